@@ -0,0 +1,131 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// These are the supported access log formats.
+const (
+	// AccessLogNone disables access logs.
+	AccessLogNone AccessLogFormat = ""
+	// AccessLogCommon is the Common Log Format.
+	AccessLogCommon AccessLogFormat = "common"
+	// AccessLogCombined is the Combined Log Format, which extends the
+	// Common Log Format by the referer and the user agent.
+	AccessLogCombined AccessLogFormat = "combined"
+)
+
+const (
+	// accessLogTimeFormat is the format of timestamps in access logs.
+	accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+type (
+	// AccessLogFormat describes the format of access log lines.
+	AccessLogFormat string
+
+	// accessLogWriter is an http.ResponseWriter which records the status
+	// and the size of the response for the access log.
+	accessLogWriter struct {
+		http.ResponseWriter
+		size   int
+		status int
+	}
+)
+
+// ParseAccessLogFormat parses an access log format from a string.
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch f := AccessLogFormat(s); f {
+	case AccessLogNone, AccessLogCommon, AccessLogCombined:
+		return f, nil
+	default:
+		return AccessLogNone, fmt.Errorf("unknown access log format '%s'", s)
+	}
+}
+
+// Write implements http.ResponseWriter.
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *accessLogWriter) WriteHeader(statusCode int) {
+	w.status = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Flush implements http.Flusher by flushing the wrapped response writer if it
+// supports flushing.
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// WithAccessLog writes a line in the configured access log format to the
+// configured access log for every request served by the handler. If access
+// logs are disabled, the handler is returned as is.
+func (api *API) WithAccessLog(h httprouter.Handle) httprouter.Handle {
+	if api.staticConfig.AccessLogFormat == AccessLogNone || api.staticConfig.AccessLog == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		aw := &accessLogWriter{ResponseWriter: w, status: http.StatusOK}
+		h(aw, req, ps)
+
+		line := formatAccessLogLine(api.staticConfig.AccessLogFormat, req, aw.status, aw.size, start)
+		api.accessLogMu.Lock()
+		_, err := fmt.Fprintln(api.staticConfig.AccessLog, line)
+		api.accessLogMu.Unlock()
+		if err != nil {
+			api.staticLogger.WithError(err).Error("Failed to write access log")
+		}
+	}
+}
+
+// formatAccessLogLine formats a request in the given access log format.
+func formatAccessLogLine(format AccessLogFormat, req *http.Request, status, size int, t time.Time) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	user := "-"
+	if req.URL.User != nil && req.URL.User.Username() != "" {
+		user = req.URL.User.Username()
+	}
+	sizeStr := "-"
+	if size > 0 {
+		sizeStr = fmt.Sprint(size)
+	}
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+		orDash(host),
+		user,
+		t.Format(accessLogTimeFormat),
+		req.Method,
+		req.URL.RequestURI(),
+		req.Proto,
+		status,
+		sizeStr,
+	)
+	if format == AccessLogCombined {
+		line += fmt.Sprintf(" %q %q", orDash(req.Referer()), orDash(req.UserAgent()))
+	}
+	return line
+}
+
+// orDash returns s or "-" if s is empty, which is how access logs mark
+// missing values.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
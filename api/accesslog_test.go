@@ -0,0 +1,92 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// TestAccessLog ensures that requests produce correctly formatted access log
+// lines.
+func TestAccessLog(t *testing.T) {
+	handler := func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("hello"))
+	}
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/balance/sub?x=1", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("Referer", "https://example.com/")
+		req.Header.Set("User-Agent", "test-agent/1.0")
+		return req
+	}
+
+	// Disabled.
+	var buf bytes.Buffer
+	api, _ := newTestAPI(Config{AccessLog: &buf})
+	api.WithAccessLog(handler)(httptest.NewRecorder(), newRequest(), nil)
+	if buf.Len() != 0 {
+		t.Fatalf("Expected no access log, got '%s'", buf.String())
+	}
+
+	// Common.
+	clf := regexp.MustCompile(`^10\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /balance/sub\?x=1 HTTP/1\.1" 201 5\n$`)
+	api, _ = newTestAPI(Config{AccessLog: &buf, AccessLogFormat: AccessLogCommon})
+	api.WithAccessLog(handler)(httptest.NewRecorder(), newRequest(), nil)
+	if !clf.MatchString(buf.String()) {
+		t.Fatalf("Unexpected common log line '%s'", buf.String())
+	}
+
+	// Combined.
+	buf.Reset()
+	api, _ = newTestAPI(Config{AccessLog: &buf, AccessLogFormat: AccessLogCombined})
+	api.WithAccessLog(handler)(httptest.NewRecorder(), newRequest(), nil)
+	line := strings.TrimSuffix(buf.String(), "\n")
+	suffix := ` 201 5 "https://example.com/" "test-agent/1.0"`
+	if !strings.HasSuffix(line, suffix) {
+		t.Fatalf("Expected line to end with '%s', got '%s'", suffix, line)
+	}
+}
+
+// TestAccessLogFlush ensures that handlers wrapped by WithAccessLog can flush
+// the response.
+func TestAccessLogFlush(t *testing.T) {
+	var flushed bool
+	handler := func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("Expected response writer to implement http.Flusher")
+		}
+		f.Flush()
+		flushed = true
+	}
+	var buf bytes.Buffer
+	api, _ := newTestAPI(Config{AccessLog: &buf, AccessLogFormat: AccessLogCommon})
+	rw := httptest.NewRecorder()
+	api.WithAccessLog(handler)(rw, httptest.NewRequest(http.MethodGet, "/health", nil), nil)
+	if !flushed || !rw.Flushed {
+		t.Fatal("Expected the response to be flushed")
+	}
+}
+
+// TestFormatAccessLogLine is a unit test for formatAccessLogLine.
+func TestFormatAccessLogLine(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/payment", nil)
+	req.RemoteAddr = "192.168.1.1:5555"
+	ts := time.Date(2022, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600))
+
+	expected := `192.168.1.1 - - [10/Oct/2022:13:55:36 -0700] "POST /payment HTTP/1.1" 204 -`
+	if line := formatAccessLogLine(AccessLogCommon, req, http.StatusNoContent, 0, ts); line != expected {
+		t.Fatalf("Expected '%s', got '%s'", expected, line)
+	}
+	expected += ` "-" "-"`
+	if line := formatAccessLogLine(AccessLogCombined, req, http.StatusNoContent, 0, ts); line != expected {
+		t.Fatalf("Expected '%s', got '%s'", expected, line)
+	}
+}
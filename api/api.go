@@ -10,6 +10,8 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/SkynetLabs/promoter/database"
@@ -17,20 +19,186 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	// ErrEmptyBody is returned when a request which requires a body has
+	// none.
+	ErrEmptyBody = errors.New("empty request body")
+
+	// ErrReadOnly is returned for writes while the API is in read-only
+	// mode.
+	ErrReadOnly = errors.New("service is in read-only mode, the database isn't writable")
+
+	// ErrShuttingDown is returned for calls which use a database session
+	// once the API started shutting down.
+	ErrShuttingDown = errors.New("service is shutting down")
+
+	// ErrInvalidSub is returned when a sub in a path is empty or consists
+	// only of whitespace.
+	ErrInvalidSub = errors.New("sub must not be empty")
+
+	// ErrSubNotAllowed is returned when a payment is made for a sub which
+	// doesn't match the configured allow-list.
+	ErrSubNotAllowed = errors.New("sub is not allowed to receive payments")
+
+	// ErrTooManyDBSessions is returned when a request couldn't get a database
+	// session because the limit of concurrent sessions is reached.
+	ErrTooManyDBSessions = errors.New("too many concurrent database sessions")
+
+	// ErrTooManyRequests is returned when a request is rejected because the
+	// limit of concurrent requests is reached.
+	ErrTooManyRequests = errors.New("too many concurrent requests")
+
+	// ErrPaymentTooOld is returned when a payment's timestamp is older than
+	// the configured maximum payment age.
+	ErrPaymentTooOld = errors.New("payment is older than the maximum payment age")
+
+	// ErrTierNotForSale is returned when a subscription is requested for a
+	// tier without a configured price.
+	ErrTierNotForSale = errors.New("no price configured for tier")
+
+	// ErrReservedTxnID is returned when a payment uses a txn ID which is
+	// reserved for txns created by the promoter itself.
+	ErrReservedTxnID = errors.New("txn ID uses a reserved prefix")
+)
+
 const (
 	// DBTxnRetryCount specifies the number of times we should retry an API
 	// call in case we run into transaction errors.
 	DBTxnRetryCount = 5
+
+	// dbSessionWaitTimeout is the maximum time a request waits for a free
+	// database session when the configured limit of concurrent sessions is
+	// reached.
+	dbSessionWaitTimeout = 5 * time.Second
 )
 
 type (
 	// API manages the http API and all of its routes.
 	API struct {
+		staticConfig   Config
 		staticDB       *database.DB
 		staticListener net.Listener
 		staticLogger   *logrus.Entry
 		staticRouter   *httprouter.Router
 		staticServer   *http.Server
+
+		// accessLogMu serializes writes to the access log.
+		accessLogMu sync.Mutex
+
+		// retryStats tallies the retries of WithDBSession.
+		retryStats retryStats
+
+		// readOnlyUntil is the time until which the API stays in read-only
+		// mode after MongoDB wasn't writable.
+		readOnlyUntil time.Time
+		readOnlyMu    sync.Mutex
+
+		// staticInFlight tracks the calls which use a database session.
+		// Once draining is set, no new calls are accepted. staticAbort is
+		// closed to abort the in-flight calls if they don't finish in
+		// time.
+		staticInFlight sync.WaitGroup
+		staticAbort    chan struct{}
+		abortOnce      sync.Once
+		draining       bool
+		inFlightMu     sync.Mutex
+
+		// staticDBSessions limits the number of concurrent database
+		// sessions. It's nil if there is no limit.
+		staticDBSessions chan struct{}
+
+		// staticRequests limits the number of concurrent requests. It's nil
+		// if there is no limit.
+		staticRequests chan struct{}
+
+		// staticPaymentCache caches the credited amounts of recently
+		// completed payments. It's nil if the cache is disabled.
+		staticPaymentCache *paymentCache
+	}
+
+	// Config contains the optional settings of the API. The zero value is a
+	// valid config which disables all optional features.
+	Config struct {
+		// AccountsAddr is the address of the accounts service. It's only
+		// used to report the service's reachability via /status.
+		AccountsAddr string
+		// APIKey is the key which authenticates requests to routes that
+		// require authentication. If it's empty, these routes reject all
+		// requests.
+		APIKey string
+		// BasePath is the prefix all routes are registered under, e.g.
+		// "/promoter" when the API is mounted behind a shared gateway. It
+		// defaults to no prefix.
+		BasePath string
+		// AllowTxnDeletion enables the DELETE /txn/:id route. It's meant for
+		// staging environments and must never be enabled in production.
+		AllowTxnDeletion bool
+		// Expvar enables the /debug/vars endpoint which exposes runtime
+		// counters via the expvar package.
+		Expvar bool
+		// DisabledFeatures lists the features whose routes are not
+		// registered. See Features for all features.
+		DisabledFeatures []string
+		// Tiers are the rules by which users' tiers are computed.
+		Tiers database.TierConfig
+		// CreditRounding is the policy for rounding the credits of incoming
+		// payments before they are stored.
+		CreditRounding RoundingPolicy
+		// MaxDBSessions is the maximum number of concurrent database
+		// sessions opened by WithDBSession. Requests beyond the limit wait
+		// for a session to become available. Zero means no limit.
+		MaxDBSessions int
+		// MaxConcurrentRequests is the maximum number of requests which are
+		// handled concurrently. Requests beyond the limit are rejected
+		// with a 503 right away. Health checks are exempt. Zero means no
+		// limit.
+		MaxConcurrentRequests int
+		// MaxLimit is the maximum number of items returned by list
+		// endpoints. Larger limits requested by callers are clamped.
+		// Defaults to DefaultMaxLimit.
+		MaxLimit int64
+		// MaxTopBalances is the maximum number of subs returned by
+		// /stats/top. Larger values requested by callers are clamped.
+		// Defaults to DefaultMaxTopBalances.
+		MaxTopBalances int
+		// MaxPaymentAge is the maximum age of payments which are accepted,
+		// based on the timestamp the payment processor passed in the
+		// payment's metadata. Payments without a timestamp are always
+		// accepted. Zero disables the check.
+		MaxPaymentAge time.Duration
+		// PaymentCacheSize is the maximum number of recently completed
+		// payments which are cached, so retries of these payments are
+		// answered without starting a database transaction. Zero disables
+		// the cache.
+		PaymentCacheSize int
+		// PaymentCacheTTL is the time a completed payment stays in the
+		// payment cache. Defaults to DefaultPaymentCacheTTL.
+		PaymentCacheTTL time.Duration
+		// AlreadyReportedStatus makes the API answer payments which were
+		// already processed with a 208 Already Reported instead of a 200.
+		// Either way, the response's AlreadyProcessed field is set.
+		AlreadyReportedStatus bool
+		// AllowedSubs is a list of glob patterns as understood by path.Match.
+		// If it's not empty, payments are only accepted for subs matching at
+		// least one of the patterns.
+		AllowedSubs []string
+		// AccessLog is the writer access log lines are written to. Access
+		// logs are disabled if it's nil.
+		AccessLog io.Writer
+		// AccessLogFormat is the format of access log lines.
+		// AccessLogNone disables access logs.
+		AccessLogFormat AccessLogFormat
+		// LogBodies enables logging of request and response bodies at Trace
+		// level. This is meant for debugging integrations and must never be
+		// enabled by default since bodies might contain sensitive data.
+		LogBodies bool
+		// LogBodiesRedact lists the JSON fields whose values are replaced
+		// before a body is logged. Matching is case-insensitive.
+		LogBodiesRedact []string
+		// ReadOnly puts the API into read-only mode permanently. All routes
+		// which write to the database are rejected with a 503 while reads
+		// keep working.
+		ReadOnly bool
 	}
 
 	// Error is the error type returned by the API in case the status code
@@ -51,8 +219,8 @@ func (err Error) Error() string {
 	return err.Message
 }
 
-// New creates a new API with the given logger and database.
-func New(log *logrus.Entry, db *database.DB, port int) (*API, error) {
+// New creates a new API with the given logger, database and config.
+func New(log *logrus.Entry, db *database.DB, port int, cfg Config) (*API, error) {
 	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
 	if err != nil {
 		return nil, err
@@ -60,10 +228,12 @@ func New(log *logrus.Entry, db *database.DB, port int) (*API, error) {
 	router := httprouter.New()
 	router.RedirectTrailingSlash = true
 	api := &API{
+		staticConfig:   cfg,
 		staticDB:       db,
 		staticListener: l,
 		staticLogger:   log,
 		staticRouter:   router,
+		staticAbort:    make(chan struct{}),
 		staticServer: &http.Server{
 			Handler: router,
 
@@ -73,7 +243,17 @@ func New(log *logrus.Entry, db *database.DB, port int) (*API, error) {
 			ReadTimeout:       10 * time.Second,
 		},
 	}
+	if cfg.MaxDBSessions > 0 {
+		api.staticDBSessions = make(chan struct{}, cfg.MaxDBSessions)
+	}
+	if cfg.MaxConcurrentRequests > 0 {
+		api.staticRequests = make(chan struct{}, cfg.MaxConcurrentRequests)
+	}
+	if cfg.PaymentCacheSize > 0 {
+		api.staticPaymentCache = newPaymentCache(cfg.PaymentCacheSize, cfg.PaymentCacheTTL)
+	}
 	api.buildHTTPRoutes()
+	api.logFeatures()
 	return api, nil
 }
 
@@ -87,29 +267,47 @@ func (api *API) ListenAndServe() error {
 	return api.staticServer.Serve(api.staticListener)
 }
 
-// Shutdown gracefully shuts down the API.
+// Shutdown gracefully shuts down the API. It stops accepting connections and
+// waits for the active ones to become idle. Calls which are still running
+// when the context expires can be waited for with WaitInFlight.
 func (api *API) Shutdown(ctx context.Context) error {
 	return api.staticServer.Shutdown(ctx)
 }
 
 // WithDBSession injects a session context into the request context of the
 // handler. In case of a MongoDB WriteConflict error, the call is retried up to
-// DBTxnRetryCount times or until the request context expires.
+// DBTxnRetryCount times or until the request context expires. Since all
+// handlers which write to the database use a session, calls are rejected right
+// away while the API is in read-only mode. Calls are tracked until they finish,
+// so that WaitInFlight can wait for them during shutdown.
 func (api *API) WithDBSession(h httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if !api.beginInFlight() {
+			api.WriteError(w, ErrShuttingDown, http.StatusServiceUnavailable)
+			return
+		}
+		defer api.staticInFlight.Done()
+		ctx, cancel := api.abortable(req.Context())
+		defer cancel()
+		req = req.WithContext(ctx)
+
+		if api.ReadOnly() {
+			api.writeReadOnlyError(w, nil)
+			return
+		}
 		numRetriesLeft := DBTxnRetryCount
-		var body []byte
-		var err error
-		if req.Body != nil {
-			// Read the request's body and replace its Body io.ReadCloser with a
-			// new one based off the read data.
-			body, err = io.ReadAll(req.Body)
-			if err != nil {
-				api.WriteError(w, errors.AddContext(err, "failed to read body"), http.StatusBadRequest)
-				return
-			}
-			_ = req.Body.Close()
+		body, err := readBody(req)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "failed to read body"), http.StatusBadRequest)
+			return
+		}
+		release, err := api.acquireDBSession(req.Context())
+		if err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(dbSessionWaitTimeout.Seconds())))
+			api.WriteError(w, err, http.StatusServiceUnavailable)
+			return
 		}
+		defer release()
 
 		// handleFn wraps a full execution of the handler, combined with a retry
 		// detection and counting. It also takes care of creating and cancelling
@@ -153,6 +351,7 @@ func (api *API) WithDBSession(h httprouter.Handle) httprouter.Handle {
 				default:
 					api.staticLogger.Tracef("Retrying call because of WriteConflict (%d out of %d). Request: %+v", numRetriesLeft, DBTxnRetryCount, req)
 					numRetriesLeft--
+					expvarRetries.Add(1)
 					return true
 				}
 			}
@@ -171,7 +370,62 @@ func (api *API) WithDBSession(h httprouter.Handle) httprouter.Handle {
 		// no more retries are needed or possible.
 		for handleFn() {
 		}
+		api.retryStats.record(DBTxnRetryCount - numRetriesLeft)
+	}
+}
+
+// acquireDBSession blocks until the number of concurrent database sessions is
+// below the configured limit. It returns a function which needs to be called
+// once the session is no longer in use. If no session becomes available
+// within dbSessionWaitTimeout or before the context expires,
+// ErrTooManyDBSessions is returned.
+func (api *API) acquireDBSession(ctx context.Context) (func(), error) {
+	if api.staticDBSessions == nil {
+		return func() {}, nil
+	}
+	timer := time.NewTimer(dbSessionWaitTimeout)
+	defer timer.Stop()
+	select {
+	case api.staticDBSessions <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errors.Compose(ErrTooManyDBSessions, ctx.Err())
+	case <-timer.C:
+		return nil, ErrTooManyDBSessions
+	}
+	return func() { <-api.staticDBSessions }, nil
+}
+
+// readBody reads the request's body and replaces its Body io.ReadCloser with a
+// new one based off the read data, so the body can be read again further down
+// the handler chain.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
 	}
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// decodeJSONBody decodes the request's JSON body into v. Missing bodies and
+// bodies which consist only of whitespace are rejected with ErrEmptyBody.
+func decodeJSONBody(req *http.Request, v interface{}) error {
+	body, err := readBody(req)
+	if err != nil {
+		return errors.AddContext(err, "failed to read body")
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ErrEmptyBody
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return errors.AddContext(err, "failed to parse body")
+	}
+	return nil
 }
 
 // WriteError an error to the API caller.
@@ -186,14 +440,79 @@ func (api *API) WriteError(w http.ResponseWriter, err error, code int) {
 	}
 }
 
+// WriteDBError writes an error which was returned by the database to the API
+// caller. The database's sentinel errors are mapped to their corresponding
+// status codes. Errors caused by an overloaded or unreachable database are
+// reported with a 503 and a Retry-After header so the caller backs off. The
+// same applies to errors caused by the database not being writable, which also
+// put the API into read-only mode. All other errors are reported as internal
+// errors.
+func (api *API) WriteDBError(w http.ResponseWriter, err error) {
+	if isDBNotWritableError(err) {
+		api.enterReadOnly()
+		api.writeReadOnlyError(w, err)
+		return
+	}
+	if isDBOverloadError(err) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(dbOverloadRetryAfter.Seconds())))
+	}
+	api.WriteError(w, err, dbErrorStatus(err))
+}
+
+// dbErrorStatus returns the status code for an error returned by the
+// database.
+func dbErrorStatus(err error) int {
+	switch {
+	case errors.Contains(err, database.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Contains(err, database.ErrDuplicateTxn):
+		return http.StatusConflict
+	case errors.Contains(err, database.ErrHoldMismatch):
+		return http.StatusConflict
+	case errors.Contains(err, database.ErrInsufficientBalance):
+		return http.StatusPaymentRequired
+	case errors.Contains(err, database.ErrInvalidPeriod):
+		return http.StatusBadRequest
+	case errors.Contains(err, database.ErrTxnNotReassignable):
+		return http.StatusBadRequest
+	case errors.Contains(err, database.ErrInvalidPrice):
+		return http.StatusBadRequest
+	case isDBOverloadError(err):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 // WriteJSON writes the object to the ResponseWriter. If the encoding fails, an
 // error is written instead. The Content-Type of the response header is set
 // accordingly.
 func (api *API) WriteJSON(w http.ResponseWriter, obj interface{}) {
-	api.staticLogger.Debug("WriteJSON", obj)
+	api.writeJSON(w, http.StatusOK, obj)
+}
+
+// writeJSON writes the object to the ResponseWriter like WriteJSON but with
+// the given status.
+func (api *API) writeJSON(w http.ResponseWriter, status int, obj interface{}) {
+	api.staticLogger.Debug("WriteJSON", status, obj)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(obj)
+	if err != nil {
+		api.staticLogger.WithError(err).Error("Failed to encode response object")
+	}
+}
+
+// WriteCreated writes the created resource to the ResponseWriter with a 201
+// status and a Location header pointing at the resource. If the encoding
+// fails, an error is logged.
+func (api *API) WriteCreated(w http.ResponseWriter, location string, obj interface{}) {
+	api.staticLogger.Debug("WriteCreated", location, obj)
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
 	err := json.NewEncoder(w).Encode(obj)
 	if err != nil {
 		api.staticLogger.WithError(err).Error("Failed to encode response object")
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// newTestAPI creates an API without a database or listener, which is
+// sufficient for testing middlewares. Everything logged by the API is written
+// to the returned buffer.
+func newTestAPI(cfg Config) (*API, *bytes.Buffer) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetLevel(logrus.TraceLevel)
+	return &API{
+		staticConfig: cfg,
+		staticLogger: logger.WithField("module", "test"),
+	}, &buf
+}
+
+// TestAcquireDBSession ensures that the number of concurrent database sessions
+// is limited.
+func TestAcquireDBSession(t *testing.T) {
+	// Without a limit, sessions can always be acquired.
+	api, _ := newTestAPI(Config{})
+	for i := 0; i < 100; i++ {
+		if _, err := api.acquireDBSession(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// With a limit, sessions beyond the limit are throttled.
+	limit := 2
+	api.staticDBSessions = make(chan struct{}, limit)
+	var releases []func()
+	for i := 0; i < limit; i++ {
+		release, err := api.acquireDBSession(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, release)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := api.acquireDBSession(ctx)
+	if !errors.Contains(err, ErrTooManyDBSessions) {
+		t.Fatalf("Expected %v, got %v", ErrTooManyDBSessions, err)
+	}
+
+	// A waiting request gets a session as soon as one is released.
+	done := make(chan error)
+	go func() {
+		_, err := api.acquireDBSession(context.Background())
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected request to wait for a session")
+	case <-time.After(100 * time.Millisecond):
+	}
+	releases[0]()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDecodeJSONBody ensures that missing and empty bodies are rejected with
+// a clear error.
+func TestDecodeJSONBody(t *testing.T) {
+	api, _ := newTestAPI(Config{})
+	tests := []struct {
+		name    string
+		body    string
+		nilBody bool
+		err     error
+	}{
+		{"nil", "", true, ErrEmptyBody},
+		{"empty", "", false, ErrEmptyBody},
+		{"whitespace", " \n\t ", false, ErrEmptyBody},
+		{"invalid", "{", false, nil},
+	}
+	// newRequest creates a request with the body of the test case.
+	newRequest := func(body string, nilBody bool) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/payment", strings.NewReader(body))
+		if nilBody {
+			req.Body = nil
+		}
+		return req
+	}
+	for _, tt := range tests {
+		var payment PaymentPOST
+		err := decodeJSONBody(newRequest(tt.body, tt.nilBody), &payment)
+		if err == nil {
+			t.Fatalf("%s: expected an error", tt.name)
+		}
+		if tt.err != nil && !errors.Contains(err, tt.err) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+		if tt.err == nil && errors.Contains(err, ErrEmptyBody) {
+			t.Fatalf("%s: unexpected %v", tt.name, err)
+		}
+
+		// The handlers respond with a 400.
+		rw := httptest.NewRecorder()
+		api.paymentPOST(rw, newRequest(tt.body, tt.nilBody), nil)
+		if rw.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status %d, got %d", tt.name, http.StatusBadRequest, rw.Code)
+		}
+	}
+
+	// A valid body is decoded.
+	var payment PaymentPOST
+	if err := decodeJSONBody(newRequest(`{"txnID":"txn"}`, false), &payment); err != nil {
+		t.Fatal(err)
+	}
+	if payment.TxnID != "txn" {
+		t.Fatalf("Unexpected payment %+v", payment)
+	}
+}
+
+// TestWriteCreated tests that WriteCreated responds with a 201, the location of
+// the created resource and the resource itself.
+func TestWriteCreated(t *testing.T) {
+	api, _ := newTestAPI(Config{})
+	rw := httptest.NewRecorder()
+	api.WriteCreated(rw, "/subscription/id", SubscriptionGET{ID: "id", Sub: "sub"})
+	if rw.Code != http.StatusCreated {
+		t.Fatal("wrong status", rw.Code)
+	}
+	if location := rw.Header().Get("Location"); location != "/subscription/id" {
+		t.Fatal("wrong location", location)
+	}
+	if ct := rw.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Fatal("wrong content type", ct)
+	}
+	var sg SubscriptionGET
+	if err := json.NewDecoder(rw.Body).Decode(&sg); err != nil {
+		t.Fatal(err)
+	}
+	if sg.ID != "id" || sg.Sub != "sub" {
+		t.Fatal("wrong body", sg)
+	}
+}
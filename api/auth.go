@@ -0,0 +1,42 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// apiKeyHeader is the header which carries the API key of authenticated
+	// requests.
+	apiKeyHeader = "X-Promoter-API-Key"
+)
+
+var (
+	// ErrUnauthorized is returned when a request to an authenticated route
+	// doesn't carry a valid API key.
+	ErrUnauthorized = errors.New("missing or invalid API key")
+)
+
+// WithAPIKey only passes requests on to the handler if they carry the
+// configured API key. If no API key is configured, all requests are rejected.
+func (api *API) WithAPIKey(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if !api.validAPIKey(req.Header.Get(apiKeyHeader)) {
+			api.WriteError(w, ErrUnauthorized, http.StatusUnauthorized)
+			return
+		}
+		h(w, req, ps)
+	}
+}
+
+// validAPIKey returns true if the given key matches the configured API key.
+func (api *API) validAPIKey(key string) bool {
+	expected := api.staticConfig.APIKey
+	if expected == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(expected)) == 1
+}
@@ -3,15 +3,21 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"gitlab.com/NebulousLabs/errors"
 )
 
 // Client is a library for interacting with Promoter's API.
 type Client struct {
-	staticAddr string
+	staticAddr     string
+	staticAPIKey   string
+	staticBasePath string
 }
 
 // NewClient creates a new Client for an API listening on the given address.
@@ -21,6 +27,26 @@ func NewClient(addr string) *Client {
 	}
 }
 
+// NewClientWithAPIKey creates a new Client for an API listening on the given
+// address which authenticates its requests with the given API key.
+func NewClientWithAPIKey(addr, apiKey string) *Client {
+	return &Client{
+		staticAddr:   addr,
+		staticAPIKey: apiKey,
+	}
+}
+
+// NewCustomClient creates a new Client for an API listening on the given
+// address with its routes registered under the given base path. If apiKey
+// isn't empty, requests are authenticated with it.
+func NewCustomClient(addr, basePath, apiKey string) *Client {
+	return &Client{
+		staticAddr:     addr,
+		staticAPIKey:   apiKey,
+		staticBasePath: normalizeBasePath(basePath),
+	}
+}
+
 // readAPIError decodes and returns an api.Error.
 func readAPIError(r io.Reader) error {
 	var apiErr Error
@@ -31,9 +57,26 @@ func readAPIError(r io.Reader) error {
 	return apiErr
 }
 
+// request performs a request with the given method and body on the provided
+// resource. If the client has an API key, the request is authenticated with
+// it.
+func (c *Client) request(method, resource string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.staticAddr+c.staticBasePath+resource, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.staticAPIKey != "" {
+		req.Header.Set(apiKeyHeader, c.staticAPIKey)
+	}
+	return http.DefaultClient.Do(req)
+}
+
 // get performs a GET request on the provided resource.
 func (c *Client) get(resource string) (*http.Response, error) {
-	return http.DefaultClient.Get(c.staticAddr + resource)
+	return c.request(http.MethodGet, resource, nil)
 }
 
 // getJSON performs a GET request on the provided resource and tries to json
@@ -54,8 +97,243 @@ func (c *Client) getJSON(resource string, obj interface{}) error {
 	return dec.Decode(obj)
 }
 
+// post performs a POST request on the provided resource with the json encoded
+// object as its body.
+func (c *Client) post(resource string, obj interface{}) (*http.Response, error) {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to marshal request body")
+	}
+	return c.request(http.MethodPost, resource, bytes.NewReader(b))
+}
+
+// postJSON performs a POST request on the provided resource and tries to json
+// decode the response body into the provided object.
+func (c *Client) postJSON(resource string, body, obj interface{}) error {
+	resp, err := c.post(resource, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Check for 200 since we expect a successful response with body. A
+	// 208 is successful as well, e.g. for a payment which was already
+	// processed.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAlreadyReported {
+		return readAPIError(resp.Body)
+	}
+	return json.NewDecoder(resp.Body).Decode(obj)
+}
+
+// postCreated performs a POST request on the provided resource and tries to
+// json decode the created resource from the response body into the provided
+// object.
+func (c *Client) postCreated(resource string, body, obj interface{}) error {
+	resp, err := c.post(resource, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Check for 201 since we expect the resource to be created.
+	if resp.StatusCode != http.StatusCreated {
+		return readAPIError(resp.Body)
+	}
+	return json.NewDecoder(resp.Body).Decode(obj)
+}
+
+// postNoContent performs a POST request on the provided resource and expects
+// a successful response without a body.
+func (c *Client) postNoContent(resource string, obj interface{}) error {
+	return expectNoContent(c.post(resource, obj))
+}
+
+// deleteNoContent performs a DELETE request on the provided resource and
+// expects a successful response without a body.
+func (c *Client) deleteNoContent(resource string) error {
+	return expectNoContent(c.request(http.MethodDelete, resource, nil))
+}
+
+// expectNoContent checks that the response is a successful response without
+// a body. Otherwise, the API's error is returned.
+func expectNoContent(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Check for 204 since we expect a successful response without body.
+	if resp.StatusCode != http.StatusNoContent {
+		return readAPIError(resp.Body)
+	}
+	return nil
+}
+
+// DebugVars calls the /debug/vars endpoint on the server.
+func (c *Client) DebugVars() (vars map[string]interface{}, err error) {
+	err = c.getJSON("/debug/vars", &vars)
+	return
+}
+
+// Alerts calls the /alerts endpoint on the server.
+func (c *Client) Alerts() (ag AlertsGET, err error) {
+	err = c.getJSON("/alerts", &ag)
+	return
+}
+
+// Balance calls the /balance/:sub endpoint on the server.
+func (c *Client) Balance(sub string) (bg BalanceGET, err error) {
+	err = c.getJSON("/balance/"+url.PathEscape(sub), &bg)
+	return
+}
+
+// UserEligible calls the /user/:sub/eligible endpoint on the server.
+func (c *Client) UserEligible(sub string, tier int) (ueg UserEligibleGET, err error) {
+	values := url.Values{}
+	values.Set("tier", strconv.Itoa(tier))
+	err = c.getJSON(fmt.Sprintf("/user/%s/eligible?%s", url.PathEscape(sub), values.Encode()), &ueg)
+	return
+}
+
+// Debits calls the /debits/:sub endpoint on the server.
+func (c *Client) Debits(sub string, limit, offset int) (p Page[TxnGET], err error) {
+	values := url.Values{}
+	values.Set("limit", strconv.Itoa(limit))
+	values.Set("offset", strconv.Itoa(offset))
+	err = c.getJSON(fmt.Sprintf("/debits/%s?%s", url.PathEscape(sub), values.Encode()), &p)
+	return
+}
+
+// DebugIndexes calls the /debug/indexes endpoint on the server.
+func (c *Client) DebugIndexes() (ig IndexesGET, err error) {
+	err = c.getJSON("/debug/indexes", &ig)
+	return
+}
+
+// DebugRetries calls the /debug/retries endpoint on the server. If reset is
+// true, the server resets its tallies after returning them.
+func (c *Client) DebugRetries(reset bool) (rg RetriesGET, err error) {
+	values := url.Values{}
+	if reset {
+		values.Set("reset", "true")
+	}
+	err = c.getJSON("/debug/retries?"+values.Encode(), &rg)
+	return
+}
+
+// DebugOrphanTxns calls the /debug/txns/orphans endpoint on the server.
+func (c *Client) DebugOrphanTxns() (og OrphanTxnsGET, err error) {
+	err = c.getJSON("/debug/txns/orphans", &og)
+	return
+}
+
+// DeleteTxn calls the DELETE /txn/:id endpoint on the server.
+func (c *Client) DeleteTxn(id string) error {
+	return c.deleteNoContent("/txn/" + url.PathEscape(id))
+}
+
+// GetSubscription calls the /subscription/:id endpoint on the server.
+func (c *Client) GetSubscription(id string) (sg SubscriptionGET, err error) {
+	err = c.getJSON("/subscription/"+url.PathEscape(id), &sg)
+	return
+}
+
+// Txn calls the /txn/:id endpoint on the server.
+func (c *Client) Txn(id string) (tg TxnGET, err error) {
+	err = c.getJSON("/txn/"+url.PathEscape(id), &tg)
+	return
+}
+
+// TxnForAudit calls the /txn/:id endpoint on the server in audit mode, which
+// returns deleted txns as well.
+func (c *Client) TxnForAudit(id string) (tg TxnGET, err error) {
+	err = c.getJSON("/txn/"+url.PathEscape(id)+"?audit=true", &tg)
+	return
+}
+
+// TxnsSince calls the /txns/since endpoint on the server. The cursor is
+// either empty, the ID of a txn or a timestamp in RFC3339 format.
+func (c *Client) TxnsSince(after string, limit int) (tsg TxnsSinceGET, err error) {
+	values := url.Values{}
+	if after != "" {
+		values.Set("after", after)
+	}
+	values.Set("limit", strconv.Itoa(limit))
+	err = c.getJSON("/txns/since?"+values.Encode(), &tsg)
+	return
+}
+
+// ReassignTxn calls the /txn/:id/reassign endpoint on the server.
+func (c *Client) ReassignTxn(id, sub string) (trr TxnReassignResponse, err error) {
+	err = c.postJSON("/txn/"+url.PathEscape(id)+"/reassign", TxnReassignPOST{Sub: sub}, &trr)
+	return
+}
+
+// Status calls the /status endpoint on the server.
+func (c *Client) Status() (sg StatusGET, err error) {
+	err = c.getJSON("/status", &sg)
+	return
+}
+
 // Health calls the /health endpoint on the server.
 func (c *Client) Health() (hg HealthGET, err error) {
 	err = c.getJSON("/health", &hg)
 	return
 }
+
+// Payment calls the /payment endpoint on the server.
+func (c *Client) Payment(txnID, sub string, credits float64) (PaymentResponse, error) {
+	return c.PaymentWithMetadata(txnID, sub, credits, nil)
+}
+
+// PaymentWithMetadata calls the /payment endpoint on the server with metadata
+// which is stored with the payment's txn.
+func (c *Client) PaymentWithMetadata(txnID, sub string, credits float64, metadata map[string]string) (pr PaymentResponse, err error) {
+	err = c.postJSON("/payment", PaymentPOST{
+		TxnID:    txnID,
+		Sub:      sub,
+		Credits:  credits,
+		Metadata: metadata,
+	}, &pr)
+	return
+}
+
+// Subscription calls the /subscription endpoint on the server.
+func (c *Client) Subscription(sp SubscriptionPOST) (sg SubscriptionGET, err error) {
+	err = c.postCreated("/subscription", sp, &sg)
+	return
+}
+
+// StatsRevenue calls the /stats/revenue endpoint on the server.
+func (c *Client) StatsRevenue(from, to time.Time) (srg StatsRevenueGET, err error) {
+	values := url.Values{}
+	values.Set("from", from.Format(time.RFC3339))
+	values.Set("to", to.Format(time.RFC3339))
+	err = c.getJSON("/stats/revenue?"+values.Encode(), &srg)
+	return
+}
+
+// StatsTiers calls the /stats/tiers endpoint on the server.
+func (c *Client) StatsTiers(from, to time.Time) (stg StatsTiersGET, err error) {
+	values := url.Values{}
+	values.Set("from", from.Format(time.RFC3339))
+	values.Set("to", to.Format(time.RFC3339))
+	err = c.getJSON("/stats/tiers?"+values.Encode(), &stg)
+	return
+}
+
+// StatsTop calls the /stats/top endpoint on the server.
+func (c *Client) StatsTop(n int) (stg StatsTopGET, err error) {
+	values := url.Values{}
+	values.Set("n", strconv.Itoa(n))
+	err = c.getJSON("/stats/top?"+values.Encode(), &stg)
+	return
+}
+
+// StatsSubscribers calls the /stats/subscribers endpoint on the server.
+func (c *Client) StatsSubscribers(at time.Time) (ssg StatsSubscribersGET, err error) {
+	values := url.Values{}
+	values.Set("at", at.Format(time.RFC3339))
+	err = c.getJSON("/stats/subscribers?"+values.Encode(), &ssg)
+	return
+}
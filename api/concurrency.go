@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// concurrencyLimitRetryAfter is the time we ask clients to wait before
+	// retrying a request which was rejected due to the concurrency limit.
+	concurrencyLimitRetryAfter = time.Second
+)
+
+// WithConcurrencyLimit rejects requests with a 503 while the configured
+// maximum number of requests is being handled already. Since requests are
+// rejected right away instead of waiting, a burst of requests can't pile up
+// buffered bodies and database sessions.
+func (api *API) WithConcurrencyLimit(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if api.staticRequests == nil {
+			h(w, req, ps)
+			return
+		}
+		select {
+		case api.staticRequests <- struct{}{}:
+		default:
+			expvarRejectedRequests.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(concurrencyLimitRetryAfter.Seconds())))
+			api.WriteError(w, ErrTooManyRequests, http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-api.staticRequests }()
+		h(w, req, ps)
+	}
+}
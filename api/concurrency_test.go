@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// TestWithConcurrencyLimit ensures that requests beyond the concurrency limit
+// are rejected with a 503 while routes which bypass the limit keep working.
+func TestWithConcurrencyLimit(t *testing.T) {
+	limit := 2
+	api, _ := newTestAPI(Config{})
+	api.staticRouter = httprouter.New()
+	api.staticRequests = make(chan struct{}, limit)
+
+	// The busy route blocks until it's released.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	api.registerRoute(http.MethodGet, "/busy", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		started <- struct{}{}
+		<-release
+		api.WriteSuccess(w)
+	})
+	api.registerUnlimitedRoute(http.MethodGet, "/probe", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		api.WriteSuccess(w)
+	})
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		api.staticRouter.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		return rw
+	}
+
+	// Occupy all slots.
+	var wg sync.WaitGroup
+	codes := make([]int, limit)
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = serve("/busy").Code
+		}(i)
+		<-started
+	}
+
+	// A burst of further requests is rejected, on both versions of the
+	// route.
+	rejected := expvarRejectedRequests.Value()
+	for _, path := range []string{"/busy", "/v1/busy", "/busy"} {
+		rw := serve(path)
+		if rw.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s: expected status %d, got %d", path, http.StatusServiceUnavailable, rw.Code)
+		}
+		if rw.Header().Get("Retry-After") == "" {
+			t.Fatalf("%s: expected a Retry-After header", path)
+		}
+	}
+	if expvarRejectedRequests.Value() != rejected+3 {
+		t.Fatalf("Expected %d rejected requests, got %d", rejected+3, expvarRejectedRequests.Value())
+	}
+
+	// The probe still works.
+	if rw := serve("/probe"); rw.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, rw.Code)
+	}
+
+	// Once the slots are released, requests are accepted again.
+	close(release)
+	wg.Wait()
+	for _, code := range codes {
+		if code != http.StatusNoContent {
+			t.Fatalf("Expected status %d, got %d", http.StatusNoContent, code)
+		}
+	}
+	go func() { <-started }()
+	if rw := serve("/busy"); rw.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, rw.Code)
+	}
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"expvar"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// These are the runtime counters published via expvar. They are global since
+// expvar doesn't allow for publishing the same name twice.
+var (
+	// expvarPayments counts the payments credited by the API. Replayed
+	// payments aren't counted.
+	expvarPayments = expvar.NewInt("promoter_payments")
+
+	// expvarCredits sums up the credits of all payments credited by the
+	// API.
+	expvarCredits = expvar.NewFloat("promoter_credits")
+
+	// expvarStalePayments counts the payments which were rejected for
+	// being older than the maximum payment age.
+	expvarStalePayments = expvar.NewInt("promoter_stale_payments")
+
+	// expvarPaymentCacheHits counts the payments which were answered from
+	// the payment cache.
+	expvarPaymentCacheHits = expvar.NewInt("promoter_payment_cache_hits")
+
+	// expvarRejectedRequests counts the requests which were rejected because
+	// the limit of concurrent requests was reached.
+	expvarRejectedRequests = expvar.NewInt("promoter_rejected_requests")
+
+	// expvarRetries counts the number of times a call was retried due to a
+	// WriteConflict.
+	expvarRetries = expvar.NewInt("promoter_db_retries")
+
+	// expvarRetryBuckets counts the calls wrapped by WithDBSession by how
+	// often they were retried, i.e. "0", "1" or "2+" times.
+	expvarRetryBuckets = expvar.NewMap("promoter_db_retry_buckets")
+)
+
+// debugVarsGET serves the variables published via expvar.
+func (api *API) debugVarsGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	expvar.Handler().ServeHTTP(w, req)
+}
@@ -2,12 +2,276 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/SkynetLabs/promoter/database"
 	"github.com/julienschmidt/httprouter"
 	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	// defaultLimit is the number of items returned by list endpoints if the
+	// caller doesn't specify a limit.
+	defaultLimit = 100
+
+	// DefaultMaxLimit is the default maximum number of items returned by
+	// list endpoints. Larger limits are clamped.
+	DefaultMaxLimit = 1000
+
+	// defaultTopBalances is the number of subs returned by /stats/top if
+	// the caller doesn't specify n.
+	defaultTopBalances = 10
+
+	// DefaultMaxTopBalances is the default maximum number of subs returned
+	// by /stats/top. Larger values of n are clamped.
+	DefaultMaxTopBalances = 100
+)
+
+// alertsGET returns the subs flagged by the credit anomaly detector.
+func (api *API) alertsGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	alerts, err := api.staticDB.Alerts(req.Context())
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	ag := AlertsGET{
+		Alerts: make([]AlertGET, 0, len(alerts)),
+	}
+	for _, alert := range alerts {
+		ag.Alerts = append(ag.Alerts, AlertGET{
+			Sub:            alert.Sub,
+			Credits:        alert.Credits,
+			FirstFlaggedAt: alert.FirstFlaggedAt,
+			LastFlaggedAt:  alert.LastFlaggedAt,
+		})
+	}
+	api.WriteJSON(w, ag)
+}
+
+// balanceGET returns the balance of the given sub along with its components.
+func (api *API) balanceGET(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	sub, err := parsePathSub(ps)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	credit, spent, net, err := api.staticDB.BalanceBreakdown(req.Context(), sub)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	_, available, err := api.staticDB.UserBalance(req.Context(), sub)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	api.WriteJSON(w, BalanceGET{
+		Sub:       sub,
+		Balance:   net,
+		Available: available,
+		Credit:    credit,
+		Spent:     spent,
+	})
+}
+
+// userEligibleGET reports whether the given sub is eligible for the tier
+// passed in the 'tier' query parameter. The user isn't promoted, this only
+// surfaces the tier rules, e.g. for upselling.
+func (api *API) userEligibleGET(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	sub, err := parsePathSub(ps)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	tierStr := req.FormValue("tier")
+	if tierStr == "" {
+		api.WriteError(w, errors.New("missing 'tier' parameter"), http.StatusBadRequest)
+		return
+	}
+	tier, err := strconv.Atoi(tierStr)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "invalid 'tier' parameter"), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	cfg := api.staticConfig.Tiers
+	view, err := api.staticDB.UserView(req.Context(), sub, now.Add(-cfg.GracePeriod))
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	eligibility := database.EligibilityForTier(view, cfg, tier, now)
+	api.WriteJSON(w, UserEligibleGET{
+		Sub:         sub,
+		Tier:        tier,
+		CurrentTier: eligibility.CurrentTier,
+		Eligible:    eligibility.Eligible,
+		Reason:      eligibility.Reason,
+		Gap:         eligibility.Gap,
+	})
+}
+
+// debitsGET returns a page of the debits of the given sub, i.e. the txns
+// which reduced their balance, ordered from newest to oldest. The page can be
+// controlled via the 'limit' and 'offset' query parameters.
+func (api *API) debitsGET(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	sub, err := parsePathSub(ps)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	limit, offset, err := parsePagination(req, api.maxLimit())
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	txns, total, err := api.staticDB.ListDebits(req.Context(), sub, limit, offset)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	debits := make([]TxnGET, 0, len(txns))
+	for _, txn := range txns {
+		debits = append(debits, txnGETFromTxn(txn))
+	}
+	api.WriteJSON(w, newPage(debits, total, limit, offset))
+}
+
+// txnsSinceGET returns a page of txns which were created after the cursor
+// given by the 'after' query parameter, ordered from oldest to newest. The
+// cursor is either the ID of a txn or a timestamp in RFC3339 format. Without
+// a cursor, the txns are returned from the oldest one on. The response
+// contains the cursor for the next page, so external systems can poll for new
+// txns without missing or repeating any. Txns only show up once they are
+// older than the database's TxnVisibilityLag.
+func (api *API) txnsSinceGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	limit, _, err := parsePagination(req, api.maxLimit())
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	after := req.URL.Query().Get("after")
+	var pos database.TxnPosition
+	if t, err := time.Parse(time.RFC3339, after); err == nil {
+		pos.CreatedAt = t
+	} else if after != "" {
+		// The txn might have been deleted since it was returned, so look
+		// it up in audit mode.
+		txn, err := api.staticDB.GetTxnForAudit(req.Context(), after)
+		if err != nil {
+			api.WriteDBError(w, errors.AddContext(err, "failed to look up cursor txn"))
+			return
+		}
+		pos = txn.Position()
+	}
+	txns, err := api.staticDB.TxnsAfter(req.Context(), pos, limit)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	tsg := TxnsSinceGET{
+		Txns: make([]TxnGET, 0, len(txns)),
+		Next: after,
+	}
+	for _, txn := range txns {
+		tsg.Txns = append(tsg.Txns, txnGETFromTxn(txn))
+	}
+	if len(txns) > 0 {
+		tsg.Next = txns[len(txns)-1].ID
+	}
+	api.WriteJSON(w, tsg)
+}
+
+// debugIndexesGET compares the indexes the service expects with the ones that
+// exist in the database to help with debugging schema drift.
+func (api *API) debugIndexesGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	report, err := api.staticDB.IndexReport(req.Context())
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	ig := IndexesGET{
+		Collections: make(map[string]CollectionIndexesGET, len(report)),
+	}
+	for collName, ci := range report {
+		ig.Collections[collName] = CollectionIndexesGET{
+			Expected:   ci.Expected,
+			Existing:   ci.Existing,
+			Missing:    ci.Missing,
+			Unexpected: ci.Unexpected,
+		}
+	}
+	api.WriteJSON(w, ig)
+}
+
+// debugSchemaGET returns the collections and indexes of the database schema.
+func (api *API) debugSchemaGET(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	b, err := database.SchemaJSON()
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, json.RawMessage(b))
+}
+
+// debugTierPOST computes the tier of a hypothetical user state under the
+// configured tier rules without touching any real data.
+func (api *API) debugTierPOST(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var dtp DebugTierPOST
+	err := decodeJSONBody(req, &dtp)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	view := database.UserView{
+		Balance:       dtp.Balance,
+		Subscriptions: make([]database.Subscription, 0, len(dtp.Subscriptions)),
+	}
+	for _, s := range dtp.Subscriptions {
+		view.Subscriptions = append(view.Subscriptions, database.Subscription{
+			Tier: s.Tier,
+			From: s.From,
+			To:   s.To,
+		})
+	}
+	at := dtp.At
+	if at.IsZero() {
+		at = time.Now()
+	}
+	decision := database.ExplainTierForUser(view, api.staticConfig.Tiers, at)
+	resp := DebugTierResponse{
+		Tier: decision.Tier,
+		Rule: decision.Rule,
+	}
+	if decision.Subscription >= 0 {
+		resp.Subscription = &decision.Subscription
+	}
+	api.WriteJSON(w, resp)
+}
+
+// debugOrphanTxnsGET returns all txns whose sub has no user.
+func (api *API) debugOrphanTxnsGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	txns, err := api.staticDB.OrphanTxns(req.Context())
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	og := OrphanTxnsGET{
+		Txns: make([]TxnGET, 0, len(txns)),
+	}
+	for _, txn := range txns {
+		og.Txns = append(og.Txns, txnGETFromTxn(txn))
+	}
+	api.WriteJSON(w, og)
+}
+
 // healthGET returns the status of the service
 func (api *API) healthGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	ph := api.staticDB.Health()
@@ -19,21 +283,416 @@ func (api *API) healthGET(w http.ResponseWriter, req *http.Request, _ httprouter
 // paymentPOST registers a new payment. The payment is represented by a txn id,
 // user's sub, and an amount. The amount is in credits that are to be added to
 // the user's balance. The txn id ensures the idempotency of the operation.
+// The credits are rounded according to the configured policy and the applied
+// amount is returned. For a payment which was processed before, that's the
+// amount which was applied back then.
 func (api *API) paymentPOST(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	var payment PaymentPOST
-	err := json.NewDecoder(req.Body).Decode(&payment)
+	err := decodeJSONBody(req, &payment)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if status, err := api.checkPayment(&payment, time.Now()); err != nil {
+		if errors.Contains(err, ErrPaymentTooOld) {
+			expvarStalePayments.Add(1)
+		}
+		api.WriteError(w, err, status)
+		return
+	}
+	payment.Credits = api.staticConfig.CreditRounding.Round(payment.Credits)
+	if math.IsNaN(payment.Credits) || math.IsInf(payment.Credits, 0) {
+		api.WriteError(w, errors.New("credits amount rounds to an invalid number"), http.StatusBadRequest)
+		return
+	}
+	if payment.Credits <= 0 {
+		api.WriteError(w, errors.New("credits amount rounds to zero"), http.StatusBadRequest)
+		return
+	}
+	credited, balance, inserted, err := api.staticDB.CreditUserWithBalance(req.Context(), payment.Sub, payment.Credits, payment.TxnID, payment.Metadata)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	if inserted {
+		expvarPayments.Add(1)
+		expvarCredits.Add(credited)
+	}
+	response := PaymentResponse{
+		Credits:          credited,
+		Balance:          balance,
+		AlreadyProcessed: !inserted,
+	}
+	api.writePaymentResponse(w, response)
+	// Only cache payments which made it into the database. Otherwise a
+	// retry would be answered from the cache without ever being credited.
+	if api.staticPaymentCache != nil && committed(w) {
+		api.staticPaymentCache.add(payment.TxnID, payment.Sub, credited, time.Now())
+	}
+}
+
+// checkPayment runs the checks a payment needs to pass before it may be
+// credited. If it fails, the returned status is the one to reject the payment
+// with.
+func (api *API) checkPayment(payment *PaymentPOST, now time.Time) (int, error) {
+	if err := payment.Validate(); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if !api.subAllowed(payment.Sub) {
+		return http.StatusForbidden, ErrSubNotAllowed
+	}
+	err := api.checkPaymentAge(payment, now)
+	if errors.Contains(err, ErrPaymentTooOld) {
+		return http.StatusUnprocessableEntity, err
+	}
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	return http.StatusOK, nil
+}
+
+// writePaymentResponse writes the response to a payment. Payments which were
+// already processed are answered with a 208 if Config.AlreadyReportedStatus
+// is set and a 200 otherwise.
+func (api *API) writePaymentResponse(w http.ResponseWriter, response PaymentResponse) {
+	status := http.StatusOK
+	if response.AlreadyProcessed && api.staticConfig.AlreadyReportedStatus {
+		status = http.StatusAlreadyReported
+	}
+	api.writeJSON(w, status, response)
+}
+
+// subscriptionPOST creates a new subscription and pays for it from the user's
+// balance. The price is the one configured for the tier, tiers without a price
+// can't be subscribed to. The created subscription is returned with a 201 and
+// its location.
+func (api *API) subscriptionPOST(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var sp SubscriptionPOST
+	err := decodeJSONBody(req, &sp)
 	if err != nil {
-		api.WriteError(w, errors.AddContext(err, "failed to parse body"), http.StatusBadRequest)
+		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	if err = payment.Validate(); err != nil {
+	sp.Sub = strings.TrimSpace(sp.Sub)
+	if err = sp.Validate(); err != nil {
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	err = api.staticDB.CreditUser(req.Context(), payment.Sub, payment.Credits, payment.TxnID)
+	price, ok := api.staticConfig.Tiers.Prices[sp.Tier]
+	if !ok {
+		api.WriteError(w, ErrTierNotForSale, http.StatusBadRequest)
+		return
+	}
+	s, err := api.staticDB.NewSubscription(req.Context(), sp.Sub, sp.Tier, sp.From, sp.To, price)
 	if err != nil {
-		api.WriteError(w, err, http.StatusInternalServerError)
+		api.WriteDBError(w, err)
+		return
+	}
+	err = api.staticDB.ChargeSubscription(req.Context(), s.ID)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	api.WriteCreated(w, api.resourcePath(req, "/subscription/"+s.ID.Hex()), subscriptionGETFromSubscription(*s))
+}
+
+// subscriptionGET returns the subscription with the given ID.
+func (api *API) subscriptionGET(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "invalid subscription id"), http.StatusBadRequest)
+		return
+	}
+	s, err := api.staticDB.GetSubscription(req.Context(), id)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	api.WriteJSON(w, subscriptionGETFromSubscription(*s))
+}
+
+// txnGET returns the txn with the given ID. Deleted txns are only returned if
+// the 'audit' query parameter is true. Since txns carry the payment metadata,
+// it requires the API key.
+func (api *API) txnGET(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var audit bool
+	if auditStr := req.URL.Query().Get("audit"); auditStr != "" {
+		var err error
+		audit, err = strconv.ParseBool(auditStr)
+		if err != nil {
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	getTxn := api.staticDB.GetTxn
+	if audit {
+		getTxn = api.staticDB.GetTxnForAudit
+	}
+	txn, err := getTxn(req.Context(), ps.ByName("id"))
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	api.WriteJSON(w, txnGETFromTxn(*txn))
+}
+
+// txnDELETE deletes a txn, reversing its effect on the balance of its user.
+// The txn is kept for auditing.
+func (api *API) txnDELETE(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	err := api.staticDB.DeleteTxn(req.Context(), ps.ByName("id"))
+	if err != nil {
+		api.WriteDBError(w, err)
 		return
 	}
 	api.WriteSuccess(w)
 }
+
+// txnReassignPOST moves a txn to another sub, e.g. because it was credited to
+// the wrong sub.
+func (api *API) txnReassignPOST(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var trp TxnReassignPOST
+	err := decodeJSONBody(req, &trp)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	sub := strings.TrimSpace(trp.Sub)
+	if sub == "" {
+		api.WriteError(w, ErrInvalidSub, http.StatusBadRequest)
+		return
+	}
+	if !api.subAllowed(sub) {
+		api.WriteError(w, ErrSubNotAllowed, http.StatusForbidden)
+		return
+	}
+	// Remember the txn's current sub to report its balance afterwards.
+	txn, err := api.staticDB.GetTxn(req.Context(), ps.ByName("id"))
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	fromSub := txn.Sub
+	txn, err = api.staticDB.ReassignTxn(req.Context(), txn.ID, sub)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	fromBalance, _, err := api.staticDB.UserBalance(req.Context(), fromSub)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	toBalance, _, err := api.staticDB.UserBalance(req.Context(), sub)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	api.WriteJSON(w, TxnReassignResponse{
+		Txn:         txnGETFromTxn(*txn),
+		FromSub:     fromSub,
+		FromBalance: fromBalance,
+		ToBalance:   toBalance,
+	})
+}
+
+// checkPaymentAge returns ErrPaymentTooOld if the payment's timestamp is older
+// than the configured maximum payment age. This guards against stale webhook
+// deliveries which are replayed after an outage. Payments without a timestamp
+// bypass the check.
+func (api *API) checkPaymentAge(payment *PaymentPOST, now time.Time) error {
+	maxAge := api.staticConfig.MaxPaymentAge
+	if maxAge <= 0 {
+		return nil
+	}
+	ts, ok, err := payment.Timestamp()
+	if err != nil || !ok {
+		return err
+	}
+	if age := now.Sub(ts); age > maxAge {
+		return errors.AddContext(ErrPaymentTooOld, fmt.Sprintf("age %v exceeds %v", age.Round(time.Second), maxAge))
+	}
+	return nil
+}
+
+// subAllowed returns true if payments are accepted for the given sub. That's
+// the case if the sub matches any of the configured patterns or if there are
+// no patterns configured at all.
+func (api *API) subAllowed(sub string) bool {
+	if len(api.staticConfig.AllowedSubs) == 0 {
+		return true
+	}
+	for _, pattern := range api.staticConfig.AllowedSubs {
+		if ok, err := path.Match(pattern, sub); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// statsTiersGET returns the revenue of the subscriptions which were active
+// within the given time window, grouped by tier.
+func (api *API) statsTiersGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	from, to, err := parseTimeRange(req)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	tiers, err := api.staticDB.SumByTier(req.Context(), from, to)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	api.WriteJSON(w, StatsTiersGET{
+		Tiers: tiers,
+	})
+}
+
+// statsSubscribersGET returns the number of subs with an active subscription
+// grouped by tier. The optional 'at' query parameter specifies the point in
+// time to look at and defaults to now.
+func (api *API) statsSubscribersGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	at := time.Now()
+	if atStr := req.URL.Query().Get("at"); atStr != "" {
+		var err error
+		at, err = time.Parse(time.RFC3339, atStr)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "failed to parse 'at'"), http.StatusBadRequest)
+			return
+		}
+	}
+	subscribers, err := api.staticDB.SubscribersByTier(req.Context(), at)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	api.WriteJSON(w, StatsSubscribersGET{
+		Tiers: subscribers,
+	})
+}
+
+// statsTopGET returns the subs with the highest balances. The optional 'n'
+// query parameter specifies the number of subs and is silently clamped to the
+// configured maximum. Since it exposes the balances of individual users, it
+// requires the API key.
+func (api *API) statsTopGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	n := defaultTopBalances
+	if nStr := req.URL.Query().Get("n"); nStr != "" {
+		var err error
+		n, err = strconv.Atoi(nStr)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "failed to parse 'n'"), http.StatusBadRequest)
+			return
+		}
+		if n <= 0 {
+			api.WriteError(w, errors.New("'n' must be positive"), http.StatusBadRequest)
+			return
+		}
+	}
+	if maxN := api.maxTopBalances(); n > maxN {
+		n = maxN
+	}
+	balances, err := api.staticDB.TopBalances(req.Context(), n)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	users := make([]UserBalanceGET, 0, len(balances))
+	for _, b := range balances {
+		users = append(users, UserBalanceGET{
+			Sub:     b.Sub,
+			Balance: b.Balance,
+		})
+	}
+	api.WriteJSON(w, StatsTopGET{
+		N:     n,
+		Users: users,
+	})
+}
+
+// statsRevenueGET returns the revenue of all subscriptions within the given
+// time window. Subscriptions which partially overlap the window are prorated.
+func (api *API) statsRevenueGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	from, to, err := parseTimeRange(req)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	revenue, err := api.staticDB.SubscriptionRevenue(req.Context(), from, to)
+	if err != nil {
+		api.WriteDBError(w, err)
+		return
+	}
+	api.WriteJSON(w, StatsRevenueGET{
+		Revenue: revenue,
+	})
+}
+
+// maxLimit returns the maximum number of items returned by list endpoints.
+func (api *API) maxLimit() int64 {
+	if api.staticConfig.MaxLimit <= 0 {
+		return DefaultMaxLimit
+	}
+	return api.staticConfig.MaxLimit
+}
+
+// maxTopBalances returns the maximum number of subs returned by /stats/top.
+func (api *API) maxTopBalances() int {
+	if api.staticConfig.MaxTopBalances <= 0 {
+		return DefaultMaxTopBalances
+	}
+	return api.staticConfig.MaxTopBalances
+}
+
+// parsePathSub returns the 'sub' path parameter of sub-keyed routes with
+// surrounding whitespace removed. Subs which are empty after trimming are
+// rejected with ErrInvalidSub.
+func parsePathSub(ps httprouter.Params) (string, error) {
+	sub := strings.TrimSpace(ps.ByName("sub"))
+	if sub == "" {
+		return "", ErrInvalidSub
+	}
+	return sub, nil
+}
+
+// parsePagination parses the optional 'limit' and 'offset' query parameters
+// shared by all list endpoints. The limit defaults to defaultLimit and is
+// silently clamped to maxLimit. Since the limit is returned with every page,
+// callers can tell the effective limit from the response.
+func parsePagination(req *http.Request, maxLimit int64) (limit, offset int64, err error) {
+	query := req.URL.Query()
+	limit = defaultLimit
+	if l := query.Get("limit"); l != "" {
+		limit, err = strconv.ParseInt(l, 10, 64)
+		if err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("invalid 'limit' %s", l)
+		}
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	if o := query.Get("offset"); o != "" {
+		offset, err = strconv.ParseInt(o, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid 'offset' %s", o)
+		}
+	}
+	return limit, offset, nil
+}
+
+// parseTimeRange parses the mandatory 'from' and 'to' query parameters of the
+// request. Both are expected in RFC3339 format.
+func parseTimeRange(req *http.Request) (from, to time.Time, err error) {
+	query := req.URL.Query()
+	from, err = time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.AddContext(err, "failed to parse 'from'")
+	}
+	to, err = time.Parse(time.RFC3339, query.Get("to"))
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.AddContext(err, "failed to parse 'to'")
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("'from' (%v) must be before 'to' (%v)", from, to)
+	}
+	return from, to, nil
+}
@@ -0,0 +1,351 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/promoter/database"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestSubAllowed ensures that the sub allow-list is enforced when configured
+// and that all subs are accepted when it's empty.
+func TestSubAllowed(t *testing.T) {
+	api, _ := newTestAPI(Config{})
+	if !api.subAllowed("anysub") {
+		t.Fatal("Expected all subs to be allowed with an empty allow-list")
+	}
+
+	api, _ = newTestAPI(Config{
+		AllowedSubs: []string{"tenant-a:*", "exact-sub"},
+	})
+	tests := []struct {
+		sub     string
+		allowed bool
+	}{
+		{"tenant-a:123", true},
+		{"exact-sub", true},
+		{"tenant-b:123", false},
+		{"exact-sub-2", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if api.subAllowed(tt.sub) != tt.allowed {
+			t.Errorf("Expected sub '%s' allowed to be %v", tt.sub, tt.allowed)
+		}
+	}
+
+	// A payment for a disallowed sub should be rejected with a 403 before it
+	// ever reaches the database.
+	rw := httptest.NewRecorder()
+	body := `{"txnID":"txn","sub":"tenant-b:123","credits":1}`
+	req := httptest.NewRequest(http.MethodPost, "/payment", strings.NewReader(body))
+	api.paymentPOST(rw, req, nil)
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, rw.Code)
+	}
+	var apiErr Error
+	if err := json.NewDecoder(rw.Body).Decode(&apiErr); err != nil {
+		t.Fatal(err)
+	}
+	if apiErr.Message != ErrSubNotAllowed.Error() {
+		t.Fatalf("Expected error '%v', got '%v'", ErrSubNotAllowed, apiErr)
+	}
+}
+
+// TestParsePathSub ensures that subs in paths are normalized and that empty
+// subs are rejected before they reach the database.
+func TestParsePathSub(t *testing.T) {
+	tests := []struct {
+		sub        string
+		normalized string
+		err        error
+	}{
+		{"sub", "sub", nil},
+		{"  sub\t", "sub", nil},
+		{"tenant:some sub", "tenant:some sub", nil},
+		{"", "", ErrInvalidSub},
+		{"   ", "", ErrInvalidSub},
+		{"\t\n", "", ErrInvalidSub},
+	}
+	for _, tt := range tests {
+		sub, err := parsePathSub(httprouter.Params{{Key: "sub", Value: tt.sub}})
+		if err != tt.err {
+			t.Errorf("Expected error %v for sub '%s', got %v", tt.err, tt.sub, err)
+		}
+		if sub != tt.normalized {
+			t.Errorf("Expected sub '%s' to be normalized to '%s', got '%s'", tt.sub, tt.normalized, sub)
+		}
+	}
+
+	// URL-encoded whitespace is rejected by all sub-keyed routes.
+	api, _ := newTestAPI(Config{})
+	api.staticRouter = httprouter.New()
+	api.buildHTTPRoutes()
+	for _, p := range []string{
+		"/balance/%20",
+		"/balance/%20%09%0A",
+		"/debits/%20",
+		"/v1/debits/%20%20",
+	} {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		api.staticRouter.ServeHTTP(rw, req)
+		if rw.Code != http.StatusBadRequest {
+			t.Fatalf("Expected status %d for %s, got %d", http.StatusBadRequest, p, rw.Code)
+		}
+	}
+}
+
+// TestDebugTierPOST ensures that /debug/tier reports the tier and the rule
+// which determined it for hypothetical user states and that it requires the
+// API key.
+func TestDebugTierPOST(t *testing.T) {
+	day := 24 * time.Hour
+	api, _ := newTestAPI(Config{
+		Tiers: database.TierConfig{
+			DefaultTier: 1,
+			GracePeriod: 3 * day,
+		},
+	})
+	now := time.Now().UTC().Truncate(time.Second)
+	index := func(i int) *int { return &i }
+
+	tests := []struct {
+		name string
+		dtp  DebugTierPOST
+		resp DebugTierResponse
+	}{
+		{
+			name: "NoSubscriptions",
+			dtp:  DebugTierPOST{Balance: 10, At: now},
+			resp: DebugTierResponse{Tier: 1, Rule: database.TierRuleDefault},
+		},
+		{
+			name: "Active",
+			dtp: DebugTierPOST{
+				Subscriptions: []DebugTierSubscription{
+					{Tier: 2, From: now.Add(-10 * day), To: now.Add(10 * day)},
+					{Tier: 3, From: now.Add(-day), To: now.Add(day)},
+				},
+				At: now,
+			},
+			resp: DebugTierResponse{Tier: 3, Rule: database.TierRuleSubscription, Subscription: index(1)},
+		},
+		{
+			name: "GracePeriod",
+			dtp: DebugTierPOST{
+				Subscriptions: []DebugTierSubscription{
+					{Tier: 4, From: now.Add(-30 * day), To: now.Add(-day)},
+				},
+				At: now,
+			},
+			resp: DebugTierResponse{Tier: 4, Rule: database.TierRuleGracePeriod, Subscription: index(0)},
+		},
+		{
+			name: "Expired",
+			dtp: DebugTierPOST{
+				Subscriptions: []DebugTierSubscription{
+					{Tier: 4, From: now.Add(-30 * day), To: now.Add(-10 * day)},
+				},
+				At: now,
+			},
+			resp: DebugTierResponse{Tier: 1, Rule: database.TierRuleDefault},
+		},
+	}
+	// The route requires the API key.
+	api.staticRouter = httprouter.New()
+	api.buildHTTPRoutes()
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/debug/tier", bytes.NewReader([]byte("{}")))
+	api.staticRouter.ServeHTTP(rw, req)
+	if rw.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, rw.Code)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(tt.dtp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/debug/tier", bytes.NewReader(body))
+			api.debugTierPOST(rw, req, nil)
+			if rw.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, rw.Code)
+			}
+			var resp DebugTierResponse
+			if err = json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Tier != tt.resp.Tier || resp.Rule != tt.resp.Rule {
+				t.Fatalf("Expected %+v, got %+v", tt.resp, resp)
+			}
+			if (resp.Subscription == nil) != (tt.resp.Subscription == nil) {
+				t.Fatalf("Expected subscription %v, got %v", tt.resp.Subscription, resp.Subscription)
+			}
+			if resp.Subscription != nil && *resp.Subscription != *tt.resp.Subscription {
+				t.Fatalf("Expected subscription %v, got %v", *tt.resp.Subscription, *resp.Subscription)
+			}
+		})
+	}
+}
+
+// TestParsePagination ensures that limits are validated and clamped to the
+// configured maximum.
+func TestParsePagination(t *testing.T) {
+	tests := []struct {
+		query    string
+		maxLimit int64
+		limit    int64
+		offset   int64
+		valid    bool
+	}{
+		{"", DefaultMaxLimit, defaultLimit, 0, true},
+		{"?limit=10&offset=5", DefaultMaxLimit, 10, 5, true},
+		{"?limit=1000000000", DefaultMaxLimit, DefaultMaxLimit, 0, true},
+		{"?limit=20", 10, 10, 0, true},
+		{"", 10, 10, 0, true},
+		{"?limit=0", DefaultMaxLimit, 0, 0, false},
+		{"?limit=-1", DefaultMaxLimit, 0, 0, false},
+		{"?offset=-1", DefaultMaxLimit, 0, 0, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/debits/sub"+tt.query, nil)
+		limit, offset, err := parsePagination(req, tt.maxLimit)
+		if (err == nil) != tt.valid {
+			t.Fatalf("Expected valid to be %v for '%s', got %v", tt.valid, tt.query, err)
+		}
+		if limit != tt.limit || offset != tt.offset {
+			t.Fatalf("Expected limit %d and offset %d for '%s', got %d and %d", tt.limit, tt.offset, tt.query, limit, offset)
+		}
+	}
+
+	// The configured maximum applies.
+	api, _ := newTestAPI(Config{})
+	if api.maxLimit() != DefaultMaxLimit {
+		t.Fatalf("Expected max limit %d, got %d", DefaultMaxLimit, api.maxLimit())
+	}
+	api, _ = newTestAPI(Config{MaxLimit: 50})
+	if api.maxLimit() != 50 {
+		t.Fatalf("Expected max limit 50, got %d", api.maxLimit())
+	}
+}
+
+// TestCheckPaymentAge ensures that payments with a timestamp older than the
+// maximum payment age are rejected while fresh payments and payments without
+// a timestamp are accepted.
+func TestCheckPaymentAge(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		timestamp string
+		err       error
+	}{
+		{"Fresh", now.Add(-time.Minute).Format(time.RFC3339), nil},
+		{"FreshUnix", strconv.FormatInt(now.Add(-time.Minute).Unix(), 10), nil},
+		{"Stale", now.Add(-2 * time.Hour).Format(time.RFC3339), ErrPaymentTooOld},
+		{"StaleUnix", strconv.FormatInt(now.Add(-2*time.Hour).Unix(), 10), ErrPaymentTooOld},
+		{"None", "", nil},
+	}
+	api, _ := newTestAPI(Config{MaxPaymentAge: time.Hour})
+	for _, tt := range tests {
+		p := PaymentPOST{TxnID: "txn", Sub: "sub", Credits: 1}
+		if tt.timestamp != "" {
+			p.Metadata = map[string]string{MetadataTimestamp: tt.timestamp}
+		}
+		err := api.checkPaymentAge(&p, now)
+		if tt.err == nil && err != nil || tt.err != nil && !errors.Contains(err, tt.err) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+	}
+
+	// Invalid timestamps are rejected.
+	p := PaymentPOST{Metadata: map[string]string{MetadataTimestamp: "yesterday"}}
+	if err := api.checkPaymentAge(&p, now); err == nil || errors.Contains(err, ErrPaymentTooOld) {
+		t.Fatalf("Expected an invalid timestamp error, got %v", err)
+	}
+
+	// Without a maximum age, even stale payments are accepted.
+	api, _ = newTestAPI(Config{})
+	p = PaymentPOST{Metadata: map[string]string{MetadataTimestamp: now.Add(-24 * time.Hour).Format(time.RFC3339)}}
+	if err := api.checkPaymentAge(&p, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stale payment should be rejected with a 422 before it ever reaches
+	// the database.
+	api, _ = newTestAPI(Config{MaxPaymentAge: time.Hour})
+	stale := expvarStalePayments.Value()
+	rw := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"txnID":"txn","sub":"sub","credits":1,"metadata":{"%s":"%s"}}`, MetadataTimestamp, now.Add(-2*time.Hour).Format(time.RFC3339))
+	req := httptest.NewRequest(http.MethodPost, "/payment", strings.NewReader(body))
+	api.paymentPOST(rw, req, nil)
+	if rw.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnprocessableEntity, rw.Code)
+	}
+	if expvarStalePayments.Value() != stale+1 {
+		t.Fatalf("Expected %d stale payments, got %d", stale+1, expvarStalePayments.Value())
+	}
+}
+
+// TestWritePaymentResponse ensures that payments which were already processed
+// are only answered with a 208 if configured.
+func TestWritePaymentResponse(t *testing.T) {
+	tests := []struct {
+		alreadyReported  bool
+		alreadyProcessed bool
+		status           int
+	}{
+		{false, false, http.StatusOK},
+		{false, true, http.StatusOK},
+		{true, false, http.StatusOK},
+		{true, true, http.StatusAlreadyReported},
+	}
+	for _, tt := range tests {
+		api, _ := newTestAPI(Config{AlreadyReportedStatus: tt.alreadyReported})
+		rw := httptest.NewRecorder()
+		api.writePaymentResponse(rw, PaymentResponse{Credits: 1, Balance: 2, AlreadyProcessed: tt.alreadyProcessed})
+		if rw.Code != tt.status {
+			t.Fatalf("Expected status %d for %+v, got %d", tt.status, tt, rw.Code)
+		}
+		var pr PaymentResponse
+		if err := json.NewDecoder(rw.Body).Decode(&pr); err != nil {
+			t.Fatal(err)
+		}
+		if pr.AlreadyProcessed != tt.alreadyProcessed || pr.Balance != 2 {
+			t.Fatalf("Unexpected response %+v", pr)
+		}
+	}
+}
+
+// TestUserEligibleGETInvalidTier ensures that /user/:sub/eligible rejects
+// missing and malformed tiers before they reach the database.
+func TestUserEligibleGETInvalidTier(t *testing.T) {
+	api, _ := newTestAPI(Config{})
+	api.staticRouter = httprouter.New()
+	api.buildHTTPRoutes()
+	for _, p := range []string{
+		"/user/sub/eligible",
+		"/user/sub/eligible?tier=",
+		"/user/sub/eligible?tier=x",
+		"/v1/user/sub/eligible?tier=1.5",
+		"/user/%20/eligible?tier=2",
+	} {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		api.staticRouter.ServeHTTP(rw, req)
+		if rw.Code != http.StatusBadRequest {
+			t.Fatalf("Expected status %d for %s, got %d", http.StatusBadRequest, p, rw.Code)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// redactedValue is the value which replaces redacted fields in logged
+	// bodies.
+	redactedValue = "[REDACTED]"
+)
+
+type (
+	// bodyLoggingWriter is an http.ResponseWriter which keeps a copy of
+	// everything written to the underlying writer so it can be logged once
+	// the handler is done.
+	bodyLoggingWriter struct {
+		http.ResponseWriter
+		body   bytes.Buffer
+		status int
+	}
+)
+
+// Write implements http.ResponseWriter.
+func (w *bodyLoggingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *bodyLoggingWriter) WriteHeader(statusCode int) {
+	w.status = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// WithBodyLogging logs the request and response bodies of the handler at
+// Trace level. Fields listed in the config's LogBodiesRedact are redacted
+// before logging. If body logging is disabled, the handler is returned as is.
+func (api *API) WithBodyLogging(h httprouter.Handle) httprouter.Handle {
+	if !api.staticConfig.LogBodies {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		body, err := readBody(req)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "failed to read body"), http.StatusBadRequest)
+			return
+		}
+		lw := &bodyLoggingWriter{ResponseWriter: w, status: http.StatusOK}
+		h(lw, req, ps)
+
+		api.staticLogger.WithField("method", req.Method).
+			WithField("path", req.URL.Path).
+			WithField("status", lw.status).
+			WithField("request", api.redactBody(body)).
+			WithField("response", api.redactBody(lw.body.Bytes())).
+			Trace("Request/response bodies")
+	}
+}
+
+// redactBody returns the body as a string with the values of all redacted
+// fields replaced. Bodies which are not valid JSON are returned unchanged.
+func (api *API) redactBody(body []byte) string {
+	if len(api.staticConfig.LogBodiesRedact) == 0 {
+		return string(body)
+	}
+	var obj interface{}
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return string(body)
+	}
+	redacted, err := json.Marshal(redactFields(obj, api.staticConfig.LogBodiesRedact))
+	if err != nil {
+		return string(body)
+	}
+	return string(redacted)
+}
+
+// redactFields recursively replaces the values of all object fields whose
+// names match one of the given fields.
+func redactFields(obj interface{}, fields []string) interface{} {
+	switch o := obj.(type) {
+	case map[string]interface{}:
+		for k, v := range o {
+			if containsFold(fields, k) {
+				o[k] = redactedValue
+				continue
+			}
+			o[k] = redactFields(v, fields)
+		}
+	case []interface{}:
+		for i, v := range o {
+			o[i] = redactFields(v, fields)
+		}
+	}
+	return obj
+}
+
+// containsFold returns true if the given list contains the given string,
+// ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// TestWithBodyLogging ensures that request and response bodies are logged
+// only when enabled and that redacted fields don't show up in the logs.
+func TestWithBodyLogging(t *testing.T) {
+	reqBody := `{"sub":"somesub","auth":"secretauth"}`
+	respBody := `{"status":"responsebody"}`
+	handler := func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		// The handler must still be able to read the body.
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != reqBody {
+			t.Fatalf("Expected body '%s', got '%s'", reqBody, string(b))
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(respBody))
+	}
+
+	// Disabled.
+	api, logs := newTestAPI(Config{})
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/payment", strings.NewReader(reqBody))
+	api.WithBodyLogging(handler)(rw, req, nil)
+	if rw.Body.String() != respBody {
+		t.Fatalf("Expected response '%s', got '%s'", respBody, rw.Body.String())
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("Expected no logs, got '%s'", logs.String())
+	}
+
+	// Enabled.
+	api, logs = newTestAPI(Config{
+		LogBodies:       true,
+		LogBodiesRedact: []string{"Auth"},
+	})
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/payment", strings.NewReader(reqBody))
+	api.WithBodyLogging(handler)(rw, req, nil)
+	if rw.Body.String() != respBody {
+		t.Fatalf("Expected response '%s', got '%s'", respBody, rw.Body.String())
+	}
+	out := logs.String()
+	if !strings.Contains(out, "somesub") || !strings.Contains(out, "responsebody") {
+		t.Fatalf("Expected both bodies to be logged, got '%s'", out)
+	}
+	if strings.Contains(out, "secretauth") {
+		t.Fatalf("Expected auth field to be redacted, got '%s'", out)
+	}
+	if !strings.Contains(out, redactedValue) {
+		t.Fatalf("Expected redacted value in logs, got '%s'", out)
+	}
+}
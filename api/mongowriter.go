@@ -3,11 +3,16 @@ package api
 import (
 	"bytes"
 	"context"
+	stderrors "errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
 )
 
 const (
@@ -15,8 +20,19 @@ const (
 	// MongoDB issues when a transaction needs to be reverted because of a
 	// write conflict.
 	writeConflictErrMsg = "(WriteConflict)"
+
+	// dbOverloadRetryAfter is the time we ask clients to wait before
+	// retrying a call which failed because MongoDB is overloaded.
+	dbOverloadRetryAfter = 5 * time.Second
 )
 
+// dbOverloadErrCodes are the MongoDB error codes which indicate that the
+// database is overloaded rather than that the operation is faulty.
+var dbOverloadErrCodes = []int{
+	50,  // MaxTimeMSExpired
+	262, // ExceededTimeLimit
+}
+
 type (
 	// MongoSessionContext defines the minimal session context interface that
 	// we are using. This interface facilitates testing and should be expanded
@@ -40,6 +56,8 @@ type (
 		// able to either retrieve this data (if we can't retry anymore) or
 		// discard it (if we want to retry the call).
 		ew *bufferResponseWriter
+		// committed is set once the transaction was committed successfully.
+		committed bool
 	}
 
 	// bufferResponseWriter will hold anything written to it in memory.
@@ -95,10 +113,16 @@ func (mw *MongoWriter) WriteHeader(statusCode int) {
 		if err != nil {
 			mw.logger.Warningln("Failed to commit transaction:", err)
 		}
+		mw.committed = err == nil
 	}
 	mw.w.WriteHeader(statusCode)
 }
 
+// Committed returns true if the transaction was committed successfully.
+func (mw *MongoWriter) Committed() bool {
+	return mw.committed
+}
+
 // ErrorBuffer returns the data stored in the error buffer.
 func (mw *MongoWriter) ErrorBuffer() []byte {
 	return mw.ew.Buffer.Bytes()
@@ -130,3 +154,39 @@ func (w *bufferResponseWriter) Write(b []byte) (int, error) {
 func (w *bufferResponseWriter) WriteHeader(statusCode int) {
 	w.Status = statusCode
 }
+
+// isDBOverloadError returns true if the error indicates that MongoDB is
+// overloaded or unreachable, e.g. because an operation timed out or no
+// connection could be checked out of the pool. Such calls might succeed when
+// retried later, as opposed to calls which fail due to faulty operations.
+func isDBOverloadError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// Check the components of composed errors.
+	if composed, ok := err.(errors.Error); ok {
+		for _, e := range composed.ErrSet {
+			if isDBOverloadError(e) {
+				return true
+			}
+		}
+		return false
+	}
+	var se mongo.ServerError
+	if stderrors.As(err, &se) {
+		for _, code := range dbOverloadErrCodes {
+			if se.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+	var wqte topology.WaitQueueTimeoutError
+	if stderrors.As(err, &wqte) {
+		return true
+	}
+	var sse topology.ServerSelectionError
+	if stderrors.As(err, &sse) {
+		return true
+	}
+	return mongo.IsTimeout(err) || mongo.IsNetworkError(err)
+}
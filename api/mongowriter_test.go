@@ -6,13 +6,17 @@ import (
 	"io"
 	"math"
 	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 
+	"github.com/SkynetLabs/promoter/database"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
 )
 
 // MockSessionContext status values.
@@ -113,6 +117,9 @@ func TestMongoWriter(t *testing.T) {
 	if testSC.status != statusCommitted {
 		t.Fatalf("Expected status %d, got %d", statusStarted, testSC.status)
 	}
+	if !mw.Committed() {
+		t.Fatal("Expected the MongoWriter to report the commit")
+	}
 
 	/* Error path */
 
@@ -152,6 +159,9 @@ func TestMongoWriter(t *testing.T) {
 	if testSC.status != statusAborted {
 		t.Fatalf("Expected status %d, got %d", statusAborted, testSC.status)
 	}
+	if mw.Committed() {
+		t.Fatal("Expected the MongoWriter not to report a commit")
+	}
 	// Expect MongoWriter to properly signal that the error was NOT caused by a
 	// WriteConflict.
 	if mw.FailedWithWriteConflict() {
@@ -201,3 +211,109 @@ func TestMongoWriter(t *testing.T) {
 		t.Fatal("Expected a WriteConflict indication, didn't get one.")
 	}
 }
+
+// TestWriteDBError ensures that database errors are mapped to the right status
+// codes and that overload errors tell the caller when to retry.
+func TestWriteDBError(t *testing.T) {
+	api, _ := newTestAPI(Config{})
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{
+			name:       "ExceededTimeLimit",
+			err:        mongo.CommandError{Code: 262, Name: "ExceededTimeLimit"},
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "5",
+		},
+		{
+			name:       "MaxTimeMSExpired",
+			err:        mongo.CommandError{Code: 50, Name: "MaxTimeMSExpired"},
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "5",
+		},
+		{
+			name:       "PoolExhausted",
+			err:        topology.WaitQueueTimeoutError{},
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "5",
+		},
+		{
+			name:       "ServerSelection",
+			err:        topology.ServerSelectionError{},
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "5",
+		},
+		{
+			name:       "Timeout",
+			err:        context.DeadlineExceeded,
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "5",
+		},
+		{
+			name:       "WrappedOverload",
+			err:        errors.AddContext(mongo.CommandError{Code: 262}, "context"),
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "5",
+		},
+		{
+			name:   "WriteConflict",
+			err:    mongo.CommandError{Code: 112, Name: "WriteConflict"},
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "DuplicateKey",
+			err:    mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000}}},
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "NotFound",
+			err:    database.ErrNotFound,
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "DuplicateTxn",
+			err:    errors.AddContext(database.ErrDuplicateTxn, "context"),
+			status: http.StatusConflict,
+		},
+		{
+			name:   "HoldMismatch",
+			err:    database.ErrHoldMismatch,
+			status: http.StatusConflict,
+		},
+		{
+			name:   "InsufficientBalance",
+			err:    database.ErrInsufficientBalance,
+			status: http.StatusPaymentRequired,
+		},
+		{
+			name:   "InvalidPrice",
+			err:    database.ErrInvalidPrice,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "TxnNotReassignable",
+			err:    database.ErrTxnNotReassignable,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "Generic",
+			err:    errors.New("some error"),
+			status: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			api.WriteDBError(rw, tt.err)
+			if rw.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, rw.Code)
+			}
+			if ra := rw.Header().Get("Retry-After"); ra != tt.retryAfter {
+				t.Fatalf("Expected Retry-After '%s', got '%s'", tt.retryAfter, ra)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// DefaultPaymentCacheTTL is the default time a completed payment stays
+	// in the payment cache.
+	DefaultPaymentCacheTTL = 10 * time.Second
+)
+
+type (
+	// paymentCache is a bounded in-memory cache of recently completed
+	// payments keyed by their txn ID, which serves as the payment's
+	// idempotency key. It allows for answering retried payments without
+	// starting a database transaction. The database remains the source of
+	// truth, the cache only remembers the credited amount. The balance
+	// changes with every txn, so it isn't cached.
+	paymentCache struct {
+		entries map[string]*list.Element
+		order   *list.List
+		size    int
+		ttl     time.Duration
+		mu      sync.Mutex
+	}
+
+	// paymentCacheEntry is a cached payment.
+	paymentCacheEntry struct {
+		txnID     string
+		sub       string
+		credits   float64
+		expiresAt time.Time
+	}
+)
+
+// newPaymentCache creates a cache which holds up to size payments for the
+// given ttl.
+func newPaymentCache(size int, ttl time.Duration) *paymentCache {
+	if ttl <= 0 {
+		ttl = DefaultPaymentCacheTTL
+	}
+	return &paymentCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		size:    size,
+		ttl:     ttl,
+	}
+}
+
+// add caches the credited amount of the payment with the given txn ID. If the
+// cache is full, the oldest payment is evicted.
+func (pc *paymentCache) add(txnID, sub string, credits float64, now time.Time) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if e, ok := pc.entries[txnID]; ok {
+		pc.order.Remove(e)
+		delete(pc.entries, txnID)
+	}
+	for pc.order.Len() >= pc.size {
+		oldest := pc.order.Front()
+		pc.order.Remove(oldest)
+		delete(pc.entries, oldest.Value.(*paymentCacheEntry).txnID)
+	}
+	pc.entries[txnID] = pc.order.PushBack(&paymentCacheEntry{
+		txnID:     txnID,
+		sub:       sub,
+		credits:   credits,
+		expiresAt: now.Add(pc.ttl),
+	})
+}
+
+// get returns the credited amount of the payment with the given txn ID. Only
+// payments for the same sub which haven't expired yet are returned, all other
+// payments need to be checked against the database.
+func (pc *paymentCache) get(txnID, sub string, now time.Time) (float64, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	e, ok := pc.entries[txnID]
+	if !ok {
+		return 0, false
+	}
+	entry := e.Value.(*paymentCacheEntry)
+	if !now.Before(entry.expiresAt) {
+		pc.order.Remove(e)
+		delete(pc.entries, txnID)
+		return 0, false
+	}
+	if entry.sub != sub {
+		return 0, false
+	}
+	return entry.credits, true
+}
+
+// WithPaymentCache answers payments which were completed recently from the
+// payment cache without calling the wrapped handler. Since it wraps
+// WithDBSession, a cache hit doesn't start a database transaction, only the
+// current balance is read. Requests which can't be decoded or which don't
+// pass the checks of paymentPOST are passed on to the handler to be rejected
+// there, and so are all requests while the API is in read-only mode.
+func (api *API) WithPaymentCache(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if api.staticPaymentCache == nil {
+			h(w, req, ps)
+			return
+		}
+		body, err := readBody(req)
+		if err != nil {
+			h(w, req, ps)
+			return
+		}
+		var payment PaymentPOST
+		if err = json.Unmarshal(body, &payment); err != nil {
+			h(w, req, ps)
+			return
+		}
+		now := time.Now()
+		if _, err = api.checkPayment(&payment, now); err != nil || api.ReadOnly() {
+			h(w, req, ps)
+			return
+		}
+		credits, ok := api.staticPaymentCache.get(payment.TxnID, payment.Sub, now)
+		if !ok {
+			h(w, req, ps)
+			return
+		}
+		balance, _, err := api.staticDB.UserBalance(req.Context(), payment.Sub)
+		if err != nil {
+			h(w, req, ps)
+			return
+		}
+		expvarPaymentCacheHits.Add(1)
+		api.writePaymentResponse(w, PaymentResponse{
+			Credits:          credits,
+			Balance:          balance,
+			AlreadyProcessed: true,
+		})
+	}
+}
+
+// committed returns false if w is a MongoWriter whose transaction wasn't
+// committed. Other writers don't belong to a transaction, so there is nothing
+// to wait for.
+func committed(w http.ResponseWriter) bool {
+	mw, ok := w.(*MongoWriter)
+	return !ok || mw.Committed()
+}
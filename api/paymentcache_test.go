@@ -0,0 +1,98 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// TestPaymentCache is a unit test for the paymentCache.
+func TestPaymentCache(t *testing.T) {
+	now := time.Now()
+	pc := newPaymentCache(2, time.Minute)
+	credits := 1.5
+
+	// Cached payments are returned for the same sub only.
+	pc.add("txn1", "sub", credits, now)
+	if cached, ok := pc.get("txn1", "sub", now); !ok || cached != credits {
+		t.Fatalf("Expected %v to be cached, got %v %v", credits, cached, ok)
+	}
+	if _, ok := pc.get("txn1", "other", now); ok {
+		t.Fatal("Expected no cached payment for a different sub")
+	}
+	if _, ok := pc.get("txn2", "sub", now); ok {
+		t.Fatal("Expected no cached payment for an unknown txn")
+	}
+
+	// The cache is bounded, the oldest payment is evicted first.
+	pc.add("txn2", "sub", credits, now)
+	pc.add("txn3", "sub", credits, now)
+	if _, ok := pc.get("txn1", "sub", now); ok {
+		t.Fatal("Expected the oldest payment to be evicted")
+	}
+	if len(pc.entries) != 2 || pc.order.Len() != 2 {
+		t.Fatalf("Expected 2 entries, got %d and %d", len(pc.entries), pc.order.Len())
+	}
+
+	// Payments expire after the ttl.
+	if _, ok := pc.get("txn2", "sub", now.Add(time.Minute-time.Second)); !ok {
+		t.Fatal("Expected the payment to be cached before its ttl passed")
+	}
+	if _, ok := pc.get("txn2", "sub", now.Add(time.Minute)); ok {
+		t.Fatal("Expected the payment to expire")
+	}
+	if len(pc.entries) != 1 || pc.order.Len() != 1 {
+		t.Fatalf("Expected 1 entry, got %d and %d", len(pc.entries), pc.order.Len())
+	}
+}
+
+// TestWithPaymentCache ensures that payments which aren't cached or which
+// don't pass the payment checks are passed on to the wrapped handler. Cache
+// hits read the balance from the database, so they are covered by the
+// integration tests.
+func TestWithPaymentCache(t *testing.T) {
+	api, _ := newTestAPI(Config{
+		AllowedSubs:   []string{"sub", "other"},
+		MaxPaymentAge: time.Hour,
+	})
+	api.staticPaymentCache = newPaymentCache(10, time.Minute)
+	api.staticPaymentCache.add("txn", "sub", 1, time.Now())
+	api.staticPaymentCache.add("txn", "denied", 1, time.Now())
+
+	var calls int
+	h := api.WithPaymentCache(func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		calls++
+		api.WriteSuccess(w)
+	})
+	stale := time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+	tests := []string{
+		`{"txnID":"other","sub":"sub","credits":1}`,
+		`{"txnID":"txn","sub":"other","credits":1}`,
+		`{"txnID":"txn","sub":"denied","credits":1}`,
+		`{"txnID":"txn","sub":"sub","credits":0}`,
+		`{"txnID":"txn","sub":"sub","credits":1,"metadata":{"timestamp":"` + stale + `"}}`,
+		`{`,
+	}
+	for _, body := range tests {
+		calls = 0
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/payment", bytes.NewBufferString(body))
+		h(rw, req, nil)
+		if calls != 1 {
+			t.Fatalf("%s: expected the handler to be called, got %d calls", body, calls)
+		}
+	}
+
+	// In read-only mode, even cached payments are passed on to be rejected.
+	api.enterReadOnly()
+	calls = 0
+	req := httptest.NewRequest(http.MethodPost, "/payment", bytes.NewBufferString(`{"txnID":"txn","sub":"sub","credits":1}`))
+	h(httptest.NewRecorder(), req, nil)
+	if calls != 1 {
+		t.Fatalf("Expected the handler to be called, got %d calls", calls)
+	}
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	stderrors "errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// readOnlyCooldown is the time the API stays in read-only mode after a
+	// write failed because MongoDB wasn't writable. Writes are rejected
+	// without trying until it passes. This is also the time we ask clients
+	// to wait before retrying.
+	readOnlyCooldown = 30 * time.Second
+)
+
+// dbNotWritableErrCodes are the MongoDB error codes which indicate that there
+// is currently no primary to accept writes.
+var dbNotWritableErrCodes = []int{
+	189,   // PrimarySteppedDown
+	10107, // NotWritablePrimary
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// ReadOnly returns true if the API is in read-only mode, either because it
+// was configured that way or because MongoDB recently wasn't writable. Reads
+// keep working in read-only mode since the database client prefers the
+// nearest member of the replica set, which might be a secondary.
+func (api *API) ReadOnly() bool {
+	if api.staticConfig.ReadOnly {
+		return true
+	}
+	api.readOnlyMu.Lock()
+	defer api.readOnlyMu.Unlock()
+	return time.Now().Before(api.readOnlyUntil)
+}
+
+// enterReadOnly puts the API into read-only mode for readOnlyCooldown.
+func (api *API) enterReadOnly() {
+	api.readOnlyMu.Lock()
+	defer api.readOnlyMu.Unlock()
+	now := time.Now()
+	if !now.Before(api.readOnlyUntil) {
+		api.staticLogger.Warnf("Database isn't writable, switching to read-only mode for %v", readOnlyCooldown)
+	}
+	api.readOnlyUntil = now.Add(readOnlyCooldown)
+}
+
+// writeReadOnlyError rejects a write while the API is in read-only mode.
+func (api *API) writeReadOnlyError(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(readOnlyCooldown.Seconds())))
+	api.WriteError(w, errors.Compose(ErrReadOnly, err), http.StatusServiceUnavailable)
+}
+
+// isDBNotWritableError returns true if the error indicates that MongoDB
+// currently doesn't accept writes, e.g. because the primary stepped down or
+// isn't reachable.
+func isDBNotWritableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// Check the components of composed errors.
+	if composed, ok := err.(errors.Error); ok {
+		for _, e := range composed.ErrSet {
+			if isDBNotWritableError(e) {
+				return true
+			}
+		}
+		return false
+	}
+	var se mongo.ServerError
+	if stderrors.As(err, &se) {
+		for _, code := range dbNotWritableErrCodes {
+			if se.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+	return false
+}
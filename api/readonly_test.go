@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TestReadOnly ensures that writes are rejected in read-only mode and that
+// the API switches to read-only mode when the database isn't writable.
+func TestReadOnly(t *testing.T) {
+	// write runs a call through WithDBSession. Since the test API has no
+	// database, only calls which are rejected before a session is created
+	// can be tested this way.
+	write := func(api *API) *httptest.ResponseRecorder {
+		t.Helper()
+		h := api.WithDBSession(func(http.ResponseWriter, *http.Request, httprouter.Params) {
+			t.Fatal("Expected write to be rejected")
+		})
+		rw := httptest.NewRecorder()
+		h(rw, httptest.NewRequest(http.MethodPost, "/payment", strings.NewReader("{}")), nil)
+		return rw
+	}
+	// checkRejected checks that a write was rejected due to read-only mode.
+	checkRejected := func(rw *httptest.ResponseRecorder) {
+		t.Helper()
+		if rw.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Expected status %d, got %d", http.StatusServiceUnavailable, rw.Code)
+		}
+		if rw.Header().Get("Retry-After") != "30" {
+			t.Fatalf("Expected Retry-After 30, got '%s'", rw.Header().Get("Retry-After"))
+		}
+		var apiErr Error
+		if err := json.NewDecoder(rw.Body).Decode(&apiErr); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(apiErr.Message, ErrReadOnly.Error()) {
+			t.Fatalf("Expected error '%v', got '%v'", ErrReadOnly, apiErr)
+		}
+	}
+
+	// Configured read-only mode.
+	api, _ := newTestAPI(Config{ReadOnly: true})
+	if !api.ReadOnly() {
+		t.Fatal("Expected API to be read-only")
+	}
+	checkRejected(write(api))
+
+	// Detected read-only mode. Other database errors don't trigger it.
+	api, _ = newTestAPI(Config{})
+	api.WriteDBError(httptest.NewRecorder(), mongo.CommandError{Code: 112, Name: "WriteConflict"})
+	if api.ReadOnly() {
+		t.Fatal("Expected API not to be read-only")
+	}
+	rw := httptest.NewRecorder()
+	api.WriteDBError(rw, mongo.CommandError{Code: 10107, Name: "NotWritablePrimary"})
+	checkRejected(rw)
+	if !api.ReadOnly() {
+		t.Fatal("Expected API to be read-only")
+	}
+	checkRejected(write(api))
+
+	// Read-only mode ends after the cooldown.
+	api.readOnlyMu.Lock()
+	api.readOnlyUntil = api.readOnlyUntil.Add(-readOnlyCooldown)
+	api.readOnlyMu.Unlock()
+	if api.ReadOnly() {
+		t.Fatal("Expected API not to be read-only after the cooldown")
+	}
+}
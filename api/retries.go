@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// These are the buckets by which calls are grouped depending on how often
+// WithDBSession retried them.
+const (
+	retryBucketNone     = "0"
+	retryBucketOne      = "1"
+	retryBucketMultiple = "2+"
+)
+
+type (
+	// retryStats tallies how often calls wrapped by WithDBSession were
+	// retried due to WriteConflicts.
+	retryStats struct {
+		calls   map[string]int64
+		retries int64
+		mu      sync.Mutex
+	}
+)
+
+// retryBucket returns the bucket of a call which was retried the given number
+// of times.
+func retryBucket(retries int) string {
+	switch {
+	case retries <= 0:
+		return retryBucketNone
+	case retries == 1:
+		return retryBucketOne
+	default:
+		return retryBucketMultiple
+	}
+}
+
+// record tallies a call which was retried the given number of times.
+func (rs *retryStats) record(retries int) {
+	bucket := retryBucket(retries)
+	expvarRetryBuckets.Add(bucket, 1)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.calls == nil {
+		rs.calls = make(map[string]int64)
+	}
+	rs.calls[bucket]++
+	rs.retries += int64(retries)
+}
+
+// snapshot returns the current tallies. If reset is true, the tallies are
+// reset afterwards.
+func (rs *retryStats) snapshot(reset bool) RetriesGET {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rg := RetriesGET{
+		Calls: map[string]int64{
+			retryBucketNone:     rs.calls[retryBucketNone],
+			retryBucketOne:      rs.calls[retryBucketOne],
+			retryBucketMultiple: rs.calls[retryBucketMultiple],
+		},
+		Retries: rs.retries,
+	}
+	if reset {
+		rs.calls = nil
+		rs.retries = 0
+	}
+	return rg
+}
+
+// debugRetriesGET returns how often calls needed to be retried due to
+// WriteConflicts since the API started or since the tallies were last reset.
+// The tallies are reset if the 'reset' query parameter is true.
+func (api *API) debugRetriesGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var reset bool
+	if resetStr := req.FormValue("reset"); resetStr != "" {
+		var err error
+		reset, err = strconv.ParseBool(resetStr)
+		if err != nil {
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	api.WriteJSON(w, api.retryStats.snapshot(reset))
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// These are the supported rounding modes for credits.
+const (
+	// RoundingNone disables rounding.
+	RoundingNone RoundingMode = ""
+	// RoundingNearest rounds to the nearest value, rounding half away from
+	// zero.
+	RoundingNearest RoundingMode = "nearest"
+	// RoundingDown rounds towards negative infinity.
+	RoundingDown RoundingMode = "down"
+	// RoundingUp rounds towards positive infinity.
+	RoundingUp RoundingMode = "up"
+
+	// MaxRoundingPlaces is the maximum number of decimal places credits can
+	// be rounded to. A float64 doesn't hold more significant decimal places
+	// than that.
+	MaxRoundingPlaces = 15
+)
+
+type (
+	// RoundingMode describes how credits are rounded.
+	RoundingMode string
+
+	// RoundingPolicy describes how incoming credits are rounded before they
+	// are stored.
+	RoundingPolicy struct {
+		// Places is the number of decimal places to round to.
+		Places int
+		// Mode is the rounding mode. RoundingNone disables rounding.
+		Mode RoundingMode
+	}
+)
+
+// ParseRoundingMode parses a rounding mode from a string.
+func ParseRoundingMode(s string) (RoundingMode, error) {
+	switch m := RoundingMode(s); m {
+	case RoundingNone, RoundingNearest, RoundingDown, RoundingUp:
+		return m, nil
+	default:
+		return RoundingNone, fmt.Errorf("unknown rounding mode '%s'", s)
+	}
+}
+
+// ParseRoundingPlaces parses the number of decimal places to round to from a
+// string. It needs to be between 0 and MaxRoundingPlaces.
+func ParseRoundingPlaces(s string) (int, error) {
+	places, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if places < 0 || places > MaxRoundingPlaces {
+		return 0, fmt.Errorf("rounding places must be between 0 and %d, got %d", MaxRoundingPlaces, places)
+	}
+	return places, nil
+}
+
+// Round rounds the given amount according to the policy.
+func (p RoundingPolicy) Round(amount float64) float64 {
+	scale := math.Pow(10, float64(p.Places))
+	switch p.Mode {
+	case RoundingNearest:
+		return math.Round(amount*scale) / scale
+	case RoundingDown:
+		return math.Floor(amount*scale) / scale
+	case RoundingUp:
+		return math.Ceil(amount*scale) / scale
+	default:
+		return amount
+	}
+}
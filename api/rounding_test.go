@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRoundingPolicy is a unit test for RoundingPolicy.Round.
+func TestRoundingPolicy(t *testing.T) {
+	tests := []struct {
+		places   int
+		mode     RoundingMode
+		amount   float64
+		expected float64
+	}{
+		{2, RoundingNone, 1.23456, 1.23456},
+		{2, RoundingNearest, 1.23456, 1.23},
+		{2, RoundingNearest, 1.235, 1.24},
+		{2, RoundingDown, 1.23999, 1.23},
+		{2, RoundingUp, 1.23001, 1.24},
+		{0, RoundingNearest, 12.5, 13},
+		{0, RoundingDown, 12.9, 12},
+		{0, RoundingUp, 12.1, 13},
+		{4, RoundingNearest, 0.123456, 0.1235},
+		{4, RoundingDown, 0.123456, 0.1234},
+		{2, RoundingNearest, 10, 10},
+	}
+	for _, tt := range tests {
+		p := RoundingPolicy{Places: tt.places, Mode: tt.mode}
+		if rounded := p.Round(tt.amount); rounded != tt.expected {
+			t.Errorf("Rounding %v to %d places (%s): expected %v, got %v", tt.amount, tt.places, tt.mode, tt.expected, rounded)
+		}
+	}
+
+	// Parsing.
+	for _, m := range []RoundingMode{RoundingNone, RoundingNearest, RoundingDown, RoundingUp} {
+		parsed, err := ParseRoundingMode(string(m))
+		if err != nil || parsed != m {
+			t.Fatalf("Failed to parse '%s': %v %v", m, parsed, err)
+		}
+	}
+	if _, err := ParseRoundingMode("sideways"); err == nil {
+		t.Fatal("Expected unknown mode to fail to parse")
+	}
+}
+
+// TestParseRoundingPlaces ensures that only the supported number of decimal
+// places is accepted.
+func TestParseRoundingPlaces(t *testing.T) {
+	tests := []struct {
+		s     string
+		valid bool
+	}{
+		{"0", true},
+		{"2", true},
+		{"15", true},
+		{"16", false},
+		{"400", false},
+		{"-1", false},
+		{"two", false},
+	}
+	for _, tt := range tests {
+		_, err := ParseRoundingPlaces(tt.s)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid %v, got %v", tt.s, tt.valid, err)
+		}
+	}
+}
+
+// TestPaymentRoundsToInvalidNumber ensures that payments whose credits round
+// to an infinite amount are rejected before they reach the database.
+func TestPaymentRoundsToInvalidNumber(t *testing.T) {
+	api, _ := newTestAPI(Config{
+		CreditRounding: RoundingPolicy{Places: 2, Mode: RoundingNearest},
+	})
+	rw := httptest.NewRecorder()
+	body := `{"txnID":"txn","sub":"sub","credits":1e307}`
+	req := httptest.NewRequest(http.MethodPost, "/payment", strings.NewReader(body))
+	api.paymentPOST(rw, req, nil)
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, rw.Code)
+	}
+}
@@ -1,14 +1,208 @@
 package api
 
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/SkynetLabs/promoter/build"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// apiVersionHeader is the response header which contains the version of
+	// the route set which served the request.
+	apiVersionHeader = "X-Promoter-API-Version"
+
+	// buildVersionHeader is the response header which contains the version
+	// of the promoter build which served the request.
+	buildVersionHeader = "X-Promoter-Build-Version"
+
+	// apiVersionLegacy is the version of the unversioned routes.
+	apiVersionLegacy = "legacy"
+
+	// apiVersionV1 is the first version of the API's routes.
+	apiVersionV1 = "v1"
+)
+
+// These are the features which can be disabled via Config.DisabledFeatures.
+// The routes of disabled features are not registered at all.
+const (
+	// FeatureBalance covers the balance endpoints.
+	FeatureBalance = "balance"
+	// FeatureDebits covers the debit history endpoints.
+	FeatureDebits = "debits"
+	// FeaturePayments covers the payment endpoints.
+	FeaturePayments = "payments"
+	// FeatureStats covers the statistics endpoints.
+	FeatureStats = "stats"
+	// FeatureSubscriptions covers the subscription endpoints.
+	FeatureSubscriptions = "subscriptions"
+	// FeatureTxns covers the txn endpoints.
+	FeatureTxns = "txns"
+)
+
+// Features returns all features which can be disabled.
+func Features() []string {
+	return []string{
+		FeatureBalance,
+		FeatureDebits,
+		FeaturePayments,
+		FeatureStats,
+		FeatureSubscriptions,
+		FeatureTxns,
+	}
+}
+
 type (
 	// HealthGET is the type returned by the /health endpoint.
 	HealthGET struct {
 		DBAlive bool `json:"dbAlive"`
 	}
+
+	// apiVersionKey is the context key under which WithAPIVersion stores
+	// the version of the route set which serves a request.
+	apiVersionKey struct{}
 )
 
 // buildHTTPRoutes registers the http routes with the httprouter.
 func (api *API) buildHTTPRoutes() {
-	api.staticRouter.GET("/health", api.healthGET)
-	api.staticRouter.POST("/payment", api.WithDBSession(api.paymentPOST))
+	// The health check bypasses the concurrency limit, so probes keep
+	// working under load.
+	api.registerUnlimitedRoute(http.MethodGet, "/health", api.WithBodyLogging(api.healthGET))
+	api.registerRoute(http.MethodGet, "/status", api.WithBodyLogging(api.statusGET))
+
+	if api.featureEnabled(FeaturePayments) {
+		api.registerRoute(http.MethodPost, "/payment", api.WithBodyLogging(api.WithPaymentCache(api.WithDBSession(api.paymentPOST))))
+	}
+	if api.featureEnabled(FeatureSubscriptions) {
+		api.registerRoute(http.MethodPost, "/subscription", api.WithBodyLogging(api.WithAPIKey(api.WithDBSession(api.subscriptionPOST))))
+		api.registerRoute(http.MethodGet, "/subscription/:id", api.WithBodyLogging(api.subscriptionGET))
+	}
+	if api.featureEnabled(FeatureBalance) {
+		api.registerRoute(http.MethodGet, "/balance/:sub", api.WithBodyLogging(api.balanceGET))
+		api.registerRoute(http.MethodGet, "/user/:sub/eligible", api.WithBodyLogging(api.userEligibleGET))
+	}
+	if api.featureEnabled(FeatureDebits) {
+		api.registerRoute(http.MethodGet, "/debits/:sub", api.WithBodyLogging(api.debitsGET))
+	}
+	if api.featureEnabled(FeatureTxns) {
+		api.registerRoute(http.MethodGet, "/txn/:id", api.WithBodyLogging(api.WithAPIKey(api.txnGET)))
+		api.registerRoute(http.MethodGet, "/txns/since", api.WithBodyLogging(api.WithAPIKey(api.txnsSinceGET)))
+		api.registerRoute(http.MethodPost, "/txn/:id/reassign", api.WithBodyLogging(api.WithAPIKey(api.WithDBSession(api.txnReassignPOST))))
+		if api.staticConfig.AllowTxnDeletion {
+			api.registerRoute(http.MethodDelete, "/txn/:id", api.WithBodyLogging(api.WithAPIKey(api.WithDBSession(api.txnDELETE))))
+		}
+	}
+	if api.featureEnabled(FeatureStats) {
+		api.registerRoute(http.MethodGet, "/stats/revenue", api.WithBodyLogging(api.statsRevenueGET))
+		api.registerRoute(http.MethodGet, "/stats/tiers", api.WithBodyLogging(api.statsTiersGET))
+		api.registerRoute(http.MethodGet, "/stats/subscribers", api.WithBodyLogging(api.statsSubscribersGET))
+		api.registerRoute(http.MethodGet, "/stats/top", api.WithBodyLogging(api.WithAPIKey(api.statsTopGET)))
+	}
+
+	api.registerRoute(http.MethodGet, "/alerts", api.WithBodyLogging(api.WithAPIKey(api.alertsGET)))
+	api.registerRoute(http.MethodGet, "/debug/indexes", api.WithBodyLogging(api.WithAPIKey(api.debugIndexesGET)))
+	api.registerRoute(http.MethodGet, "/debug/retries", api.WithBodyLogging(api.WithAPIKey(api.debugRetriesGET)))
+	api.registerRoute(http.MethodGet, "/debug/txns/orphans", api.WithBodyLogging(api.WithAPIKey(api.debugOrphanTxnsGET)))
+	api.registerRoute(http.MethodGet, "/debug/schema", api.WithBodyLogging(api.WithAPIKey(api.debugSchemaGET)))
+	api.registerRoute(http.MethodPost, "/debug/tier", api.WithBodyLogging(api.WithAPIKey(api.debugTierPOST)))
+
+	if api.staticConfig.Expvar {
+		api.registerRoute(http.MethodGet, "/debug/vars", api.debugVarsGET)
+	}
+}
+
+// featureEnabled returns true if the given feature wasn't disabled.
+func (api *API) featureEnabled(feature string) bool {
+	for _, f := range api.staticConfig.DisabledFeatures {
+		if f == feature {
+			return false
+		}
+	}
+	return true
+}
+
+// logFeatures logs which features are enabled and which are disabled.
+func (api *API) logFeatures() {
+	var enabled, disabled []string
+	for _, f := range Features() {
+		if api.featureEnabled(f) {
+			enabled = append(enabled, f)
+		} else {
+			disabled = append(disabled, f)
+		}
+	}
+	api.staticLogger.WithField("enabled", enabled).
+		WithField("disabled", disabled).
+		WithField("txnDeletion", api.staticConfig.AllowTxnDeletion).
+		WithField("expvar", api.staticConfig.Expvar).
+		Info("API features")
+}
+
+// registerRoute registers the handler under the versioned path as well as the
+// legacy unversioned path, so existing callers keep working. Both paths are
+// prefixed with the configured base path. Calls are subject to the
+// concurrency limit.
+func (api *API) registerRoute(method, path string, h httprouter.Handle) {
+	api.handleRoute(method, path, h, true)
+}
+
+// registerUnlimitedRoute registers the handler like registerRoute but its
+// calls bypass the concurrency limit.
+func (api *API) registerUnlimitedRoute(method, path string, h httprouter.Handle) {
+	api.handleRoute(method, path, h, false)
+}
+
+// handleRoute registers the handler for the route. If limited is true, the
+// concurrency limit is applied as the outermost middleware.
+func (api *API) handleRoute(method, path string, h httprouter.Handle, limited bool) {
+	h = api.WithAccessLog(h)
+	legacy := WithAPIVersion(apiVersionLegacy, h)
+	v1 := WithAPIVersion(apiVersionV1, h)
+	if limited {
+		legacy = api.WithConcurrencyLimit(legacy)
+		v1 = api.WithConcurrencyLimit(v1)
+	}
+	api.staticRouter.Handle(method, api.routePath(path), legacy)
+	api.staticRouter.Handle(method, api.routePath("/"+apiVersionV1+path), v1)
+}
+
+// resourcePath returns the path of the resource with the given path within
+// the route set which serves the request, i.e. prefixed with the configured
+// base path and the version of the request's route.
+func (api *API) resourcePath(req *http.Request, path string) string {
+	if version, _ := req.Context().Value(apiVersionKey{}).(string); version == apiVersionV1 {
+		path = "/" + apiVersionV1 + path
+	}
+	return api.routePath(path)
+}
+
+// routePath returns the path under which the route with the given path is
+// served, i.e. prefixed with the configured base path.
+func (api *API) routePath(path string) string {
+	return normalizeBasePath(api.staticConfig.BasePath) + path
+}
+
+// normalizeBasePath turns a base path into the form routes are prefixed with,
+// i.e. with a leading and without a trailing slash. An empty base path stays
+// empty.
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// WithAPIVersion stamps the version of the route set and the version of the
+// build onto every response of the handler. The version of the route set is
+// also passed on to the handler with the request's context.
+func WithAPIVersion(version string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		w.Header().Set(apiVersionHeader, version)
+		w.Header().Set(buildVersionHeader, build.Version())
+		req = req.WithContext(context.WithValue(req.Context(), apiVersionKey{}, version))
+		h(w, req, ps)
+	}
 }
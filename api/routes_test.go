@@ -0,0 +1,175 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/promoter/build"
+	"github.com/SkynetLabs/promoter/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// TestAPIVersionHeader ensures that both versioned and legacy routes respond
+// with the version of the route set that served them.
+func TestAPIVersionHeader(t *testing.T) {
+	api, _ := newTestAPI(Config{})
+	api.staticRouter = httprouter.New()
+	api.buildHTTPRoutes()
+
+	tests := []struct {
+		path    string
+		version string
+	}{
+		{"/stats/tiers", apiVersionLegacy},
+		{"/v1/stats/tiers", apiVersionV1},
+	}
+	for _, tt := range tests {
+		// The request is missing its query parameters, which makes the
+		// handler fail before it touches the database.
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		api.staticRouter.ServeHTTP(rw, req)
+		if rw.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status %d, got %d", tt.path, http.StatusBadRequest, rw.Code)
+		}
+		if v := rw.Header().Get(apiVersionHeader); v != tt.version {
+			t.Fatalf("%s: expected API version '%s', got '%s'", tt.path, tt.version, v)
+		}
+		if v := rw.Header().Get(buildVersionHeader); v != build.Version() {
+			t.Fatalf("%s: expected build version '%s', got '%s'", tt.path, build.Version(), v)
+		}
+	}
+}
+
+// TestDisabledFeatures ensures that the routes of disabled features are not
+// registered while the routes of enabled features are.
+func TestDisabledFeatures(t *testing.T) {
+	api, _ := newTestAPI(Config{DisabledFeatures: []string{FeatureDebits}})
+	api.staticRouter = httprouter.New()
+	api.buildHTTPRoutes()
+
+	// The debits route of the disabled feature doesn't exist.
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/debits/sub", nil)
+	api.staticRouter.ServeHTTP(rw, req)
+	if rw.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d", http.StatusNotFound, rw.Code)
+	}
+
+	// The stats route of an enabled feature exists. The request is missing
+	// its query parameters, which makes the handler fail before it touches
+	// the database.
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/stats/tiers", nil)
+	api.staticRouter.ServeHTTP(rw, req)
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, rw.Code)
+	}
+}
+
+// TestDebugSchema ensures that /debug/schema serves the database schema to
+// authenticated requests only.
+func TestDebugSchema(t *testing.T) {
+	api, _ := newTestAPI(Config{APIKey: "key"})
+	api.staticRouter = httprouter.New()
+	api.buildHTTPRoutes()
+
+	// Without the API key, the request is rejected.
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/debug/schema", nil)
+	api.staticRouter.ServeHTTP(rw, req)
+	if rw.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/debug/schema", nil)
+	req.Header.Set(apiKeyHeader, "key")
+	api.staticRouter.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rw.Code)
+	}
+	expected, err := database.SchemaJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(rw.Body.String()) != string(expected) {
+		t.Fatalf("Expected schema %s, got %s", expected, rw.Body.String())
+	}
+}
+
+// TestBasePath ensures that all routes are registered under the configured
+// base path and that the client prefixes its requests with it.
+func TestBasePath(t *testing.T) {
+	api, _ := newTestAPI(Config{BasePath: "/promoter/"})
+	api.staticRouter = httprouter.New()
+	api.buildHTTPRoutes()
+
+	// The routes are reachable under the base path but not at the root. The
+	// requests are missing their query parameters, which makes the handler
+	// fail before it touches the database.
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/promoter/stats/tiers", http.StatusBadRequest},
+		{"/promoter/v1/stats/tiers", http.StatusBadRequest},
+		{"/stats/tiers", http.StatusNotFound},
+		{"/v1/stats/tiers", http.StatusNotFound},
+		{"/health", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		api.staticRouter.ServeHTTP(rw, req)
+		if rw.Code != tt.status {
+			t.Fatalf("%s: expected status %d, got %d", tt.path, tt.status, rw.Code)
+		}
+	}
+
+	// A client with the same base path reaches the handler.
+	server := httptest.NewServer(api.staticRouter)
+	defer server.Close()
+	now := time.Now()
+	c := NewCustomClient(server.URL, "promoter", "")
+	_, err := c.StatsTiers(now, now.Add(-time.Hour))
+	if err == nil || !strings.Contains(err.Error(), "must be before") {
+		t.Fatalf("Expected the handler to reject the window, got %v", err)
+	}
+
+	// A client without it doesn't.
+	c = NewClient(server.URL)
+	_, err = c.StatsTiers(now, now.Add(-time.Hour))
+	if err == nil || strings.Contains(err.Error(), "must be before") {
+		t.Fatalf("Expected the route not to be found, got %v", err)
+	}
+}
+
+// TestResourcePath ensures that resource paths are built within the route set
+// which serves the request.
+func TestResourcePath(t *testing.T) {
+	tests := []struct {
+		basePath string
+		version  string
+		expected string
+	}{
+		{"", apiVersionLegacy, "/subscription/id"},
+		{"", apiVersionV1, "/v1/subscription/id"},
+		{"/promoter", apiVersionLegacy, "/promoter/subscription/id"},
+		{"/promoter", apiVersionV1, "/promoter/v1/subscription/id"},
+	}
+	for _, tt := range tests {
+		api, _ := newTestAPI(Config{BasePath: tt.basePath})
+		var path string
+		h := WithAPIVersion(tt.version, func(_ http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+			path = api.resourcePath(req, "/subscription/id")
+		})
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/subscription", nil), nil)
+		if path != tt.expected {
+			t.Fatalf("%s %s: expected %s, got %s", tt.basePath, tt.version, tt.expected, path)
+		}
+	}
+}
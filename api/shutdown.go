@@ -0,0 +1,59 @@
+package api
+
+import (
+	"context"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// beginInFlight registers a call which uses a database session. It returns
+// false if the API is shutting down and doesn't accept new calls anymore.
+// Otherwise, staticInFlight.Done needs to be called once the call is done.
+func (api *API) beginInFlight() bool {
+	api.inFlightMu.Lock()
+	defer api.inFlightMu.Unlock()
+	if api.draining {
+		return false
+	}
+	api.staticInFlight.Add(1)
+	return true
+}
+
+// abortable returns a context derived from the given one which is cancelled
+// when WaitInFlight gives up on waiting for in-flight calls.
+func (api *API) abortable(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-api.staticAbort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// WaitInFlight stops accepting new calls which use a database session, e.g.
+// payments, and waits for the in-flight ones to finish. If they don't finish
+// before the context expires, they are aborted, which rolls back their
+// transactions, and an error is returned once they have returned. It's meant
+// to be called after Shutdown and before the database is closed.
+func (api *API) WaitInFlight(ctx context.Context) error {
+	api.inFlightMu.Lock()
+	api.draining = true
+	api.inFlightMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		api.staticInFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	api.abortOnce.Do(func() { close(api.staticAbort) })
+	<-done
+	return errors.AddContext(ctx.Err(), "in-flight calls were aborted")
+}
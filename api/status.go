@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SkynetLabs/promoter/build"
+	"github.com/SkynetLabs/promoter/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// statusCheckTimeout is the time every check of the /status endpoint
+	// gets before it's considered failed.
+	statusCheckTimeout = 2 * time.Second
+)
+
+// statusGET returns the aggregated status of the service and its
+// dependencies. The checks run concurrently and each of them has its own
+// timeout, so a slow dependency doesn't delay the other checks.
+func (api *API) statusGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	status := StatusGET{
+		ReadOnly:     api.ReadOnly(),
+		BuildVersion: build.Version(),
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		status.Database = runStatusCheck(req.Context(), api.staticDB.Ping)
+	}()
+	if api.staticConfig.AccountsAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			check := runStatusCheck(req.Context(), api.dialAccounts)
+			status.Accounts = &check
+		}()
+	}
+	wg.Wait()
+	status.Workers = statusWorkers(api.staticDB.WorkerHealth())
+	api.WriteJSON(w, status)
+}
+
+// statusWorkers converts the health of the background workers into the
+// format reported by /status.
+func statusWorkers(workers []database.WorkerStatus) []StatusWorker {
+	sw := make([]StatusWorker, 0, len(workers))
+	for _, w := range workers {
+		s := StatusWorker{
+			Name:          w.Name,
+			OK:            w.Healthy,
+			LastHeartbeat: w.LastHeartbeat,
+		}
+		if w.Error != nil {
+			s.Error = w.Error.Error()
+		}
+		sw = append(sw, s)
+	}
+	return sw
+}
+
+// dialAccounts checks whether the accounts service accepts connections.
+func (api *API) dialAccounts(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", api.staticConfig.AccountsAddr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// runStatusCheck runs the check with a timeout of statusCheckTimeout and
+// reports its outcome.
+func runStatusCheck(ctx context.Context, check func(context.Context) error) StatusCheck {
+	ctx, cancel := context.WithTimeout(ctx, statusCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := check(ctx)
+	sc := StatusCheck{
+		OK:        err == nil,
+		LatencyMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		sc.Error = err.Error()
+	}
+	return sc
+}
@@ -1,18 +1,316 @@
 package api
 
-import "gitlab.com/NebulousLabs/errors"
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/promoter/database"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// These are the limits for the metadata of payments.
+const (
+	// maxMetadataKeys is the maximum number of metadata entries.
+	maxMetadataKeys = 16
+	// maxMetadataKeyLen is the maximum length of a metadata key in bytes.
+	maxMetadataKeyLen = 64
+	// maxMetadataValueLen is the maximum length of a metadata value in
+	// bytes.
+	maxMetadataValueLen = 512
+)
+
+// MetadataTimestamp is the metadata key under which payment processors pass
+// the time they created a payment, either in RFC3339 format or as a unix
+// timestamp in seconds.
+const MetadataTimestamp = "timestamp"
+
+// maxSubscriptionEnd is how far in the future a subscription may end at most.
+// Anything beyond that is most likely a mistake by the caller.
+const maxSubscriptionEnd = 10 * 365 * 24 * time.Hour
 
 // These are the request and response types used by the API.
 type (
 	// PaymentPOST describes a request which notifies Promoter of an incoming
 	// txn that credits the balance of a user with a given sub.
 	PaymentPOST struct {
-		TxnID   string  `json:"txnID"`
-		Sub     string  `json:"sub"`
+		TxnID    string            `json:"txnID"`
+		Sub      string            `json:"sub"`
+		Credits  float64           `json:"credits"`
+		Metadata map[string]string `json:"metadata,omitempty"`
+	}
+
+	// PaymentResponse is the type returned by the /payment endpoint. It
+	// contains the amount of credits that was applied after rounding and the
+	// user's total balance after the payment.
+	PaymentResponse struct {
 		Credits float64 `json:"credits"`
+		Balance float64 `json:"balance"`
+		// AlreadyProcessed is true if the payment's txn had been
+		// processed before, in which case the payment wasn't credited
+		// again.
+		AlreadyProcessed bool `json:"alreadyProcessed"`
+	}
+
+	// SubscriptionPOST describes a request which subscribes a user to a tier
+	// for the given period. The tier's configured price is paid from the
+	// user's balance.
+	SubscriptionPOST struct {
+		Sub  string    `json:"sub"`
+		Tier int       `json:"tier"`
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	}
+
+	// SubscriptionGET describes a subscription period. It's returned by the
+	// /subscription/:id endpoint and when a subscription is created.
+	SubscriptionGET struct {
+		ID    string    `json:"id"`
+		Sub   string    `json:"sub"`
+		Tier  int       `json:"tier"`
+		From  time.Time `json:"from"`
+		To    time.Time `json:"to"`
+		Price float64   `json:"price"`
+	}
+
+	// AlertsGET is the type returned by the /alerts endpoint.
+	AlertsGET struct {
+		Alerts []AlertGET `json:"alerts"`
+	}
+
+	// AlertGET describes a sub which was flagged for receiving an abnormal
+	// amount of credits.
+	AlertGET struct {
+		Sub            string    `json:"sub"`
+		Credits        float64   `json:"credits"`
+		FirstFlaggedAt time.Time `json:"firstFlaggedAt"`
+		LastFlaggedAt  time.Time `json:"lastFlaggedAt"`
+	}
+
+	// BalanceGET is the type returned by the /balance/:sub endpoint. Balance
+	// is the net balance, i.e. Credit minus Spent. Available is the part of
+	// the balance which isn't reserved by holds.
+	BalanceGET struct {
+		Sub       string  `json:"sub"`
+		Balance   float64 `json:"balance"`
+		Available float64 `json:"available"`
+		Credit    float64 `json:"credit"`
+		Spent     float64 `json:"spent"`
+	}
+
+	// UserEligibleGET is the type returned by the /user/:sub/eligible
+	// endpoint. Reason is the reason for the decision and Gap is the amount
+	// of credits the user is short of the tier's price, if any.
+	UserEligibleGET struct {
+		Sub         string  `json:"sub"`
+		Tier        int     `json:"tier"`
+		CurrentTier int     `json:"currentTier"`
+		Eligible    bool    `json:"eligible"`
+		Reason      string  `json:"reason"`
+		Gap         float64 `json:"gap,omitempty"`
+	}
+
+	// DebugTierPOST describes a hypothetical user state for which the
+	// /debug/tier endpoint computes the tier. If At is zero, the tier is
+	// computed for the current time.
+	DebugTierPOST struct {
+		Balance       float64                 `json:"balance"`
+		Subscriptions []DebugTierSubscription `json:"subscriptions"`
+		At            time.Time               `json:"at"`
+	}
+
+	// DebugTierSubscription is a hypothetical subscription period.
+	DebugTierSubscription struct {
+		Tier int       `json:"tier"`
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	}
+
+	// DebugTierResponse is the type returned by the /debug/tier endpoint.
+	// Rule is the rule which determined the tier. Subscription is the index
+	// of the subscription the tier was derived from and nil if the user is on
+	// the default tier.
+	DebugTierResponse struct {
+		Tier         int    `json:"tier"`
+		Rule         string `json:"rule"`
+		Subscription *int   `json:"subscription,omitempty"`
+	}
+
+	// RetriesGET is the type returned by the /debug/retries endpoint. Calls
+	// maps the number of times a call was retried due to a WriteConflict,
+	// i.e. "0", "1" or "2+", to the number of such calls. Retries is the
+	// total number of retries.
+	RetriesGET struct {
+		Calls   map[string]int64 `json:"calls"`
+		Retries int64            `json:"retries"`
+	}
+
+	// IndexesGET is the type returned by the /debug/indexes endpoint. It
+	// maps the name of each collection to a comparison of its declared and
+	// existing indexes.
+	IndexesGET struct {
+		Collections map[string]CollectionIndexesGET `json:"collections"`
+	}
+
+	// CollectionIndexesGET compares the declared and existing indexes of a
+	// collection. Missing indexes are declared but don't exist and
+	// unexpected ones exist but aren't declared.
+	CollectionIndexesGET struct {
+		Expected   []string `json:"expected"`
+		Existing   []string `json:"existing"`
+		Missing    []string `json:"missing"`
+		Unexpected []string `json:"unexpected"`
+	}
+
+	// Page is the envelope returned by all list endpoints. Total is the
+	// number of items across all pages. NextOffset is the offset of the
+	// next page and nil on the last page.
+	Page[T any] struct {
+		Items      []T    `json:"items"`
+		Total      int64  `json:"total"`
+		Limit      int64  `json:"limit"`
+		Offset     int64  `json:"offset"`
+		NextOffset *int64 `json:"nextOffset"`
+	}
+
+	// StatusCheck is the result of a single check of the /status endpoint.
+	StatusCheck struct {
+		OK        bool   `json:"ok"`
+		LatencyMS int64  `json:"latencyMS"`
+		Error     string `json:"error,omitempty"`
+	}
+
+	// StatusGET is the type returned by the /status endpoint. Accounts is
+	// nil if no accounts service is configured. ReadOnly is true while
+	// writes are rejected.
+	StatusGET struct {
+		Database     StatusCheck    `json:"database"`
+		Accounts     *StatusCheck   `json:"accounts,omitempty"`
+		Workers      []StatusWorker `json:"workers"`
+		ReadOnly     bool           `json:"readOnly"`
+		BuildVersion string         `json:"buildVersion"`
+	}
+
+	// StatusWorker is the health of a background worker as reported by the
+	// /status endpoint. A worker is unhealthy if it missed too many
+	// heartbeats.
+	StatusWorker struct {
+		Name          string    `json:"name"`
+		OK            bool      `json:"ok"`
+		LastHeartbeat time.Time `json:"lastHeartbeat"`
+		Error         string    `json:"error,omitempty"`
+	}
+
+	// OrphanTxnsGET is the type returned by the /debug/txns/orphans
+	// endpoint. It contains all txns whose sub has no user.
+	OrphanTxnsGET struct {
+		Txns []TxnGET `json:"txns"`
+	}
+
+	// TxnReassignPOST describes a request which moves a txn to another
+	// sub.
+	TxnReassignPOST struct {
+		Sub string `json:"sub"`
+	}
+
+	// TxnReassignResponse is the type returned by the /txn/:id/reassign
+	// endpoint. It contains the reassigned txn and the resulting balances
+	// of the sub the txn was moved from and the one it was moved to.
+	TxnReassignResponse struct {
+		Txn         TxnGET  `json:"txn"`
+		FromSub     string  `json:"fromSub"`
+		FromBalance float64 `json:"fromBalance"`
+		ToBalance   float64 `json:"toBalance"`
+	}
+
+	// TxnGET describes a single txn.
+	TxnGET struct {
+		ID        string            `json:"id"`
+		Sub       string            `json:"sub"`
+		Amount    float64           `json:"amount"`
+		Source    string            `json:"source"`
+		Metadata  map[string]string `json:"metadata,omitempty"`
+		CreatedAt time.Time         `json:"createdAt"`
+		DeletedAt *time.Time        `json:"deletedAt,omitempty"`
+	}
+
+	// TxnsSinceGET is the type returned by the /txns/since endpoint. Next is
+	// the cursor to pass as 'after' to request the next page. If there are
+	// no new txns, it's the cursor of the request.
+	TxnsSinceGET struct {
+		Txns []TxnGET `json:"txns"`
+		Next string   `json:"next"`
+	}
+
+	// StatsRevenueGET is the type returned by the /stats/revenue endpoint.
+	StatsRevenueGET struct {
+		Revenue float64 `json:"revenue"`
+	}
+
+	// StatsTiersGET is the type returned by the /stats/tiers endpoint. It maps
+	// subscription tiers to the total price of their subscriptions.
+	StatsTiersGET struct {
+		Tiers map[int]float64 `json:"tiers"`
+	}
+
+	// StatsTopGET is the type returned by the /stats/top endpoint. N is the
+	// effective number of requested subs after clamping.
+	StatsTopGET struct {
+		N     int              `json:"n"`
+		Users []UserBalanceGET `json:"users"`
+	}
+
+	// UserBalanceGET is the net balance of a single sub.
+	UserBalanceGET struct {
+		Sub     string  `json:"sub"`
+		Balance float64 `json:"balance"`
+	}
+
+	// StatsSubscribersGET is the type returned by the /stats/subscribers
+	// endpoint. It maps subscription tiers to their number of subscribers.
+	StatsSubscribersGET struct {
+		Tiers map[int]int64 `json:"tiers"`
 	}
 )
 
+// UnmarshalJSON implements json.Unmarshaler. Some payment processors send
+// the credits as a string, e.g. "12.50", so both numbers and numeric strings
+// are accepted. The credits are decoded separately, so errors of the other
+// fields aren't mistaken for invalid credits. Surrounding whitespace is
+// removed from the sub like it is from subs in paths, so the user can be
+// looked up by it later.
+func (p *PaymentPOST) UnmarshalJSON(b []byte) error {
+	type alias PaymentPOST
+	aux := struct {
+		*alias
+		Credits json.RawMessage `json:"credits"`
+	}{
+		alias: (*alias)(p),
+	}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	p.Sub = strings.TrimSpace(p.Sub)
+	var number json.Number
+	if len(aux.Credits) > 0 {
+		if err := json.Unmarshal(aux.Credits, &number); err != nil {
+			return errors.AddContext(err, "credits must be a number or a numeric string")
+		}
+	}
+	if number == "" {
+		p.Credits = 0
+		return nil
+	}
+	credits, err := number.Float64()
+	if err != nil {
+		return errors.AddContext(err, "invalid credits")
+	}
+	p.Credits = credits
+	return nil
+}
+
 // Validate ensures the payment information is valid and complete.
 func (p *PaymentPOST) Validate() error {
 	if p.Credits <= 0 {
@@ -24,5 +322,116 @@ func (p *PaymentPOST) Validate() error {
 	if p.TxnID == "" {
 		return errors.New("missing or empty txn ID")
 	}
+	if database.IsReservedTxnID(p.TxnID) {
+		return ErrReservedTxnID
+	}
+	return validateMetadata(p.Metadata)
+}
+
+// Timestamp returns the time the payment processor created the payment as
+// passed via the MetadataTimestamp metadata key. If the payment has no
+// timestamp, false is returned.
+func (p *PaymentPOST) Timestamp() (time.Time, bool, error) {
+	ts, ok := p.Metadata[MetadataTimestamp]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	if t, err := time.Parse(time.RFC3339, ts); err == nil {
+		return t, true, nil
+	}
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid payment timestamp '%s'", ts)
+	}
+	return time.Unix(secs, 0), true, nil
+}
+
+// validateMetadata ensures that the metadata of a payment doesn't exceed the
+// limits on the number and size of its entries. Keys which MongoDB would treat
+// as paths or operators, i.e. keys containing a '.' or starting with a '$', are
+// rejected as well.
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataKeys {
+		return fmt.Errorf("metadata has %d keys, at most %d are allowed", len(metadata), maxMetadataKeys)
+	}
+	for k, v := range metadata {
+		if k == "" {
+			return errors.New("metadata keys must not be empty")
+		}
+		if len(k) > maxMetadataKeyLen {
+			return fmt.Errorf("metadata key '%s' exceeds %d bytes", k, maxMetadataKeyLen)
+		}
+		if strings.Contains(k, ".") || strings.HasPrefix(k, "$") {
+			return fmt.Errorf("metadata key '%s' must not contain '.' or start with '$'", k)
+		}
+		if len(v) > maxMetadataValueLen {
+			return fmt.Errorf("metadata value of key '%s' exceeds %d bytes", k, maxMetadataValueLen)
+		}
+	}
 	return nil
 }
+
+// Validate ensures the subscription information is valid and complete. All
+// problems with the subscription are combined into the returned error.
+func (s *SubscriptionPOST) Validate() error {
+	var errs []error
+	if s.Sub == "" {
+		errs = append(errs, errors.New("missing or empty sub"))
+	}
+	if s.Tier <= 0 {
+		errs = append(errs, errors.New("non-positive tier"))
+	}
+	if s.From.IsZero() {
+		errs = append(errs, errors.New("missing or zero 'from' time"))
+	}
+	if s.To.IsZero() {
+		errs = append(errs, errors.New("missing or zero 'to' time"))
+	}
+	if !s.From.Before(s.To) {
+		errs = append(errs, database.ErrInvalidPeriod)
+	}
+	if s.To.After(time.Now().Add(maxSubscriptionEnd)) {
+		errs = append(errs, fmt.Errorf("subscription must not end more than %v in the future", maxSubscriptionEnd))
+	}
+	return errors.Compose(errs...)
+}
+
+// newPage creates a page from the items at the given offset.
+func newPage[T any](items []T, total, limit, offset int64) Page[T] {
+	p := Page[T]{
+		Items:  items,
+		Total:  total,
+		Limit:  limit,
+		Offset: offset,
+	}
+	if next := offset + int64(len(items)); len(items) > 0 && next < total {
+		p.NextOffset = &next
+	}
+	return p
+}
+
+// subscriptionGETFromSubscription converts a database.Subscription into a
+// SubscriptionGET.
+func subscriptionGETFromSubscription(s database.Subscription) SubscriptionGET {
+	return SubscriptionGET{
+		ID:    s.ID.Hex(),
+		Sub:   s.Sub,
+		Tier:  s.Tier,
+		From:  s.From,
+		To:    s.To,
+		Price: s.Price,
+	}
+}
+
+// txnGETFromTxn converts a database.Txn into a TxnGET.
+func txnGETFromTxn(txn database.Txn) TxnGET {
+	return TxnGET{
+		ID:        txn.ID,
+		Sub:       txn.Sub,
+		Amount:    txn.Amount,
+		Source:    txn.Source,
+		Metadata:  txn.Metadata,
+		CreatedAt: txn.CreatedAt,
+		DeletedAt: txn.DeletedAt,
+	}
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/promoter/database"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestSubscriptionPOSTValidate is a unit test for SubscriptionPOST.Validate.
+func TestSubscriptionPOSTValidate(t *testing.T) {
+	now := time.Now()
+	valid := SubscriptionPOST{
+		Sub:  "sub",
+		Tier: 2,
+		From: now,
+		To:   now.Add(time.Hour),
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// From after To.
+	sp := valid
+	sp.From, sp.To = sp.To, sp.From
+	if err := sp.Validate(); !errors.Contains(err, database.ErrInvalidPeriod) {
+		t.Fatalf("Expected %v, got %v", database.ErrInvalidPeriod, err)
+	}
+	// From equal to To.
+	sp = valid
+	sp.To = sp.From
+	if err := sp.Validate(); !errors.Contains(err, database.ErrInvalidPeriod) {
+		t.Fatalf("Expected %v, got %v", database.ErrInvalidPeriod, err)
+	}
+
+	// Every invalid field should be reported.
+	tests := []struct {
+		name   string
+		modify func(sp *SubscriptionPOST)
+		errMsg string
+	}{
+		{"EmptySub", func(sp *SubscriptionPOST) { sp.Sub = "" }, "sub"},
+		{"ZeroTier", func(sp *SubscriptionPOST) { sp.Tier = 0 }, "tier"},
+		{"NegativeTier", func(sp *SubscriptionPOST) { sp.Tier = -1 }, "tier"},
+		{"ZeroFrom", func(sp *SubscriptionPOST) { sp.From = time.Time{} }, "'from'"},
+		{"ZeroTo", func(sp *SubscriptionPOST) { sp.To = time.Time{} }, "'to'"},
+		{"FarFuture", func(sp *SubscriptionPOST) { sp.To = now.Add(2 * maxSubscriptionEnd) }, "future"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := valid
+			tt.modify(&sp)
+			err := sp.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Fatalf("Expected error containing '%s', got %v", tt.errMsg, err)
+			}
+		})
+	}
+
+	// Multiple problems are combined into a single error.
+	err := (&SubscriptionPOST{}).Validate()
+	for _, msg := range []string{"sub", "tier", "'from'", "'to'", database.ErrInvalidPeriod.Error()} {
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("Expected error containing '%s', got %v", msg, err)
+		}
+	}
+}
+
+// TestPaymentPOSTUnmarshalJSON ensures that credits can be decoded from both
+// numbers and numeric strings and that they are always encoded as numbers.
+func TestPaymentPOSTUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		body    string
+		credits float64
+		valid   bool
+	}{
+		{`{"txnID":"txn","sub":"sub","credits":12.5}`, 12.5, true},
+		{`{"txnID":"txn","sub":"sub","credits":"12.50"}`, 12.5, true},
+		{`{"txnID":"txn","sub":"sub","credits":"1e2"}`, 100, true},
+		{`{"txnID":"txn","sub":"sub"}`, 0, true},
+		{`{"txnID":"txn","sub":" sub\t","credits":1}`, 1, true},
+		{`{"txnID":"txn","sub":"sub","credits":"twelve"}`, 0, false},
+		{`{"txnID":"txn","sub":"sub","credits":""}`, 0, false},
+		{`{"txnID":"txn","sub":"sub","credits":true}`, 0, false},
+	}
+	for _, tt := range tests {
+		var p PaymentPOST
+		err := json.Unmarshal([]byte(tt.body), &p)
+		if tt.valid && err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.body, err)
+		}
+		if !tt.valid {
+			if err == nil {
+				t.Fatalf("%s: expected an error", tt.body)
+			}
+			continue
+		}
+		if p.Credits != tt.credits || p.TxnID != "txn" || p.Sub != "sub" {
+			t.Fatalf("%s: unexpected payment %+v", tt.body, p)
+		}
+	}
+
+	// Subs which consist only of whitespace are rejected.
+	var blank PaymentPOST
+	if err := json.Unmarshal([]byte(`{"txnID":"txn","sub":"  ","credits":1}`), &blank); err != nil {
+		t.Fatal(err)
+	}
+	if err := blank.Validate(); err == nil {
+		t.Fatal("Expected a blank sub to be rejected")
+	}
+
+	// Only errors of the credits are reported as such.
+	errTests := []struct {
+		body    string
+		credits bool
+	}{
+		{`{"txnID":"txn","sub":"sub","credits":true}`, true},
+		{`{"txnID":"txn","sub":"sub","credits":{}}`, true},
+		{`{"txnID":1,"sub":"sub","credits":1}`, false},
+		{`{"txnID":"txn","sub":["sub"],"credits":1}`, false},
+		{`{"txnID":"txn","sub":"sub","credits":1,"metadata":"meta"}`, false},
+		{`{"txnID":"txn",`, false},
+	}
+	for _, tt := range errTests {
+		var p PaymentPOST
+		err := json.Unmarshal([]byte(tt.body), &p)
+		if err == nil {
+			t.Fatalf("%s: expected an error", tt.body)
+		}
+		if strings.Contains(err.Error(), "credits") != tt.credits {
+			t.Fatalf("%s: expected credits error %v, got %v", tt.body, tt.credits, err)
+		}
+	}
+
+	// Credits are encoded as numbers.
+	b, err := json.Marshal(PaymentPOST{TxnID: "txn", Sub: "sub", Credits: 12.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"txnID":"txn","sub":"sub","credits":12.5}`; string(b) != expected {
+		t.Fatalf("Expected '%s', got '%s'", expected, string(b))
+	}
+}
+
+// TestNewPage is a unit test for newPage.
+func TestNewPage(t *testing.T) {
+	tests := []struct {
+		items      []int
+		total      int64
+		limit      int64
+		offset     int64
+		nextOffset *int64
+	}{
+		// First of multiple pages.
+		{[]int{1, 2}, 5, 2, 0, func() *int64 { n := int64(2); return &n }()},
+		// Middle page.
+		{[]int{3, 4}, 5, 2, 2, func() *int64 { n := int64(4); return &n }()},
+		// Last page.
+		{[]int{5}, 5, 2, 4, nil},
+		// Exactly filled last page.
+		{[]int{1, 2}, 2, 2, 0, nil},
+		// Offset beyond the end.
+		{[]int{}, 5, 2, 10, nil},
+	}
+	for _, tt := range tests {
+		p := newPage(tt.items, tt.total, tt.limit, tt.offset)
+		if p.Total != tt.total || p.Limit != tt.limit || p.Offset != tt.offset || len(p.Items) != len(tt.items) {
+			t.Errorf("Unexpected page %+v", p)
+		}
+		if (p.NextOffset == nil) != (tt.nextOffset == nil) {
+			t.Errorf("Expected nextOffset %v, got %v", tt.nextOffset, p.NextOffset)
+		} else if p.NextOffset != nil && *p.NextOffset != *tt.nextOffset {
+			t.Errorf("Expected nextOffset %v, got %v", *tt.nextOffset, *p.NextOffset)
+		}
+	}
+
+	// nextOffset is encoded as null on the last page.
+	b, err := json.Marshal(newPage([]int{1}, 1, 2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"nextOffset":null`) {
+		t.Fatalf("Expected null nextOffset, got %s", b)
+	}
+}
+
+// TestPaymentPOSTValidateMetadata ensures that the metadata of payments is
+// limited.
+func TestPaymentPOSTValidateMetadata(t *testing.T) {
+	manyKeys := make(map[string]string)
+	for i := 0; i <= maxMetadataKeys; i++ {
+		manyKeys[fmt.Sprint(i)] = "value"
+	}
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		valid    bool
+	}{
+		{"none", nil, true},
+		{"some", map[string]string{"orderID": "123", "region": "eu"}, true},
+		{"too many keys", manyKeys, false},
+		{"empty key", map[string]string{"": "value"}, false},
+		{"long key", map[string]string{strings.Repeat("k", maxMetadataKeyLen+1): "value"}, false},
+		{"long value", map[string]string{"key": strings.Repeat("v", maxMetadataValueLen+1)}, false},
+		{"dotted key", map[string]string{"order.id": "123"}, false},
+		{"operator key", map[string]string{"$set": "123"}, false},
+		{"inner dollar", map[string]string{"price$": "123"}, true},
+	}
+	for _, tt := range tests {
+		p := PaymentPOST{
+			TxnID:    "txn",
+			Sub:      "sub",
+			Credits:  1,
+			Metadata: tt.metadata,
+		}
+		err := p.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+
+	// Metadata survives decoding.
+	var p PaymentPOST
+	err := json.Unmarshal([]byte(`{"txnID":"txn","sub":"sub","credits":"1","metadata":{"orderID":"123"}}`), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Metadata["orderID"] != "123" {
+		t.Fatalf("Unexpected metadata %v", p.Metadata)
+	}
+}
+
+// TestPaymentPOSTValidateTxnID ensures that payments can't use the txn IDs
+// reserved for charges and captured holds.
+func TestPaymentPOSTValidateTxnID(t *testing.T) {
+	tests := []struct {
+		txnID string
+		err   error
+	}{
+		{"txn", nil},
+		{"my-subscription-1", nil},
+		{"subscription-62a1b2c3d4e5f6a7b8c9d0e1", ErrReservedTxnID},
+		{"hold-1", ErrReservedTxnID},
+	}
+	for _, tt := range tests {
+		p := PaymentPOST{TxnID: tt.txnID, Sub: "sub", Credits: 1}
+		if err := p.Validate(); err != tt.err {
+			t.Errorf("%s: expected %v, got %v", tt.txnID, tt.err, err)
+		}
+	}
+}
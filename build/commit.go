@@ -0,0 +1,19 @@
+package build
+
+// These variables are set at build time via ldflags. See the Makefile.
+var (
+	// GitRevision is the git commit hash of the build.
+	GitRevision string
+
+	// BuildTime is the time at which the binary was built.
+	BuildTime string
+)
+
+// Version returns the version of the build. If no version was set at build
+// time, "unknown" is returned.
+func Version() string {
+	if GitRevision == "" {
+		return "unknown"
+	}
+	return GitRevision
+}
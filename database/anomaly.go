@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// anomalyCheckInterval is the interval at which the anomaly detector
+	// checks for subs with suspicious credit rates.
+	anomalyCheckInterval = time.Minute
+)
+
+// expvarCreditAnomalies counts the subs which were newly flagged by the
+// anomaly detector.
+var expvarCreditAnomalies = expvar.NewInt("promoter_credit_anomalies")
+
+type (
+	// Alert describes a sub which received more credits within the
+	// anomaly window than the configured threshold allows. Credits is the
+	// amount of credits received within the window at the time the sub was
+	// last flagged.
+	Alert struct {
+		Domain         string    `bson:"domain"`
+		Sub            string    `bson:"sub"`
+		Credits        float64   `bson:"credits"`
+		FirstFlaggedAt time.Time `bson:"firstFlaggedAt"`
+		LastFlaggedAt  time.Time `bson:"lastFlaggedAt"`
+	}
+)
+
+// Alerts returns all subs flagged by the anomaly detector, most recently
+// flagged first.
+func (db *DB) Alerts(ctx context.Context) ([]Alert, error) {
+	opts := options.Find().SetSort(bson.D{{"lastFlaggedAt", -1}})
+	c, err := db.staticDB.Collection(collAlerts).Find(ctx, db.scoped(bson.D{}), opts)
+	if err != nil {
+		return nil, err
+	}
+	alerts := make([]Alert, 0)
+	err = c.All(ctx, &alerts)
+	if err != nil {
+		return nil, err
+	}
+	return alerts, nil
+}
+
+// DetectCreditAnomalies flags all subs which received more credits than the
+// configured threshold within the anomaly window ending at 'now'. Flagged
+// subs are recorded in the alerts collection. It returns the number of subs
+// which weren't flagged before.
+func (db *DB) DetectCreditAnomalies(ctx context.Context, now time.Time) (int, error) {
+	if db.staticConfig.AnomalyThreshold <= 0 {
+		return 0, nil
+	}
+	match := bson.D{{"$match", db.scopedTxns(bson.D{
+		{"amount", bson.D{{"$gt", 0}}},
+		{"createdAt", bson.D{{"$gte", now.Add(-db.staticConfig.AnomalyWindow).UTC()}}},
+	})}}
+	group := bson.D{{
+		"$group", bson.D{
+			{"_id", "$sub"},
+			{"credits", bson.D{{"$sum", "$amount"}}},
+		},
+	}}
+	threshold := bson.D{{"$match", bson.D{{"credits", bson.D{{"$gt", db.staticConfig.AnomalyThreshold}}}}}}
+	c, err := db.staticDB.Collection(collTnxs).Aggregate(ctx, mongo.Pipeline{match, group, threshold})
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = c.Close(ctx) }()
+
+	var flagged int
+	for c.Next(ctx) {
+		var anomaly struct {
+			Sub     string  `bson:"_id"`
+			Credits float64 `bson:"credits"`
+		}
+		if err = c.Decode(&anomaly); err != nil {
+			return flagged, err
+		}
+		res, err := db.staticDB.Collection(collAlerts).UpdateOne(ctx, db.scoped(bson.D{{"sub", anomaly.Sub}}), bson.M{
+			"$set": bson.M{
+				"credits":       anomaly.Credits,
+				"lastFlaggedAt": now.UTC(),
+			},
+			"$setOnInsert": bson.M{
+				"firstFlaggedAt": now.UTC(),
+			},
+		}, options.Update().SetUpsert(true))
+		if err != nil {
+			return flagged, err
+		}
+		if res.UpsertedCount > 0 {
+			flagged++
+			expvarCreditAnomalies.Add(1)
+			db.staticLogger.WithField("sub", anomaly.Sub).
+				Warnf("Sub received %v credits within %v", anomaly.Credits, db.staticConfig.AnomalyWindow)
+		}
+	}
+	return flagged, c.Err()
+}
+
+// threadedDetectCreditAnomalies periodically runs DetectCreditAnomalies until
+// the DB is closed. Every completed run counts as a heartbeat of the worker.
+func (db *DB) threadedDetectCreditAnomalies() {
+	ticker := time.NewTicker(anomalyCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.staticBGCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		_, err := db.DetectCreditAnomalies(db.staticBGCtx, time.Now())
+		if err != nil {
+			db.staticLogger.WithError(err).Error("Failed to detect credit anomalies")
+		}
+		db.staticWorkers.beat(workerAnomalyDetector, time.Now())
+	}
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestDetectCreditAnomalies ensures that subs which receive an abnormal burst
+// of credits are flagged.
+func TestDetectCreditAnomalies(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newCustomTestDB(t.Name(), t.Name(), Config{
+		AnomalyThreshold: 100,
+		AnomalyWindow:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Seed a burst of credits for one sub and regular activity for
+	// another.
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		_, err = db.CreditUser(ctx, "burst", 10, fmt.Sprintf("burst%d", i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		_, err = db.CreditUser(ctx, "regular", 10, fmt.Sprintf("regular%d", i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the burst should be flagged.
+	anomalies := expvarCreditAnomalies.Value()
+	now := time.Now()
+	flagged, err := db.DetectCreditAnomalies(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flagged != 1 {
+		t.Fatalf("Expected 1 flagged sub, got %v", flagged)
+	}
+	alerts, err := db.Alerts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 || alerts[0].Sub != "burst" || alerts[0].Credits != 200 {
+		t.Fatalf("Unexpected alerts %+v", alerts)
+	}
+
+	// Detecting again updates the alert but doesn't flag the sub again.
+	flagged, err = db.DetectCreditAnomalies(ctx, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flagged != 0 {
+		t.Fatalf("Expected no newly flagged subs, got %v", flagged)
+	}
+	if n := expvarCreditAnomalies.Value() - anomalies; n != 1 {
+		t.Fatalf("Expected metric to increase by 1, got %v", n)
+	}
+
+	// Once the burst is outside of the window, nothing is flagged anymore.
+	flagged, err = db.DetectCreditAnomalies(ctx, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flagged != 0 {
+		t.Fatalf("Expected no newly flagged subs, got %v", flagged)
+	}
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"expvar"
+	"fmt"
+)
+
+// These are the supported policies for operations which would drive a
+// balance below zero.
+const (
+	// NegativeBalanceBlock rejects such operations with
+	// ErrInsufficientBalance. It's the default.
+	NegativeBalanceBlock NegativeBalancePolicy = "block"
+	// NegativeBalanceAllow permits such operations.
+	NegativeBalanceAllow NegativeBalancePolicy = "allow"
+	// NegativeBalanceWarn permits such operations but logs a warning and
+	// counts them.
+	NegativeBalanceWarn NegativeBalancePolicy = "warn"
+)
+
+// expvarNegativeBalances counts the operations which drove a balance below
+// zero under NegativeBalanceWarn.
+var expvarNegativeBalances = expvar.NewInt("promoter_negative_balances")
+
+// NegativeBalancePolicy describes how operations which would drive a balance
+// below zero are handled.
+type NegativeBalancePolicy string
+
+// ParseNegativeBalancePolicy parses a negative balance policy from a string.
+func ParseNegativeBalancePolicy(s string) (NegativeBalancePolicy, error) {
+	switch p := NegativeBalancePolicy(s); p {
+	case NegativeBalanceBlock, NegativeBalanceAllow, NegativeBalanceWarn:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown negative balance policy '%s'", s)
+	}
+}
+
+// checkSpend applies the configured NegativeBalancePolicy to an operation
+// which spends the given amount of the sub's available balance.
+func (db *DB) checkSpend(sub string, available, amount float64) error {
+	if available >= amount {
+		return nil
+	}
+	switch db.staticConfig.NegativeBalancePolicy {
+	case NegativeBalanceAllow:
+		return nil
+	case NegativeBalanceWarn:
+		expvarNegativeBalances.Add(1)
+		db.staticLogger.WithField("sub", sub).
+			Warnf("Spending %v credits drives the available balance of %v below zero", amount, available)
+		return nil
+	default:
+		return ErrInsufficientBalance
+	}
+}
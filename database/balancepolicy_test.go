@@ -0,0 +1,81 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestNegativeBalancePolicy ensures that each policy is applied to a charge
+// which would drive the balance below zero.
+func TestNegativeBalancePolicy(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	tests := []struct {
+		policy  NegativeBalancePolicy
+		err     error
+		balance float64
+		warned  int64
+	}{
+		{"", ErrInsufficientBalance, 5, 0},
+		{NegativeBalanceBlock, ErrInsufficientBalance, 5, 0},
+		{NegativeBalanceAllow, nil, -2, 0},
+		{NegativeBalanceWarn, nil, -2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			db, err := newCustomTestDB(t.Name(), t.Name(), Config{NegativeBalancePolicy: tt.policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := dropTestDB(db); err != nil {
+					t.Fatal(err)
+				}
+			}()
+			ctx := context.Background()
+			_, err = db.CreditUser(ctx, "sub", 5, "txn", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			warned := expvarNegativeBalances.Value()
+			_, err = newTestCharge(ctx, db, "sub", 7)
+			if tt.err == nil && err != nil || tt.err != nil && !errors.Contains(err, tt.err) {
+				t.Fatalf("Expected %v, got %v", tt.err, err)
+			}
+			balance, _, err := db.UserBalance(ctx, "sub")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if balance != tt.balance {
+				t.Fatalf("Expected balance %v, got %v", tt.balance, balance)
+			}
+			if n := expvarNegativeBalances.Value() - warned; n != tt.warned {
+				t.Fatalf("Expected %v warnings, got %v", tt.warned, n)
+			}
+		})
+	}
+}
+
+// TestParseNegativeBalancePolicy is a unit test for
+// ParseNegativeBalancePolicy.
+func TestParseNegativeBalancePolicy(t *testing.T) {
+	for _, s := range []string{"block", "allow", "warn"} {
+		p, err := ParseNegativeBalancePolicy(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != s {
+			t.Fatalf("Expected %s, got %s", s, p)
+		}
+	}
+	for _, s := range []string{"", "Block", "deny"} {
+		if _, err := ParseNegativeBalancePolicy(s); err == nil {
+			t.Fatalf("Expected '%s' to be rejected", s)
+		}
+	}
+}
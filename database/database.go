@@ -2,10 +2,15 @@ package database
 
 import (
 	"context"
+	"fmt"
 	"gitlab.com/NebulousLabs/errors"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readconcern"
@@ -17,6 +22,32 @@ const (
 	// DBName is the name of the database to use for Promoter.
 	DBName = "promoter"
 
+	// TestDBPrefix is the prefix of the names of all databases created by
+	// tests. Only those databases can be dropped via Drop.
+	TestDBPrefix = "Test"
+
+	// DefaultHoldTTL is the default time after which holds expire.
+	DefaultHoldTTL = 15 * time.Minute
+
+	// DefaultAnomalyWindow is the default window of the anomaly detector.
+	DefaultAnomalyWindow = time.Hour
+
+	// DefaultPingTimeout is the default time after which a ping of the
+	// database is considered failed.
+	DefaultPingTimeout = 2 * time.Second
+
+	// DefaultTxnVisibilityLag is the default time txns are held back by
+	// TxnsAfter.
+	DefaultTxnVisibilityLag = 10 * time.Second
+
+	// collAlerts defines the name of the collection which will hold
+	// information about subs which were flagged for suspicious activity.
+	collAlerts = "alerts"
+
+	// collHolds defines the name of the collection which will hold
+	// information about credits that are reserved but not yet spent.
+	collHolds = "holds"
+
 	// collSubscriptions defines the name of the collection which will hold
 	// information about users' subscriptions.
 	collSubscriptions = "subscriptions"
@@ -33,6 +64,66 @@ const (
 )
 
 type (
+	// Config contains the optional settings of the DB.
+	Config struct {
+		// IndexBuildWorkers is the number of collections whose indexes are
+		// built concurrently on startup. Values below 2 build the indexes
+		// of one collection after another.
+		IndexBuildWorkers int
+
+		// HoldTTL is the time after which a hold that was neither captured
+		// nor released expires. Defaults to DefaultHoldTTL.
+		HoldTTL time.Duration
+
+		// NegativeBalancePolicy determines whether spending credits may
+		// drive a balance below zero. Defaults to NegativeBalanceBlock.
+		NegativeBalancePolicy NegativeBalancePolicy
+
+		// PingTimeout is the time after which a ping of the database is
+		// considered failed. It's kept low so that health checks fail fast
+		// during an outage instead of waiting for the client's server
+		// selection timeout. Defaults to DefaultPingTimeout.
+		PingTimeout time.Duration
+
+		// AnomalyThreshold is the amount of credits a sub may receive
+		// within AnomalyWindow before it's flagged. Zero disables the
+		// anomaly detector.
+		AnomalyThreshold float64
+
+		// AnomalyWindow is the window over which the credits of a sub are
+		// summed up by the anomaly detector. Defaults to
+		// DefaultAnomalyWindow.
+		AnomalyWindow time.Duration
+
+		// WorkerStallMultiple is the number of intervals a background
+		// worker may go without a heartbeat before it's reported as
+		// unhealthy. Defaults to DefaultWorkerStallMultiple.
+		WorkerStallMultiple int
+
+		// FuturePriceUpdatesOnly restricts price updates to subscriptions
+		// which haven't started yet. Otherwise, the price of current
+		// subscriptions can be updated as well.
+		FuturePriceUpdatesOnly bool
+
+		// SlowQueryThreshold is the duration above which MongoDB commands
+		// are logged as slow queries. Zero disables the slow query log.
+		SlowQueryThreshold time.Duration
+
+		// TxnVisibilityLag is the time after its creation before a txn is
+		// returned by TxnsAfter. A txn's creation time is set before the
+		// DB transaction which inserts it commits, so a txn might become
+		// visible after newer ones. The lag needs to exceed the time such
+		// a DB transaction takes for pollers not to skip txns. Defaults
+		// to DefaultTxnVisibilityLag.
+		TxnVisibilityLag time.Duration
+
+		// LegacyDomain is the domain which documents created before data
+		// was scoped to server domains are assigned to on startup. Leave
+		// it empty unless all of these documents belong to the same
+		// domain, e.g. because only one server used the database.
+		LegacyDomain string
+	}
+
 	// Health contains health information about the promoter. Namely, the
 	// database. If everything is ok all fields are 'nil'.
 	// Otherwise, the corresponding fields will contain an error.
@@ -40,11 +131,14 @@ type (
 		Database error
 	}
 
-	// DB is a wrapper around a database client.
+	// DB is a wrapper around a database client. All data it reads and
+	// writes is scoped to its server domain.
 	DB struct {
+		staticConfig       Config
 		staticDB           *mongo.Database
 		staticLogger       *logrus.Entry
 		staticServerDomain string
+		staticWorkers      *workerHeartbeats
 
 		staticCtx          context.Context
 		staticBGCtx        context.Context
@@ -54,16 +148,26 @@ type (
 )
 
 // New creates a new promoter from the given db credentials.
-func New(ctx context.Context, log *logrus.Entry, uri, username, password, domain, dbName string) (*DB, error) {
-	dbClient, err := connect(ctx, uri, username, password)
+func New(ctx context.Context, log *logrus.Entry, uri, username, password, domain, dbName string, cfg Config) (*DB, error) {
+	var monitor *event.CommandMonitor
+	if cfg.SlowQueryThreshold > 0 {
+		monitor = newSlowQueryLogger(log, cfg.SlowQueryThreshold).monitor()
+	}
+	dbClient, err := connect(ctx, uri, username, password, monitor)
+	if err != nil {
+		return nil, err
+	}
+	err = checkTransactionSupport(ctx, dbClient)
 	if err != nil {
+		_ = dbClient.Disconnect(ctx)
 		return nil, err
 	}
-	return newDB(ctx, log, dbClient, domain, dbName)
+	return newDB(ctx, log, dbClient, domain, dbName, cfg)
 }
 
-// connect creates a new database object that is connected to a mongodb.
-func connect(ctx context.Context, uri, username, password string) (*mongo.Client, error) {
+// connect creates a new database object that is connected to a mongodb. The
+// monitor is optional and receives the events of all commands.
+func connect(ctx context.Context, uri, username, password string, monitor *event.CommandMonitor) (*mongo.Client, error) {
 	// Connect to database.
 	creds := options.Credential{
 		Username: username,
@@ -75,22 +179,80 @@ func connect(ctx context.Context, uri, username, password string) (*mongo.Client
 		SetReadConcern(readconcern.Majority()).
 		SetReadPreference(readpref.Nearest()).
 		SetWriteConcern(writeconcern.New(writeconcern.WMajority()))
+	if monitor != nil {
+		opts = opts.SetMonitor(monitor)
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, errors.AddContext(err, "invalid database URI")
+	}
 	return mongo.Connect(ctx, opts)
 }
 
+// helloResult contains the fields of the result of MongoDB's hello command
+// which describe the type of the deployment.
+type helloResult struct {
+	SetName string `bson:"setName"`
+	Msg     string `bson:"msg"`
+}
+
+// checkTransactionSupport makes sure that the deployment the client is
+// connected to supports transactions, which the API relies on.
+func checkTransactionSupport(ctx context.Context, client *mongo.Client) error {
+	var hello helloResult
+	err := client.Database("admin").RunCommand(ctx, bson.D{{"hello", 1}}).Decode(&hello)
+	if err != nil {
+		return errors.AddContext(err, "failed to determine the type of the database deployment")
+	}
+	return hello.transactionSupport()
+}
+
+// transactionSupport returns an error if the deployment described by the
+// hello result doesn't support transactions. Only replica sets and sharded
+// clusters, which are accessed through mongos, do.
+func (h helloResult) transactionSupport() error {
+	if h.SetName != "" || h.Msg == "isdbgrid" {
+		return nil
+	}
+	return errors.New("the database is a standalone server which doesn't support transactions, it needs to be a replica set or a sharded cluster")
+}
+
 // newDB creates a new promoter object from a given db client.
-func newDB(ctx context.Context, log *logrus.Entry, client *mongo.Client, domain, dbName string) (*DB, error) {
+func newDB(ctx context.Context, log *logrus.Entry, client *mongo.Client, domain, dbName string, cfg Config) (*DB, error) {
 	db := client.Database(dbName)
-	err := ensureDBSchema(ctx, db, log)
+	err := runMigrations(ctx, db, cfg.LegacyDomain, log)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to run migrations")
+	}
+	err = ensureDBSchema(ctx, db, log, cfg.IndexBuildWorkers)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.HoldTTL <= 0 {
+		cfg.HoldTTL = DefaultHoldTTL
+	}
+	if cfg.NegativeBalancePolicy == "" {
+		cfg.NegativeBalancePolicy = NegativeBalanceBlock
+	}
+	if cfg.PingTimeout <= 0 {
+		cfg.PingTimeout = DefaultPingTimeout
+	}
+	if cfg.TxnVisibilityLag <= 0 {
+		cfg.TxnVisibilityLag = DefaultTxnVisibilityLag
+	}
+	if cfg.AnomalyWindow <= 0 {
+		cfg.AnomalyWindow = DefaultAnomalyWindow
+	}
+	if cfg.WorkerStallMultiple <= 0 {
+		cfg.WorkerStallMultiple = DefaultWorkerStallMultiple
+	}
 	// Create a new context for background threads.
 	bgCtx, cancel := context.WithCancel(ctx)
 	return &DB{
+		staticConfig:       cfg,
 		staticDB:           db,
 		staticLogger:       log,
 		staticServerDomain: domain,
+		staticWorkers:      newWorkerHeartbeats(),
 
 		staticCtx:          ctx,
 		staticBGCtx:        bgCtx,
@@ -98,16 +260,65 @@ func newDB(ctx context.Context, log *logrus.Entry, client *mongo.Client, domain,
 	}, nil
 }
 
-// Close gracefully shuts down the DB.
+// StartBackgroundThreads launches the background threads of the DB. They are
+// stopped by Close.
+func (db *DB) StartBackgroundThreads() {
+	if db.staticConfig.AnomalyThreshold > 0 {
+		db.staticWorkers.register(workerAnomalyDetector, anomalyCheckInterval, time.Now())
+		db.staticWG.Add(1)
+		expvarBackgroundWorkers.Add(1)
+		go func() {
+			defer db.staticWG.Done()
+			defer expvarBackgroundWorkers.Add(-1)
+			db.threadedDetectCreditAnomalies()
+		}()
+	}
+}
+
+// StopBackgroundThreads stops the background threads of the DB and waits for
+// them to return. It's safe to call it multiple times.
+func (db *DB) StopBackgroundThreads() {
+	db.staticThreadCancel()
+	db.staticWG.Wait()
+}
+
+// Close gracefully shuts down the DB. The background threads are stopped
+// before the database is disconnected.
 func (db *DB) Close() error {
+	db.StopBackgroundThreads()
 	return db.staticDB.Client().Disconnect(context.Background())
 }
 
 // Health returns some health information about the promoter.
 func (db *DB) Health() Health {
 	return Health{
-		Database: db.staticDB.Client().Ping(db.staticCtx, nil),
+		Database: db.Ping(db.staticCtx),
+	}
+}
+
+// Drop drops the whole database. Since this can't be undone, it's only
+// allowed for databases whose name starts with TestDBPrefix, which is the case
+// for all databases created by tests.
+func (db *DB) Drop(ctx context.Context) error {
+	if name := db.staticDB.Name(); !strings.HasPrefix(name, TestDBPrefix) {
+		return fmt.Errorf("refusing to drop database '%s' which isn't a test database", name)
 	}
+	return db.staticDB.Drop(ctx)
+}
+
+// scoped restricts the filter to the documents of the DB's server domain.
+// Every query needs to be scoped to make sure that multiple portals can share
+// a database without seeing each other's data.
+func (db *DB) scoped(filter bson.D) bson.D {
+	return append(bson.D{{"domain", db.staticServerDomain}}, filter...)
+}
+
+// Ping checks whether the database is reachable. It fails after the
+// configured PingTimeout at the latest.
+func (db *DB) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, db.staticConfig.PingTimeout)
+	defer cancel()
+	return db.staticDB.Client().Ping(ctx, nil)
 }
 
 // NewSession starts a new Mongo session.
@@ -116,22 +327,52 @@ func (db *DB) NewSession() (mongo.Session, error) {
 }
 
 // ensureDBSchema checks that we have all collections and indexes we need and
-// creates them if needed.
+// creates them if needed. Up to 'workers' collections are handled
+// concurrently. If that fails for any collection, the first error is
+// returned.
 // See https://docs.mongodb.com/manual/indexes/
 // See https://docs.mongodb.com/manual/core/index-unique/
-func ensureDBSchema(ctx context.Context, db *mongo.Database, log *logrus.Entry) error {
-	for collName, models := range schema() {
-		coll, err := ensureCollection(ctx, db, collName)
-		if err != nil {
-			return err
-		}
-		iv := coll.Indexes()
-		names, err := iv.CreateMany(ctx, models)
-		if err != nil {
-			return errors.AddContext(err, "failed to create indexes")
+func ensureDBSchema(ctx context.Context, db *mongo.Database, log *logrus.Entry, workers int) error {
+	if workers < 2 {
+		for collName, models := range schema() {
+			if err := ensureIndexes(ctx, db, log, collName, models); err != nil {
+				return err
+			}
 		}
-		log.Debugf("Ensured index exists: %v", names)
+		return nil
+	}
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	sem := make(chan struct{}, workers)
+	for collName, models := range schema() {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(collName string, models []mongo.IndexModel) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := ensureIndexes(ctx, db, log, collName, models); err != nil {
+				errOnce.Do(func() { firstErr = err })
+			}
+		}(collName, models)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// ensureIndexes makes sure that the given collection exists and has the given
+// indexes.
+func ensureIndexes(ctx context.Context, db *mongo.Database, log *logrus.Entry, collName string, models []mongo.IndexModel) error {
+	coll, err := ensureCollection(ctx, db, collName)
+	if err != nil {
+		return err
+	}
+	iv := coll.Indexes()
+	names, err := iv.CreateMany(ctx, models)
+	if err != nil {
+		return errors.AddContext(err, "failed to create indexes for "+collName)
 	}
+	log.Debugf("Ensured index exists: %v", names)
 	return nil
 }
 
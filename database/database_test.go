@@ -3,9 +3,14 @@ package database
 import (
 	"context"
 	"io"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 const (
@@ -13,21 +18,51 @@ const (
 	// nolint:gosec // Disable gosec since these are only test credentials.
 	testPassword = "aO4tV5tC1oU3oQ7u"
 	testURI      = "mongodb://localhost:37017"
+	// testStandaloneURI points to a server which isn't part of a replica
+	// set and therefore doesn't support transactions.
+	testStandaloneURI = "mongodb://localhost:37018"
 )
 
 // newTestDB creates a DB instance for testing
 // without the background threads being launched.
 func newTestDB(domain, dbName string) (*DB, error) {
+	return newCustomTestDB(domain, dbName, Config{})
+}
+
+// newCustomTestDB creates a DB instance with the given config for testing
+// without the background threads being launched. Since the names of subtests
+// contain slashes, which aren't allowed in database names, they are replaced.
+func newCustomTestDB(domain, dbName string, cfg Config) (*DB, error) {
+	dbName = strings.ReplaceAll(dbName, "/", "_")
 	// Create discard logger.
 	logger := logrus.New()
 	logger.SetOutput(io.Discard)
-	p, err := New(context.Background(), logrus.NewEntry(logger), testURI, testUsername, testPassword, domain, dbName)
+	p, err := New(context.Background(), logrus.NewEntry(logger), testURI, testUsername, testPassword, domain, dbName, cfg)
 	if err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
+// newTestCharge creates a subscription of the sub with the given price and
+// charges it.
+func newTestCharge(ctx context.Context, db *DB, sub string, price float64) (primitive.ObjectID, error) {
+	now := time.Now()
+	s, err := db.NewSubscription(ctx, sub, 2, now, now.Add(time.Hour), price)
+	if err != nil {
+		return primitive.ObjectID{}, err
+	}
+	return s.ID, db.ChargeSubscription(ctx, s.ID)
+}
+
+// dropTestDB drops the database of the DB and closes it.
+func dropTestDB(db *DB) error {
+	if err := db.Drop(context.Background()); err != nil {
+		return err
+	}
+	return db.Close()
+}
+
 // TestPromoterHealth is a unit test for the promoter's Health method.
 func TestPromoterHealth(t *testing.T) {
 	if testing.Short() {
@@ -40,7 +75,7 @@ func TestPromoterHealth(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer func() {
-		if err := db.Close(); err != nil {
+		if err := dropTestDB(db); err != nil {
 			t.Fatal(err)
 		}
 	}()
@@ -48,3 +83,304 @@ func TestPromoterHealth(t *testing.T) {
 		t.Fatal("not healthy", ph)
 	}
 }
+
+// TestEnsureDBSchemaConcurrent ensures that all indexes are created when the
+// indexes of multiple collections are built concurrently.
+func TestEnsureDBSchemaConcurrent(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Drop the database to start from scratch and build the schema with
+	// multiple workers.
+	ctx := context.Background()
+	err = db.staticDB.Drop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ensureDBSchema(ctx, db.staticDB, db.staticLogger, len(schema()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every index of the schema should exist.
+	for collName, models := range schema() {
+		c, err := db.staticDB.Collection(collName).Indexes().List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var indexes []struct {
+			Name string `bson:"name"`
+		}
+		if err = c.All(ctx, &indexes); err != nil {
+			t.Fatal(err)
+		}
+		names := make(map[string]struct{})
+		for _, index := range indexes {
+			names[index.Name] = struct{}{}
+		}
+		for _, model := range models {
+			name := *model.Options.Name
+			if _, exists := names[name]; !exists {
+				t.Fatalf("Index %s of collection %s is missing", name, collName)
+			}
+		}
+	}
+}
+
+// TestPingTimeout ensures that pinging an unreachable database fails within
+// the configured timeout.
+func TestPingTimeout(t *testing.T) {
+	t.Parallel()
+
+	// Connecting doesn't block, so the client can be created without a
+	// database listening on the port.
+	ctx := context.Background()
+	client, err := connect(ctx, "mongodb://localhost:1", testUsername, testPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.Disconnect(ctx)
+	}()
+	timeout := 500 * time.Millisecond
+	db := &DB{
+		staticConfig: Config{PingTimeout: timeout},
+		staticDB:     client.Database(t.Name()),
+		staticCtx:    ctx,
+	}
+
+	start := time.Now()
+	if ph := db.Health(); ph.Database == nil {
+		t.Fatal("Expected unreachable database to be unhealthy")
+	}
+	if elapsed := time.Since(start); elapsed > timeout+time.Second {
+		t.Fatalf("Expected health check to fail within %v, took %v", timeout, elapsed)
+	}
+}
+
+// TestDrop ensures that test databases can be dropped while other databases
+// can't.
+func TestDrop(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Make sure the database exists and then drop it.
+	ctx := context.Background()
+	_, err = db.CreditUser(ctx, "sub", 1, "txn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := db.staticDB.Client()
+	exists := func(name string) bool {
+		t.Helper()
+		names, err := client.ListDatabaseNames(ctx, bson.M{"name": name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(names) > 0
+	}
+	if !exists(t.Name()) {
+		t.Fatal("Expected database to exist")
+	}
+	if err = db.Drop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if exists(t.Name()) {
+		t.Fatal("Expected database to be gone")
+	}
+
+	// Databases which don't follow the naming convention of tests can't be
+	// dropped.
+	prod := &DB{staticDB: client.Database(DBName)}
+	if err = prod.Drop(ctx); err == nil {
+		t.Fatal("Expected dropping a non-test database to be refused")
+	}
+}
+
+// TestDomainScoping ensures that two DBs with different server domains can
+// share a database without seeing each other's data.
+func TestDomainScoping(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	dbA, err := newTestDB("a.example.com", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(dbA); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	dbB, err := newTestDB("b.example.com", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dbB.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Credit the same sub in both domains.
+	ctx := context.Background()
+	sub := "sub"
+	if _, err = dbA.CreditUser(ctx, sub, 10, "txnA", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dbB.CreditUser(ctx, sub, 3, "txnB", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, db := range []*DB{dbA, dbB} {
+		if _, err = db.GetUser(ctx, sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	balanceA, _, err := dbA.UserBalance(ctx, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balanceB, _, err := dbB.UserBalance(ctx, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balanceA != 10 || balanceB != 3 {
+		t.Fatalf("Expected balances 10 and 3, got %v and %v", balanceA, balanceB)
+	}
+
+	// The txns of one domain can't be accessed from the other one.
+	if _, err = dbB.GetTxn(ctx, "txnA"); !errors.Contains(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+	if err = dbB.DeleteTxn(ctx, "txnA"); !errors.Contains(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+	if _, err = dbA.GetTxn(ctx, "txnA"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Txn and hold IDs are only unique within a domain, so both domains can
+	// use the same ones.
+	inserted, err := dbB.CreditUser(ctx, sub, 2, "txnA", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inserted {
+		t.Fatal("Expected the txn to be inserted in the other domain")
+	}
+	txnA, err := dbA.GetTxn(ctx, "txnA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txnB, err := dbB.GetTxn(ctx, "txnA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txnA.Amount != 10 || txnB.Amount != 2 {
+		t.Fatalf("Expected amounts 10 and 2, got %v and %v", txnA.Amount, txnB.Amount)
+	}
+	if _, err = dbB.NewTxn(ctx, "txnA", sub, 2, TxnSourcePayment, nil); !errors.Contains(err, ErrDuplicateTxn) {
+		t.Fatalf("Expected %v, got %v", ErrDuplicateTxn, err)
+	}
+	for _, db := range []*DB{dbA, dbB} {
+		if err = db.HoldCredits(ctx, sub, 1, "hold"); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.ReleaseHold(ctx, "hold"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Neither are its subscriptions.
+	now := time.Now().UTC()
+	_, err = dbA.NewSubscription(ctx, sub, 2, now.Add(-time.Hour), now.Add(time.Hour), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sums, err := dbB.SumByTier(ctx, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != 0 {
+		t.Fatalf("Expected no subscriptions, got %v", sums)
+	}
+	sums, err = dbA.SumByTier(ctx, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sums[2] != 5 {
+		t.Fatalf("Expected tier 2 to sum to 5, got %v", sums)
+	}
+}
+
+// TestTransactionSupport ensures that only deployments which support
+// transactions are accepted and that invalid URIs are rejected with a clear
+// error.
+func TestTransactionSupport(t *testing.T) {
+	tests := []struct {
+		name      string
+		hello     helloResult
+		supported bool
+	}{
+		{"Standalone", helloResult{}, false},
+		{"ReplicaSet", helloResult{SetName: "skynet"}, true},
+		{"Mongos", helloResult{Msg: "isdbgrid"}, true},
+	}
+	for _, tt := range tests {
+		err := tt.hello.transactionSupport()
+		if (err == nil) != tt.supported {
+			t.Fatalf("%s: expected supported to be %v, got %v", tt.name, tt.supported, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "standalone") {
+			t.Fatalf("%s: expected a descriptive error, got %v", tt.name, err)
+		}
+	}
+
+	// Malformed URIs are rejected before connecting.
+	_, err := connect(context.Background(), "mongodb://localhost:27017/?replicaSet=a&connect=direct&directConnection=maybe", "", "", nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid database URI") {
+		t.Fatalf("Expected an invalid URI error, got %v", err)
+	}
+}
+
+// TestStandaloneRejected makes sure that New refuses to start against a
+// standalone server.
+func TestStandaloneRejected(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	_, err := New(context.Background(), logrus.NewEntry(logger), testStandaloneURI, testUsername, testPassword, t.Name(), t.Name(), Config{})
+	if err == nil || !strings.Contains(err.Error(), "standalone") {
+		t.Fatalf("Expected a standalone error, got %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package database
+
+import "gitlab.com/NebulousLabs/errors"
+
+// These are the errors returned by the database which callers are expected to
+// handle. They are never wrapped, so they can be matched with both
+// errors.Contains and the standard library's errors.Is.
+var (
+	// ErrNotFound is returned when a requested document doesn't exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrDuplicateTxn is returned when a txn with the same ID exists
+	// already.
+	ErrDuplicateTxn = errors.New("duplicate txn")
+
+	// ErrInsufficientBalance is returned when a user's balance doesn't cover
+	// the amount they are charged.
+	ErrInsufficientBalance = errors.New("insufficient balance")
+
+	// ErrHoldNotActive is returned when a hold can't be captured or released
+	// because it was already released, captured or has expired.
+	ErrHoldNotActive = errors.New("hold is not active")
+
+	// ErrHoldMismatch is returned when a hold ID is reused for a hold of
+	// another sub or amount.
+	ErrHoldMismatch = errors.New("hold ID is taken by a different hold")
+
+	// ErrInvalidPeriod is returned when a subscription period doesn't start
+	// before it ends.
+	ErrInvalidPeriod = errors.New("subscription period must start before it ends")
+
+	// ErrTxnNotReassignable is returned when a txn which isn't a payment is
+	// reassigned to another sub.
+	ErrTxnNotReassignable = errors.New("only payments can be reassigned")
+
+	// ErrInvalidPrice is returned when a price is negative, NaN or
+	// infinite.
+	ErrInvalidPrice = errors.New("price must be a finite, non-negative number")
+
+	// ErrSubscriptionEnded is returned when a subscription can't be changed
+	// anymore because its period has ended.
+	ErrSubscriptionEnded = errors.New("subscription has ended")
+
+	// ErrSubscriptionStarted is returned when the price of a subscription
+	// can't be changed because its period has started and
+	// Config.FuturePriceUpdatesOnly is set.
+	ErrSubscriptionStarted = errors.New("subscription has started")
+)
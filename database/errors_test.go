@@ -0,0 +1,74 @@
+package database
+
+import (
+	"context"
+	stderrors "errors"
+	"testing"
+)
+
+// TestSentinelErrors ensures that the database returns its sentinel errors
+// and that they can be matched with errors.Is.
+func TestSentinelErrors(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+
+	// Lookups of missing documents.
+	_, err = db.GetTxn(ctx, "missing")
+	if !stderrors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+	_, err = db.GetUser(ctx, "missing")
+	if !stderrors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+	err = db.DeleteTxn(ctx, "missing")
+	if !stderrors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	// Lookups of existing documents.
+	_, err = db.CreditUser(ctx, "sub", 5, "txn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn, err := db.GetTxn(ctx, "txn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txn.Sub != "sub" || txn.Amount != 5 {
+		t.Fatalf("Unexpected txn %+v", txn)
+	}
+	u, err := db.GetUser(ctx, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Sub != "sub" {
+		t.Fatalf("Unexpected user %+v", u)
+	}
+
+	// Duplicate txn.
+	_, err = db.NewTxn(ctx, "txn", "sub", 5, TxnSourcePayment, nil)
+	if !stderrors.Is(err, ErrDuplicateTxn) {
+		t.Fatalf("Expected %v, got %v", ErrDuplicateTxn, err)
+	}
+
+	// Insufficient balance.
+	_, err = newTestCharge(ctx, db, "sub", 10)
+	if !stderrors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("Expected %v, got %v", ErrInsufficientBalance, err)
+	}
+}
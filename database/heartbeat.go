@@ -0,0 +1,107 @@
+package database
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWorkerStallMultiple is the default number of intervals a
+	// background worker may miss its heartbeat before it's considered
+	// stalled.
+	DefaultWorkerStallMultiple = 3
+
+	// workerAnomalyDetector is the name of the anomaly detector's worker.
+	workerAnomalyDetector = "anomalyDetector"
+)
+
+// expvarBackgroundWorkers is the number of background workers which are
+// currently running.
+var expvarBackgroundWorkers = expvar.NewInt("promoter_background_workers")
+
+type (
+	// WorkerStatus describes the health of a background worker.
+	WorkerStatus struct {
+		Name          string
+		Interval      time.Duration
+		LastHeartbeat time.Time
+		Healthy       bool
+		Error         error
+	}
+
+	// workerHeartbeats tracks the last heartbeats of the background workers.
+	workerHeartbeats struct {
+		workers map[string]*workerHeartbeat
+		mu      sync.Mutex
+	}
+
+	// workerHeartbeat is the last heartbeat of a single worker.
+	workerHeartbeat struct {
+		interval time.Duration
+		last     time.Time
+	}
+)
+
+// newWorkerHeartbeats creates an empty heartbeat tracker.
+func newWorkerHeartbeats() *workerHeartbeats {
+	return &workerHeartbeats{
+		workers: make(map[string]*workerHeartbeat),
+	}
+}
+
+// register starts tracking a worker which is expected to send a heartbeat at
+// the given interval. Registering counts as the worker's first heartbeat.
+func (wh *workerHeartbeats) register(name string, interval time.Duration, now time.Time) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	wh.workers[name] = &workerHeartbeat{
+		interval: interval,
+		last:     now,
+	}
+}
+
+// beat records a heartbeat of the worker with the given name.
+func (wh *workerHeartbeats) beat(name string, now time.Time) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	w, ok := wh.workers[name]
+	if !ok {
+		return
+	}
+	w.last = now
+}
+
+// status returns the status of all registered workers sorted by name. A worker
+// is unhealthy if its last heartbeat is older than 'multiple' times its
+// interval.
+func (wh *workerHeartbeats) status(now time.Time, multiple int) []WorkerStatus {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	statuses := make([]WorkerStatus, 0, len(wh.workers))
+	for name, w := range wh.workers {
+		ws := WorkerStatus{
+			Name:          name,
+			Interval:      w.interval,
+			LastHeartbeat: w.last,
+			Healthy:       true,
+		}
+		threshold := time.Duration(multiple) * w.interval
+		if since := now.Sub(w.last); since > threshold {
+			ws.Healthy = false
+			ws.Error = fmt.Errorf("no heartbeat for %v, expected one every %v", since.Round(time.Second), w.interval)
+		}
+		statuses = append(statuses, ws)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// WorkerHealth returns the status of all running background workers.
+func (db *DB) WorkerHealth() []WorkerStatus {
+	return db.staticWorkers.status(time.Now(), db.staticConfig.WorkerStallMultiple)
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// TestWorkerHeartbeats ensures that workers which stopped sending heartbeats
+// for longer than the allowed multiple of their interval are reported as
+// unhealthy while running ones are healthy.
+func TestWorkerHeartbeats(t *testing.T) {
+	now := time.Now()
+	wh := newWorkerHeartbeats()
+	if statuses := wh.status(now, DefaultWorkerStallMultiple); len(statuses) != 0 {
+		t.Fatalf("Expected no workers, got %v", statuses)
+	}
+
+	// Register two workers. Both are healthy right away.
+	wh.register("running", time.Minute, now)
+	wh.register("stalled", time.Minute, now)
+	for _, ws := range wh.status(now, DefaultWorkerStallMultiple) {
+		if !ws.Healthy || ws.Error != nil {
+			t.Fatalf("Expected worker %s to be healthy, got %+v", ws.Name, ws)
+		}
+	}
+
+	// Only one of them keeps beating while time passes beyond the threshold.
+	for i := 1; i <= 2*DefaultWorkerStallMultiple; i++ {
+		wh.beat("running", now.Add(time.Duration(i)*time.Minute))
+	}
+	later := now.Add(2 * DefaultWorkerStallMultiple * time.Minute)
+	statuses := wh.status(later, DefaultWorkerStallMultiple)
+	if len(statuses) != 2 {
+		t.Fatalf("Expected 2 workers, got %v", statuses)
+	}
+	running, stalled := statuses[0], statuses[1]
+	if running.Name != "running" || !running.Healthy || running.Error != nil {
+		t.Fatalf("Expected running worker to be healthy, got %+v", running)
+	}
+	if !running.LastHeartbeat.Equal(later) {
+		t.Fatalf("Expected last heartbeat %v, got %v", later, running.LastHeartbeat)
+	}
+	if stalled.Name != "stalled" || stalled.Healthy || stalled.Error == nil {
+		t.Fatalf("Expected stalled worker to be unhealthy, got %+v", stalled)
+	}
+
+	// Exactly at the threshold the worker is still healthy.
+	threshold := now.Add(DefaultWorkerStallMultiple * time.Minute)
+	for _, ws := range wh.status(threshold, DefaultWorkerStallMultiple) {
+		if !ws.Healthy {
+			t.Fatalf("Expected worker %s to be healthy at the threshold, got %+v", ws.Name, ws)
+		}
+	}
+
+	// Heartbeats of unknown workers are ignored.
+	wh.beat("unknown", later)
+	if statuses = wh.status(later, DefaultWorkerStallMultiple); len(statuses) != 2 {
+		t.Fatalf("Expected 2 workers, got %v", statuses)
+	}
+}
@@ -0,0 +1,192 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// HoldStatusActive is the status of a hold which still reserves credits
+	// unless it has expired.
+	HoldStatusActive = "active"
+
+	// HoldStatusCaptured is the status of a hold whose credits were spent.
+	HoldStatusCaptured = "captured"
+
+	// HoldStatusReleased is the status of a hold whose credits were returned
+	// to the available balance.
+	HoldStatusReleased = "released"
+)
+
+type (
+	// Hold reserves credits of a user's balance until it is either captured,
+	// released or expires. Captured holds turn into a debit txn. Hold IDs
+	// are unique within a domain.
+	Hold struct {
+		ID        string    `bson:"holdID"`
+		Domain    string    `bson:"domain"`
+		Sub       string    `bson:"sub"`
+		Amount    float64   `bson:"amount"`
+		Status    string    `bson:"status"`
+		CreatedAt time.Time `bson:"createdAt"`
+		ExpiresAt time.Time `bson:"expiresAt"`
+	}
+)
+
+// HoldCredits reserves the given amount of the user's available balance
+// until the hold is captured, released or expires. Holding the same credits
+// with the same hold ID again is a no-op, reusing the hold ID for another sub
+// or amount fails with ErrHoldMismatch. If the user's available balance
+// doesn't cover the amount, the configured NegativeBalancePolicy applies.
+// This method assumes that it's called from within a DB transaction, so when
+// it fails with an error all changes in the DB are automatically rolled back.
+func (db *DB) HoldCredits(ctx context.Context, sub string, amount float64, holdID string) error {
+	if amount <= 0 {
+		return errors.New("hold amount must be positive")
+	}
+	hold, err := db.GetHold(ctx, holdID)
+	if err == nil {
+		if hold.Sub != sub || hold.Amount != amount {
+			return ErrHoldMismatch
+		}
+		return nil
+	}
+	if !errors.Contains(err, ErrNotFound) {
+		return errors.AddContext(err, "failed to look up hold")
+	}
+	err = db.touchUser(ctx, sub)
+	if err != nil {
+		return errors.AddContext(err, "failed to update user")
+	}
+	_, available, err := db.UserBalance(ctx, sub)
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch balance")
+	}
+	if err = db.checkSpend(sub, available, amount); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	_, err = db.staticDB.Collection(collHolds).InsertOne(ctx, Hold{
+		ID:        holdID,
+		Domain:    db.staticServerDomain,
+		Sub:       sub,
+		Amount:    amount,
+		Status:    HoldStatusActive,
+		CreatedAt: now,
+		ExpiresAt: now.Add(db.staticConfig.HoldTTL),
+	})
+	if err != nil {
+		return errors.AddContext(err, "failed to create hold")
+	}
+	return nil
+}
+
+// CaptureHold spends the credits reserved by the hold by registering a debit
+// txn for them. Capturing a captured hold again is a no-op. If the hold was
+// released or has expired, ErrHoldNotActive is returned.
+// This method assumes that it's called from within a DB transaction, so when
+// it fails with an error all changes in the DB are automatically rolled back.
+func (db *DB) CaptureHold(ctx context.Context, holdID string) error {
+	hold, err := db.finishHold(ctx, holdID, HoldStatusCaptured)
+	if err != nil || hold == nil {
+		return err
+	}
+	_, err = db.NewTxn(ctx, holdTxnID(holdID), hold.Sub, -hold.Amount, TxnSourceHold, nil)
+	if err != nil {
+		return errors.AddContext(err, "failed to register capture")
+	}
+	return nil
+}
+
+// ReleaseHold returns the credits reserved by the hold to the user's
+// available balance. Releasing a released hold again is a no-op. If the hold
+// was captured or has expired, ErrHoldNotActive is returned.
+func (db *DB) ReleaseHold(ctx context.Context, holdID string) error {
+	_, err := db.finishHold(ctx, holdID, HoldStatusReleased)
+	return err
+}
+
+// GetHold returns the hold with the given ID. If the hold doesn't exist,
+// ErrNotFound is returned.
+func (db *DB) GetHold(ctx context.Context, id string) (*Hold, error) {
+	var hold Hold
+	err := db.staticDB.Collection(collHolds).FindOne(ctx, db.scoped(bson.D{{"holdID", id}})).Decode(&hold)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &hold, nil
+}
+
+// finishHold moves an active, unexpired hold to the given status and returns
+// it. If the hold has that status already, nil is returned to indicate that
+// there is nothing left to do.
+func (db *DB) finishHold(ctx context.Context, holdID, status string) (*Hold, error) {
+	hold, err := db.GetHold(ctx, holdID)
+	if err != nil {
+		return nil, err
+	}
+	if hold.Status == status {
+		return nil, nil
+	}
+	if hold.Status != HoldStatusActive || !hold.ExpiresAt.After(time.Now()) {
+		return nil, ErrHoldNotActive
+	}
+	filter := db.scoped(bson.D{
+		{"holdID", holdID},
+		{"status", HoldStatusActive},
+	})
+	res, err := db.staticDB.Collection(collHolds).UpdateOne(ctx, filter, bson.M{
+		"$set": bson.M{"status": status},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.ModifiedCount == 0 {
+		// The hold was finished concurrently.
+		return nil, ErrHoldNotActive
+	}
+	return hold, nil
+}
+
+// heldCredits returns the credits of the given sub which are reserved by
+// active holds.
+func (db *DB) heldCredits(ctx context.Context, sub string) (float64, error) {
+	match := bson.D{{"$match", db.scoped(bson.D{
+		{"sub", sub},
+		{"status", HoldStatusActive},
+		{"expiresAt", bson.D{{"$gt", time.Now().UTC()}}},
+	})}}
+	group := bson.D{{
+		"$group", bson.D{
+			{"_id", "$sub"},
+			{"held", bson.D{{"$sum", "$amount"}}},
+		},
+	}}
+	c, err := db.staticDB.Collection(collHolds).Aggregate(ctx, mongo.Pipeline{match, group})
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to calculate held credits")
+	}
+	defer func() { _ = c.Close(ctx) }()
+	var held struct {
+		Held float64 `bson:"held"`
+	}
+	if c.Next(ctx) {
+		if err = c.Decode(&held); err != nil {
+			return 0, err
+		}
+	}
+	return held.Held, c.Err()
+}
+
+// holdTxnID returns the ID of the txn which records the capture of the hold
+// with the given ID.
+func holdTxnID(holdID string) string {
+	return holdTxnIDPrefix + holdID
+}
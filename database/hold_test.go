@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestHolds tests capturing, releasing and expiring holds.
+func TestHolds(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	holdTTL := 2 * time.Second
+	db, err := newCustomTestDB(t.Name(), t.Name(), Config{HoldTTL: holdTTL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+	sub := "sub"
+	_, err = db.CreditUser(ctx, sub, 10, "txn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// checkBalance checks the total and available balance of the sub.
+	checkBalance := func(expectedTotal, expectedAvailable float64) {
+		t.Helper()
+		total, available, err := db.UserBalance(ctx, sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != expectedTotal || available != expectedAvailable {
+			t.Fatalf("Expected total %v and available %v, got %v and %v", expectedTotal, expectedAvailable, total, available)
+		}
+	}
+
+	// Hold then capture.
+	err = db.HoldCredits(ctx, sub, 4, "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(10, 6)
+	err = db.CaptureHold(ctx, "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(6, 6)
+	// Capturing again is a no-op while releasing fails.
+	err = db.CaptureHold(ctx, "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(6, 6)
+	err = db.ReleaseHold(ctx, "capture")
+	if !errors.Contains(err, ErrHoldNotActive) {
+		t.Fatalf("Expected %v, got %v", ErrHoldNotActive, err)
+	}
+
+	// Hold then release.
+	err = db.HoldCredits(ctx, sub, 5, "release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(6, 1)
+	// The held credits can't be spent elsewhere.
+	err = db.HoldCredits(ctx, sub, 2, "toomuch")
+	if !errors.Contains(err, ErrInsufficientBalance) {
+		t.Fatalf("Expected %v, got %v", ErrInsufficientBalance, err)
+	}
+	err = db.ReleaseHold(ctx, "release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(6, 6)
+	err = db.CaptureHold(ctx, "release")
+	if !errors.Contains(err, ErrHoldNotActive) {
+		t.Fatalf("Expected %v, got %v", ErrHoldNotActive, err)
+	}
+
+	// Hold then expire.
+	err = db.HoldCredits(ctx, sub, 6, "expire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(6, 0)
+	time.Sleep(holdTTL)
+	checkBalance(6, 6)
+	err = db.CaptureHold(ctx, "expire")
+	if !errors.Contains(err, ErrHoldNotActive) {
+		t.Fatalf("Expected %v, got %v", ErrHoldNotActive, err)
+	}
+
+	// Unknown holds.
+	err = db.CaptureHold(ctx, "unknown")
+	if !errors.Contains(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	// Holding the same credits again is a no-op while reusing the ID of a
+	// hold for other credits fails, even once the hold is finished.
+	err = db.HoldCredits(ctx, sub, 4, "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.HoldCredits(ctx, sub, 5, "capture")
+	if !errors.Contains(err, ErrHoldMismatch) {
+		t.Fatalf("Expected %v, got %v", ErrHoldMismatch, err)
+	}
+	err = db.HoldCredits(ctx, "othersub", 4, "capture")
+	if !errors.Contains(err, ErrHoldMismatch) {
+		t.Fatalf("Expected %v, got %v", ErrHoldMismatch, err)
+	}
+	checkBalance(6, 6)
+}
@@ -0,0 +1,210 @@
+package database
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type (
+	// migration prepares existing data for the current schema. Migrations
+	// run on every startup before the schema is ensured, so they need to be
+	// idempotent. LegacyDomain is the configured Config.LegacyDomain.
+	migration struct {
+		name string
+		run  func(ctx context.Context, db *mongo.Database, legacyDomain string, log *logrus.Entry) error
+	}
+)
+
+// migrations returns all migrations in the order in which they need to be
+// applied.
+func migrations() []migration {
+	return []migration{
+		{
+			name: "tagDomain",
+			run:  tagDomain,
+		},
+		{
+			name: "dedupUsers",
+			run:  dedupUsers,
+		},
+		{
+			name: "copyIDs",
+			run:  copyIDs,
+		},
+		{
+			name: "dropHoldTTL",
+			run:  dropHoldTTL,
+		},
+	}
+}
+
+// runMigrations applies all migrations to the database.
+func runMigrations(ctx context.Context, db *mongo.Database, legacyDomain string, log *logrus.Entry) error {
+	for _, m := range migrations() {
+		if err := m.run(ctx, db, legacyDomain, log); err != nil {
+			return errors.AddContext(err, "migration "+m.name+" failed")
+		}
+	}
+	return nil
+}
+
+// tagDomain assigns all documents which were created before data was scoped
+// to server domains to the legacy domain. Since servers of several domains
+// might share the database, there is no way of telling which domain the
+// documents belong to, so the operator needs to configure it. Without a legacy
+// domain, the documents are left alone and only reported. It also drops the
+// unique indexes on the sub which prevented the same sub from existing in
+// multiple domains. They are replaced by unique indexes on the domain and the
+// sub when the schema is ensured.
+func tagDomain(ctx context.Context, db *mongo.Database, legacyDomain string, log *logrus.Entry) error {
+	untagged := bson.M{"domain": bson.M{"$exists": false}}
+	for _, collName := range []string{collAlerts, collHolds, collSubscriptions, collTnxs, collUsers} {
+		coll := db.Collection(collName)
+		if legacyDomain == "" {
+			n, err := coll.CountDocuments(ctx, untagged)
+			if err != nil {
+				return errors.AddContext(err, "failed to count untagged documents of "+collName)
+			}
+			if n > 0 {
+				log.Warnf("Found %d documents of %s without a domain, configure a legacy domain to assign them", n, collName)
+			}
+			continue
+		}
+		res, err := coll.UpdateMany(ctx, untagged, bson.M{
+			"$set": bson.M{"domain": legacyDomain},
+		})
+		if err != nil {
+			return errors.AddContext(err, "failed to tag "+collName)
+		}
+		if res.ModifiedCount > 0 {
+			log.Infof("Assigned %d documents of %s to domain %s", res.ModifiedCount, collName, legacyDomain)
+		}
+	}
+	for _, collName := range []string{collAlerts, collUsers} {
+		err := dropIndexIfExists(ctx, db.Collection(collName), "sub_unique")
+		if err != nil {
+			return errors.AddContext(err, "failed to drop index of "+collName)
+		}
+	}
+	return nil
+}
+
+// dropIndexIfExists drops the index with the given name unless the collection
+// or the index don't exist.
+func dropIndexIfExists(ctx context.Context, coll *mongo.Collection, name string) error {
+	exists, err := indexExists(ctx, coll, name)
+	if err != nil || !exists {
+		return err
+	}
+	_, err = coll.Indexes().DropOne(ctx, name)
+	return err
+}
+
+// indexExists returns true if the collection has an index with the given
+// name.
+func indexExists(ctx context.Context, coll *mongo.Collection, name string) (bool, error) {
+	c, err := coll.Indexes().List(ctx)
+	if err != nil {
+		return false, err
+	}
+	var indexes []struct {
+		Name string `bson:"name"`
+	}
+	if err = c.All(ctx, &indexes); err != nil {
+		return false, err
+	}
+	for _, index := range indexes {
+		if index.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// dedupUsers removes duplicate user documents with the same sub within a
+// domain. Before the users collection had a unique index on the sub, every
+// payment created a new user document. Those duplicates need to be removed
+// before the index can be created. Duplicates share their domain and sub and
+// the only other field, lastCharge, merely makes concurrent spending run into
+// a WriteConflict, so it doesn't matter which one is kept. Once the index
+// exists there can't be any duplicates, so the migration is skipped.
+func dedupUsers(ctx context.Context, db *mongo.Database, _ string, log *logrus.Entry) error {
+	coll := db.Collection(collUsers)
+	exists, err := indexExists(ctx, coll, "domain_sub_unique")
+	if err != nil {
+		return errors.AddContext(err, "failed to check index of "+collUsers)
+	}
+	if exists {
+		return nil
+	}
+	group := bson.D{{
+		"$group", bson.D{
+			{"_id", bson.D{{"domain", "$domain"}, {"sub", "$sub"}}},
+			{"ids", bson.D{{"$push", "$_id"}}},
+			{"count", bson.D{{"$sum", 1}}},
+		},
+	}}
+	match := bson.D{{"$match", bson.D{{"count", bson.D{{"$gt", 1}}}}}}
+	c, err := coll.Aggregate(ctx, mongo.Pipeline{group, match})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close(ctx) }()
+	var removed int64
+	for c.Next(ctx) {
+		var dup struct {
+			IDs []interface{} `bson:"ids"`
+		}
+		if err = c.Decode(&dup); err != nil {
+			return err
+		}
+		res, err := coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": dup.IDs[1:]}})
+		if err != nil {
+			return err
+		}
+		removed += res.DeletedCount
+	}
+	if err = c.Err(); err != nil {
+		return err
+	}
+	if removed > 0 {
+		log.Infof("Removed %d duplicate users", removed)
+	}
+	return nil
+}
+
+// copyIDs copies the IDs of txns and holds, which used to be stored as their
+// _id, to their txnID and holdID fields. The _id is unique across all domains,
+// which prevented different domains from using the same IDs. Instead, the IDs
+// are unique within a domain by the domain_txnID_unique and
+// domain_holdID_unique indexes. Copied documents keep their old _id, new ones
+// get a generated one.
+func copyIDs(ctx context.Context, db *mongo.Database, _ string, log *logrus.Entry) error {
+	for collName, field := range map[string]string{collTnxs: "txnID", collHolds: "holdID"} {
+		update := mongo.Pipeline{{{"$set", bson.D{{field, "$_id"}}}}}
+		res, err := db.Collection(collName).UpdateMany(ctx, bson.M{field: bson.M{"$exists": false}}, update)
+		if err != nil {
+			return errors.AddContext(err, "failed to copy ids of "+collName)
+		}
+		if res.ModifiedCount > 0 {
+			log.Infof("Copied the ids of %d documents of %s to %s", res.ModifiedCount, collName, field)
+		}
+	}
+	return nil
+}
+
+// dropHoldTTL drops the TTL index which removed all holds a day after they
+// expired, including captured and released ones. Without them, reusing the
+// ID of a finished hold created a new hold. It's replaced by a TTL index which
+// only removes active holds when the schema is ensured.
+func dropHoldTTL(ctx context.Context, db *mongo.Database, _ string, _ *logrus.Entry) error {
+	err := dropIndexIfExists(ctx, db.Collection(collHolds), "expiresAt")
+	if err != nil {
+		return errors.AddContext(err, "failed to drop index of "+collHolds)
+	}
+	return nil
+}
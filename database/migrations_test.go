@@ -0,0 +1,307 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestDedupUsers ensures that duplicate users are removed before the unique
+// index on the users' sub is created.
+func TestDedupUsers(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Recreate the state from before the unique index existed.
+	ctx := context.Background()
+	coll := db.staticDB.Collection(collUsers)
+	_, err = coll.Indexes().DropOne(ctx, "domain_sub_unique")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := indexExists(ctx, coll, "domain_sub_unique")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("Expected index to be dropped")
+	}
+	_, err = coll.InsertMany(ctx, []interface{}{
+		User{Domain: db.staticServerDomain, Sub: "sub"},
+		User{Domain: db.staticServerDomain, Sub: "sub"},
+		User{Domain: db.staticServerDomain, Sub: "sub"},
+		User{Domain: db.staticServerDomain, Sub: "othersub"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Apply the migrations and the schema again.
+	err = runMigrations(ctx, db.staticDB, "", db.staticLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ensureDBSchema(ctx, db.staticDB, db.staticLogger, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err = indexExists(ctx, coll, "domain_sub_unique")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("Expected index to exist")
+	}
+	for _, sub := range []string{"sub", "othersub"} {
+		n, err := coll.CountDocuments(ctx, bson.M{"sub": sub})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("Expected 1 user for sub %s, got %v", sub, n)
+		}
+	}
+
+	// Creating a duplicate user is no longer possible.
+	_, err = db.NewUser(ctx, "sub")
+	if err == nil {
+		t.Fatal("Expected duplicate user to be rejected")
+	}
+}
+
+// TestTagDomain ensures that documents from before data was scoped to domains
+// are only assigned to a domain if a legacy domain is configured.
+func TestTagDomain(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Recreate the state from before documents had a domain.
+	ctx := context.Background()
+	users := db.staticDB.Collection(collUsers)
+	_, err = users.Indexes().DropOne(ctx, "domain_sub_unique")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = users.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"sub", 1}},
+		Options: options.Index().SetName("sub_unique").SetUnique(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = users.InsertOne(ctx, bson.M{"sub": "sub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.staticDB.Collection(collTnxs).InsertOne(ctx, bson.M{
+		"_id":       "txn",
+		"sub":       "sub",
+		"amount":    5,
+		"source":    TxnSourcePayment,
+		"createdAt": time.Now().UTC(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The legacy documents aren't visible before the migration.
+	if _, err = db.GetUser(ctx, "sub"); !errors.Contains(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	// Without a legacy domain, the documents aren't assigned to any domain.
+	err = runMigrations(ctx, db.staticDB, "", db.staticLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.GetUser(ctx, "sub"); !errors.Contains(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	// Apply the migrations with a legacy domain and the schema again.
+	err = runMigrations(ctx, db.staticDB, db.staticServerDomain, db.staticLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ensureDBSchema(ctx, db.staticDB, db.staticLogger, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.GetUser(ctx, "sub"); err != nil {
+		t.Fatal(err)
+	}
+	balance, _, err := db.UserBalance(ctx, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 5 {
+		t.Fatalf("Expected balance 5, got %v", balance)
+	}
+
+	// The legacy index is gone, so the same sub can exist in another
+	// domain.
+	_, err = users.InsertOne(ctx, User{Domain: "other.example.com", Sub: "sub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCopyIDs ensures that txns and holds which used their ID as their _id
+// can still be found by their ID after the migrations.
+func TestCopyIDs(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Recreate the state from before the IDs were scoped to domains.
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for collName, index := range map[string]string{collTnxs: "domain_txnID_unique", collHolds: "domain_holdID_unique"} {
+		_, err = db.staticDB.Collection(collName).Indexes().DropOne(ctx, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.staticDB.Collection(collTnxs).InsertOne(ctx, bson.M{
+		"_id":       "txn",
+		"domain":    db.staticServerDomain,
+		"sub":       "sub",
+		"amount":    5,
+		"source":    TxnSourcePayment,
+		"createdAt": now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.staticDB.Collection(collHolds).InsertOne(ctx, bson.M{
+		"_id":       "hold",
+		"domain":    db.staticServerDomain,
+		"sub":       "sub",
+		"amount":    1,
+		"status":    HoldStatusActive,
+		"createdAt": now,
+		"expiresAt": now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Apply the migrations and the schema again.
+	err = runMigrations(ctx, db.staticDB, "", db.staticLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ensureDBSchema(ctx, db.staticDB, db.staticLogger, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn, err := db.GetTxn(ctx, "txn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txn.ID != "txn" || txn.Amount != 5 {
+		t.Fatalf("Unexpected txn %+v", txn)
+	}
+	hold, err := db.GetHold(ctx, "hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hold.ID != "hold" || hold.Status != HoldStatusActive {
+		t.Fatalf("Unexpected hold %+v", hold)
+	}
+
+	// The migrated IDs are still taken.
+	_, err = db.NewTxn(ctx, "txn", "sub", 5, TxnSourcePayment, nil)
+	if !errors.Contains(err, ErrDuplicateTxn) {
+		t.Fatalf("Expected %v, got %v", ErrDuplicateTxn, err)
+	}
+}
+
+// TestDropHoldTTL ensures that the TTL index which removed finished holds is
+// replaced by one which only removes active holds.
+func TestDropHoldTTL(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Recreate the old TTL index.
+	ctx := context.Background()
+	coll := db.staticDB.Collection(collHolds)
+	_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"expiresAt", 1}},
+		Options: options.Index().SetName("expiresAt").SetExpireAfterSeconds(int32((24 * time.Hour).Seconds())),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Apply the migrations and the schema again.
+	err = runMigrations(ctx, db.staticDB, "", db.staticLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ensureDBSchema(ctx, db.staticDB, db.staticLogger, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{"expiresAt": false, "expiresAt_active": true} {
+		exists, err := indexExists(ctx, coll, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != expected {
+			t.Fatalf("Expected index %s to exist: %v, got %v", name, expected, exists)
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package database
 
 import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -14,6 +19,33 @@ import (
 // databases and are iterating over the schema at the same time.
 func schema() map[string][]mongo.IndexModel {
 	return map[string][]mongo.IndexModel{
+		collAlerts: {
+			{
+				Keys:    bson.D{{"domain", 1}, {"sub", 1}},
+				Options: options.Index().SetName("domain_sub_unique").SetUnique(true),
+			},
+		},
+		collHolds: {
+			{
+				Keys:    bson.D{{"domain", 1}, {"holdID", 1}},
+				Options: options.Index().SetName("domain_holdID_unique").SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{"sub", 1}},
+				Options: options.Index().SetName("sub"),
+			},
+			{
+				// Holds which expired without being captured or released
+				// are removed after a day. Until then they still make
+				// capturing and releasing them idempotent. Finished holds
+				// are kept, so their IDs can't be reused.
+				Keys: bson.D{{"expiresAt", 1}},
+				Options: options.Index().
+					SetName("expiresAt_active").
+					SetExpireAfterSeconds(int32((24 * time.Hour).Seconds())).
+					SetPartialFilterExpression(bson.M{"status": HoldStatusActive}),
+			},
+		},
 		collSubscriptions: {
 			{
 				Keys:    bson.D{{"sub", 1}},
@@ -27,12 +59,145 @@ func schema() map[string][]mongo.IndexModel {
 				Keys:    bson.D{{"to", 1}},
 				Options: options.Index().SetName("to"),
 			},
+			{
+				Keys:    bson.D{{"sub", 1}, {"to", 1}},
+				Options: options.Index().SetName("sub_to"),
+			},
+		},
+		collUsers: {
+			{
+				Keys:    bson.D{{"domain", 1}, {"sub", 1}},
+				Options: options.Index().SetName("domain_sub_unique").SetUnique(true),
+			},
 		},
 		collTnxs: {
+			{
+				Keys:    bson.D{{"domain", 1}, {"txnID", 1}},
+				Options: options.Index().SetName("domain_txnID_unique").SetUnique(true),
+			},
 			{
 				Keys:    bson.D{{"price", 1}},
 				Options: options.Index().SetName("price"),
 			},
+			{
+				Keys:    bson.D{{"createdAt", 1}},
+				Options: options.Index().SetName("createdAt"),
+			},
+			{
+				Keys:    bson.D{{"sub", 1}, {"createdAt", -1}},
+				Options: options.Index().SetName("sub_createdAt"),
+			},
 		},
 	}
 }
+
+type (
+	// SchemaIndex describes an index of the schema in a serializable form.
+	SchemaIndex struct {
+		Name               string           `json:"name"`
+		Keys               []SchemaIndexKey `json:"keys"`
+		Unique             bool             `json:"unique,omitempty"`
+		ExpireAfterSeconds *int32           `json:"expireAfterSeconds,omitempty"`
+		PartialFilter      interface{}      `json:"partialFilter,omitempty"`
+	}
+
+	// SchemaIndexKey is a single key of an index, in order.
+	SchemaIndexKey struct {
+		Field string      `json:"field"`
+		Order interface{} `json:"order"`
+	}
+)
+
+// SchemaJSON returns the collections of the schema and their indexes as a
+// JSON document which maps every collection name to its indexes.
+func SchemaJSON() ([]byte, error) {
+	s := make(map[string][]SchemaIndex)
+	for collName, models := range schema() {
+		indexes := make([]SchemaIndex, 0, len(models))
+		for _, model := range models {
+			index := SchemaIndex{
+				Keys: make([]SchemaIndexKey, 0),
+			}
+			for _, key := range model.Keys.(bson.D) {
+				index.Keys = append(index.Keys, SchemaIndexKey{
+					Field: key.Key,
+					Order: key.Value,
+				})
+			}
+			if opts := model.Options; opts != nil {
+				if opts.Name != nil {
+					index.Name = *opts.Name
+				}
+				if opts.Unique != nil {
+					index.Unique = *opts.Unique
+				}
+				index.ExpireAfterSeconds = opts.ExpireAfterSeconds
+				index.PartialFilter = opts.PartialFilterExpression
+			}
+			indexes = append(indexes, index)
+		}
+		s[collName] = indexes
+	}
+	return json.Marshal(s)
+}
+
+// CollectionIndexes compares the indexes of a collection declared in the
+// schema with the indexes which actually exist. All indexes are identified
+// by their names.
+type CollectionIndexes struct {
+	Expected   []string
+	Existing   []string
+	Missing    []string
+	Unexpected []string
+}
+
+// IndexReport returns a comparison of the declared and existing indexes for
+// every collection of the schema. The default index on _id is ignored.
+func (db *DB) IndexReport(ctx context.Context) (map[string]CollectionIndexes, error) {
+	report := make(map[string]CollectionIndexes)
+	for collName, models := range schema() {
+		c, err := db.staticDB.Collection(collName).Indexes().List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var indexes []struct {
+			Name string `bson:"name"`
+		}
+		if err = c.All(ctx, &indexes); err != nil {
+			return nil, err
+		}
+		ci := CollectionIndexes{
+			Expected:   make([]string, 0, len(models)),
+			Existing:   make([]string, 0, len(indexes)),
+			Missing:    make([]string, 0),
+			Unexpected: make([]string, 0),
+		}
+		expected := make(map[string]struct{})
+		for _, model := range models {
+			expected[*model.Options.Name] = struct{}{}
+			ci.Expected = append(ci.Expected, *model.Options.Name)
+		}
+		existing := make(map[string]struct{})
+		for _, index := range indexes {
+			if index.Name == "_id_" {
+				continue
+			}
+			existing[index.Name] = struct{}{}
+			ci.Existing = append(ci.Existing, index.Name)
+			if _, ok := expected[index.Name]; !ok {
+				ci.Unexpected = append(ci.Unexpected, index.Name)
+			}
+		}
+		for _, name := range ci.Expected {
+			if _, ok := existing[name]; !ok {
+				ci.Missing = append(ci.Missing, name)
+			}
+		}
+		sort.Strings(ci.Expected)
+		sort.Strings(ci.Existing)
+		sort.Strings(ci.Missing)
+		sort.Strings(ci.Unexpected)
+		report[collName] = ci
+	}
+	return report, nil
+}
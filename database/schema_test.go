@@ -0,0 +1,58 @@
+package database
+
+import (
+	"encoding/json"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestSchemaJSON ensures that the serialized schema matches the declared
+// index models.
+func TestSchemaJSON(t *testing.T) {
+	b, err := SchemaJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s map[string][]SchemaIndex
+	if err = json.Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	declared := schema()
+	if len(s) != len(declared) {
+		t.Fatalf("Expected %d collections, got %d", len(declared), len(s))
+	}
+	for collName, models := range declared {
+		indexes, ok := s[collName]
+		if !ok {
+			t.Fatalf("Collection %s is missing", collName)
+		}
+		if len(indexes) != len(models) {
+			t.Fatalf("Expected %d indexes for %s, got %d", len(models), collName, len(indexes))
+		}
+		for i, model := range models {
+			index := indexes[i]
+			if index.Name != *model.Options.Name {
+				t.Fatalf("Expected index %s, got %s", *model.Options.Name, index.Name)
+			}
+			unique := model.Options.Unique != nil && *model.Options.Unique
+			if index.Unique != unique {
+				t.Fatalf("Expected unique %v for index %s, got %v", unique, index.Name, index.Unique)
+			}
+			ttl := model.Options.ExpireAfterSeconds
+			if (ttl == nil) != (index.ExpireAfterSeconds == nil) || ttl != nil && *ttl != *index.ExpireAfterSeconds {
+				t.Fatalf("Expected expireAfterSeconds %v for index %s, got %v", ttl, index.Name, index.ExpireAfterSeconds)
+			}
+			keys := model.Keys.(bson.D)
+			if len(index.Keys) != len(keys) {
+				t.Fatalf("Expected %d keys for index %s, got %d", len(keys), index.Name, len(index.Keys))
+			}
+			for j, key := range keys {
+				// JSON numbers are decoded as float64.
+				if index.Keys[j].Field != key.Key || index.Keys[j].Order != float64(key.Value.(int)) {
+					t.Fatalf("Expected key %v for index %s, got %v", key, index.Name, index.Keys[j])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// expvarSlowQueries counts the MongoDB commands which took longer than the
+// slow query threshold.
+var expvarSlowQueries = expvar.NewInt("promoter_db_slow_queries")
+
+// subPaths are the paths at which the commands issued by the DB contain the
+// sub they operate on, if any. The first path that contains a string is used.
+var subPaths = [][]string{
+	{"filter", "sub"},                  // find
+	{"query", "sub"},                   // count, findAndModify
+	{"pipeline", "0", "$match", "sub"}, // aggregate
+	{"updates", "0", "q", "sub"},       // update
+	{"deletes", "0", "q", "sub"},       // delete
+	{"documents", "0", "sub"},          // insert
+}
+
+type (
+	// slowQueryLogger logs MongoDB commands which take longer than a
+	// threshold. It's hooked into the client as a command monitor, so it
+	// covers all operations of the DB.
+	slowQueryLogger struct {
+		logger    *logrus.Entry
+		threshold time.Duration
+
+		// started maps the request IDs of running commands to the
+		// information which is logged if they turn out to be slow.
+		started map[int64]slowQueryInfo
+		mu      sync.Mutex
+	}
+
+	// slowQueryInfo describes a running command.
+	slowQueryInfo struct {
+		collection string
+		sub        string
+	}
+)
+
+// newSlowQueryLogger creates a logger for commands which take longer than the
+// threshold.
+func newSlowQueryLogger(logger *logrus.Entry, threshold time.Duration) *slowQueryLogger {
+	return &slowQueryLogger{
+		logger:    logger,
+		threshold: threshold,
+		started:   make(map[int64]slowQueryInfo),
+	}
+}
+
+// monitor returns the command monitor which feeds the logger.
+func (sl *slowQueryLogger) monitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(_ context.Context, e *event.CommandStartedEvent) {
+			sl.start(e.RequestID, e.Command)
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			sl.finish(e.RequestID, e.CommandName, time.Duration(e.DurationNanos))
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			sl.finish(e.RequestID, e.CommandName, time.Duration(e.DurationNanos))
+		},
+	}
+}
+
+// start remembers a command until it finishes.
+func (sl *slowQueryLogger) start(requestID int64, cmd bson.Raw) {
+	info := slowQueryInfo{
+		sub: commandSub(cmd),
+	}
+	if elem, err := cmd.IndexErr(0); err == nil {
+		info.collection, _ = elem.Value().StringValueOK()
+	}
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.started[requestID] = info
+}
+
+// finish logs a command if it took longer than the threshold.
+func (sl *slowQueryLogger) finish(requestID int64, name string, d time.Duration) {
+	sl.mu.Lock()
+	info := sl.started[requestID]
+	delete(sl.started, requestID)
+	sl.mu.Unlock()
+
+	if d <= sl.threshold {
+		return
+	}
+	expvarSlowQueries.Add(1)
+	l := sl.logger.WithField("operation", name).
+		WithField("duration", d)
+	if info.collection != "" {
+		l = l.WithField("collection", info.collection)
+	}
+	if info.sub != "" {
+		l = l.WithField("sub", hashSub(info.sub))
+	}
+	l.Warnf("Slow query took longer than %v", sl.threshold)
+}
+
+// commandSub returns the sub a command operates on or an empty string if it
+// doesn't operate on a single sub.
+func commandSub(cmd bson.Raw) string {
+	for _, path := range subPaths {
+		if sub, ok := cmd.Lookup(path...).StringValueOK(); ok {
+			return sub
+		}
+	}
+	return ""
+}
+
+// hashSub returns a short hash of the sub, so that slow queries of the same
+// sub can be correlated without writing the sub itself to the logs.
+func hashSub(sub string) string {
+	h := sha256.Sum256([]byte(sub))
+	return hex.EncodeToString(h[:8])
+}
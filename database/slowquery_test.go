@@ -0,0 +1,106 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// TestSlowQueryLogger ensures that commands which take longer than the
+// threshold are logged with their hashed sub and counted while faster ones
+// aren't.
+func TestSlowQueryLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	monitor := newSlowQueryLogger(logrus.NewEntry(logger), 100*time.Millisecond).monitor()
+
+	cmd, err := bson.Marshal(bson.D{
+		{"find", collTnxs},
+		{"filter", bson.D{{"domain", "domain"}, {"sub", "secret-sub"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// run feeds a command with the given duration to the monitor.
+	requestID := int64(0)
+	run := func(d time.Duration, failed bool) {
+		requestID++
+		monitor.Started(context.Background(), &event.CommandStartedEvent{
+			Command:     cmd,
+			CommandName: "find",
+			RequestID:   requestID,
+		})
+		finished := event.CommandFinishedEvent{
+			DurationNanos: d.Nanoseconds(),
+			CommandName:   "find",
+			RequestID:     requestID,
+		}
+		if failed {
+			monitor.Failed(context.Background(), &event.CommandFailedEvent{CommandFinishedEvent: finished})
+		} else {
+			monitor.Succeeded(context.Background(), &event.CommandSucceededEvent{CommandFinishedEvent: finished})
+		}
+	}
+
+	// A command below the threshold isn't logged.
+	slowQueries := expvarSlowQueries.Value()
+	run(50*time.Millisecond, false)
+	if buf.Len() != 0 {
+		t.Fatalf("Expected no log, got %s", buf.String())
+	}
+	if expvarSlowQueries.Value() != slowQueries {
+		t.Fatal("Expected no slow query to be counted")
+	}
+
+	// A command above the threshold is logged.
+	run(200*time.Millisecond, false)
+	log := buf.String()
+	if !strings.Contains(log, "level=warning") || !strings.Contains(log, "operation=find") || !strings.Contains(log, "collection="+collTnxs) {
+		t.Fatalf("Expected a slow query warning, got %s", log)
+	}
+	if strings.Contains(log, "secret-sub") || !strings.Contains(log, "sub="+hashSub("secret-sub")) {
+		t.Fatalf("Expected the hashed sub to be logged, got %s", log)
+	}
+	if expvarSlowQueries.Value() != slowQueries+1 {
+		t.Fatalf("Expected %d slow queries, got %d", slowQueries+1, expvarSlowQueries.Value())
+	}
+
+	// Failed commands are logged as well.
+	buf.Reset()
+	run(time.Second, true)
+	if !strings.Contains(buf.String(), "Slow query") {
+		t.Fatalf("Expected a slow query warning, got %s", buf.String())
+	}
+}
+
+// TestCommandSub is a unit test for commandSub.
+func TestCommandSub(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  bson.D
+		sub  string
+	}{
+		{"Find", bson.D{{"find", "c"}, {"filter", bson.D{{"sub", "a"}}}}, "a"},
+		{"Aggregate", bson.D{{"aggregate", "c"}, {"pipeline", bson.A{bson.D{{"$match", bson.D{{"sub", "b"}}}}}}}, "b"},
+		{"Update", bson.D{{"update", "c"}, {"updates", bson.A{bson.D{{"q", bson.D{{"sub", "c"}}}}}}}, "c"},
+		{"Insert", bson.D{{"insert", "c"}, {"documents", bson.A{bson.D{{"sub", "d"}}}}}, "d"},
+		{"MultipleSubs", bson.D{{"find", "c"}, {"filter", bson.D{{"sub", bson.D{{"$in", bson.A{"a", "b"}}}}}}}, ""},
+		{"NoSub", bson.D{{"find", "c"}, {"filter", bson.D{}}}, ""},
+	}
+	for _, tt := range tests {
+		cmd, err := bson.Marshal(tt.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sub := commandSub(cmd); sub != tt.sub {
+			t.Fatalf("%s: expected sub '%s', got '%s'", tt.name, tt.sub, sub)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package database
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewSubscription creates a new subscription period for the given sub. The
+// period needs to start before it ends, otherwise ErrInvalidPeriod is
+// returned. Invalid prices are rejected with ErrInvalidPrice.
+func (db *DB) NewSubscription(ctx context.Context, sub string, tier int, from, to time.Time, price float64) (*Subscription, error) {
+	if !from.Before(to) {
+		return nil, ErrInvalidPeriod
+	}
+	if !validPrice(price) {
+		return nil, ErrInvalidPrice
+	}
+	s := &Subscription{
+		ID:     primitive.NewObjectID(),
+		Domain: db.staticServerDomain,
+		Sub:    sub,
+		Tier:   tier,
+		From:   from.UTC(),
+		To:     to.UTC(),
+		Price:  price,
+	}
+	_, err := db.staticDB.Collection(collSubscriptions).InsertOne(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetSubscription returns the subscription with the given ID or ErrNotFound
+// if it doesn't exist.
+func (db *DB) GetSubscription(ctx context.Context, id primitive.ObjectID) (*Subscription, error) {
+	var s Subscription
+	err := db.staticDB.Collection(collSubscriptions).FindOne(ctx, db.scoped(bson.D{{"_id", id}})).Decode(&s)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// UpdateSubscriptionPrice sets the price of the subscription with the given
+// ID. The previous price is appended to the subscription's price history.
+// Ended subscriptions can't be changed anymore and ErrSubscriptionEnded is
+// returned for them. If Config.FuturePriceUpdatesOnly is set, the same applies
+// to subscriptions which have started and ErrSubscriptionStarted is returned.
+// Charges which were already made for the subscription are not affected.
+// Invalid prices are rejected with ErrInvalidPrice.
+func (db *DB) UpdateSubscriptionPrice(ctx context.Context, id primitive.ObjectID, newPrice float64) (*Subscription, error) {
+	if !validPrice(newPrice) {
+		return nil, ErrInvalidPrice
+	}
+	now := time.Now().UTC()
+	filter := bson.D{
+		{"_id", id},
+		{"to", bson.D{{"$gt", now}}},
+	}
+	if db.staticConfig.FuturePriceUpdatesOnly {
+		filter = append(filter, bson.E{"from", bson.D{{"$gt", now}}})
+	}
+	// Use an update pipeline to append the previous price to the history in
+	// the same atomic operation that replaces it.
+	update := mongo.Pipeline{{{
+		"$set", bson.D{
+			{"priceHistory", bson.D{{"$concatArrays", bson.A{
+				bson.D{{"$ifNull", bson.A{"$priceHistory", bson.A{}}}},
+				bson.A{bson.D{{"price", "$price"}, {"changedAt", now}}},
+			}}}},
+			{"price", newPrice},
+		},
+	}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var s Subscription
+	err := db.staticDB.Collection(collSubscriptions).FindOneAndUpdate(ctx, db.scoped(filter), update, opts).Decode(&s)
+	if err == nil {
+		return &s, nil
+	}
+	if !errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	// Nothing was updated, find out why.
+	existing, err := db.GetSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !existing.To.After(now) {
+		return nil, ErrSubscriptionEnded
+	}
+	return nil, ErrSubscriptionStarted
+}
+
+// validPrice returns true if the price is a finite, non-negative number.
+func validPrice(price float64) bool {
+	return !math.IsNaN(price) && !math.IsInf(price, 0) && price >= 0
+}
+
+// UserView returns a snapshot of the given user for computing their tier. The
+// balance is the user's available balance and only subscriptions which end
+// after the given time are included.
+func (db *DB) UserView(ctx context.Context, sub string, since time.Time) (UserView, error) {
+	_, available, err := db.UserBalance(ctx, sub)
+	if err != nil {
+		return UserView{}, errors.AddContext(err, "failed to fetch balance")
+	}
+	filter := db.scoped(bson.D{
+		{"sub", sub},
+		{"to", bson.D{{"$gt", since.UTC()}}},
+	})
+	c, err := db.staticDB.Collection(collSubscriptions).Find(ctx, filter)
+	if err != nil {
+		return UserView{}, err
+	}
+	subs := make([]Subscription, 0)
+	err = c.All(ctx, &subs)
+	if err != nil {
+		return UserView{}, err
+	}
+	return UserView{
+		Sub:           sub,
+		Balance:       available,
+		Subscriptions: subs,
+	}, nil
+}
+
+// FindInvalidSubscriptions returns all subscriptions whose period doesn't
+// start before it ends. Such subscriptions can't be created anymore but might
+// have been stored before their periods were validated.
+func (db *DB) FindInvalidSubscriptions(ctx context.Context) ([]Subscription, error) {
+	filter := db.scoped(bson.D{{"$expr", bson.D{{"$gte", bson.A{"$from", "$to"}}}}})
+	c, err := db.staticDB.Collection(collSubscriptions).Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	subs := make([]Subscription, 0)
+	err = c.All(ctx, &subs)
+	if err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// SumByTier returns the total price of all subscriptions which were active at
+// any point within the given window, grouped by tier.
+//
+// Every subscription period counts towards its own tier with its full price.
+// Since a tier change is recorded as a new subscription period, a user who
+// changes their tier within the window contributes both the old and the new
+// period to their respective tiers.
+func (db *DB) SumByTier(ctx context.Context, from, to time.Time) (map[int]float64, error) {
+	match := bson.D{{"$match", db.scoped(bson.D{
+		{"from", bson.D{{"$lt", to.UTC()}}},
+		{"to", bson.D{{"$gt", from.UTC()}}},
+	})}}
+	group := bson.D{{
+		"$group", bson.D{
+			{"_id", "$tier"},
+			{"total", bson.D{{"$sum", "$price"}}},
+		},
+	}}
+	c, err := db.staticDB.Collection(collSubscriptions).Aggregate(ctx, mongo.Pipeline{match, group})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.Close(ctx) }()
+
+	sums := make(map[int]float64)
+	for c.Next(ctx) {
+		var tier struct {
+			Tier  int     `bson:"_id"`
+			Total float64 `bson:"total"`
+		}
+		if err = c.Decode(&tier); err != nil {
+			return nil, err
+		}
+		sums[tier.Tier] = tier.Total
+	}
+	return sums, c.Err()
+}
+
+// SubscribersByTier returns the number of distinct subs with a subscription
+// which is active at the given time, grouped by tier. A sub with multiple
+// active subscriptions of the same tier is only counted once.
+func (db *DB) SubscribersByTier(ctx context.Context, at time.Time) (map[int]int64, error) {
+	match := bson.D{{"$match", db.scoped(bson.D{
+		{"to", bson.D{{"$gt", at.UTC()}}},
+		{"from", bson.D{{"$lte", at.UTC()}}},
+	})}}
+	distinct := bson.D{{
+		"$group", bson.D{
+			{"_id", bson.D{{"tier", "$tier"}, {"sub", "$sub"}}},
+		},
+	}}
+	count := bson.D{{
+		"$group", bson.D{
+			{"_id", "$_id.tier"},
+			{"subscribers", bson.D{{"$sum", 1}}},
+		},
+	}}
+	c, err := db.staticDB.Collection(collSubscriptions).Aggregate(ctx, mongo.Pipeline{match, distinct, count})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.Close(ctx) }()
+
+	counts := make(map[int]int64)
+	for c.Next(ctx) {
+		var tier struct {
+			Tier        int   `bson:"_id"`
+			Subscribers int64 `bson:"subscribers"`
+		}
+		if err = c.Decode(&tier); err != nil {
+			return nil, err
+		}
+		counts[tier.Tier] = tier.Subscribers
+	}
+	return counts, c.Err()
+}
+
+// SubscriptionRevenue returns the revenue of all subscriptions within the
+// given window. Subscriptions which only partially overlap the window are
+// prorated linearly by time, i.e. a subscription contributes its price
+// multiplied by the fraction of its period that lies within the window.
+func (db *DB) SubscriptionRevenue(ctx context.Context, from, to time.Time) (float64, error) {
+	filter := db.scoped(bson.D{
+		{"from", bson.D{{"$lt", to.UTC()}}},
+		{"to", bson.D{{"$gt", from.UTC()}}},
+	})
+	c, err := db.staticDB.Collection(collSubscriptions).Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = c.Close(ctx) }()
+
+	var revenue float64
+	for c.Next(ctx) {
+		var s Subscription
+		if err = c.Decode(&s); err != nil {
+			return 0, err
+		}
+		revenue += s.proratedPrice(from, to)
+	}
+	return revenue, c.Err()
+}
+
+// proratedPrice returns the part of the subscription's price which falls into
+// the given window.
+func (s Subscription) proratedPrice(from, to time.Time) float64 {
+	period := s.To.Sub(s.From)
+	if period <= 0 {
+		return 0
+	}
+	start, end := s.From, s.To
+	if from.After(start) {
+		start = from
+	}
+	if to.Before(end) {
+		end = to
+	}
+	overlap := end.Sub(start)
+	if overlap <= 0 {
+		return 0
+	}
+	return s.Price * float64(overlap) / float64(period)
+}
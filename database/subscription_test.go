@@ -0,0 +1,363 @@
+package database
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestInvalidSubscriptions ensures that subscriptions with invalid periods
+// are rejected and that pre-existing ones are detected.
+func TestInvalidSubscriptions(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	// Periods which don't start before they end are rejected.
+	_, err = db.NewSubscription(ctx, "sub", 2, now, now.Add(-time.Hour), 5)
+	if !errors.Contains(err, ErrInvalidPeriod) {
+		t.Fatalf("Expected %v, got %v", ErrInvalidPeriod, err)
+	}
+	_, err = db.NewSubscription(ctx, "sub", 2, now, now, 5)
+	if !errors.Contains(err, ErrInvalidPeriod) {
+		t.Fatalf("Expected %v, got %v", ErrInvalidPeriod, err)
+	}
+	valid, err := db.NewSubscription(ctx, "sub", 2, now, now.Add(time.Hour), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert an invalid subscription directly, bypassing the validation.
+	invalid := Subscription{
+		ID:     primitive.NewObjectID(),
+		Domain: db.staticServerDomain,
+		Sub:    "sub",
+		Tier:   2,
+		From:   now.Add(time.Hour),
+		To:     now,
+		Price:  5,
+	}
+	_, err = db.staticDB.Collection(collSubscriptions).InsertOne(ctx, invalid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the invalid subscription should be found.
+	subs, err := db.FindInvalidSubscriptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 || subs[0].ID != invalid.ID {
+		t.Fatalf("Expected only %v to be invalid, got %+v (valid: %v)", invalid.ID, subs, valid.ID)
+	}
+}
+
+// TestSubscriptionRevenue is a unit test for SubscriptionRevenue.
+func TestSubscriptionRevenue(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	windowFrom, windowTo := start.Add(10*day), start.Add(20*day)
+	subs := []struct {
+		from  time.Time
+		to    time.Time
+		price float64
+	}{
+		// Fully contained, counts fully.
+		{start.Add(12 * day), start.Add(14 * day), 10},
+		// Overlaps the start of the window by half, counts half.
+		{start.Add(8 * day), start.Add(12 * day), 20},
+		// Overlaps the end of the window by a quarter, counts a quarter.
+		{start.Add(19 * day), start.Add(23 * day), 40},
+		// Covers the window and more, counts with a third.
+		{start.Add(5 * day), start.Add(35 * day), 90},
+		// Doesn't overlap.
+		{start, start.Add(10 * day), 1000},
+		{start.Add(20 * day), start.Add(30 * day), 1000},
+	}
+	for _, s := range subs {
+		_, err = db.NewSubscription(ctx, "sub", 2, s.from, s.to, s.price)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revenue, err := db.SubscriptionRevenue(ctx, windowFrom, windowTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := 10.0 + 10 + 10 + 30
+	if math.Abs(revenue-expected) > 1e-9 {
+		t.Fatalf("Expected revenue %v, got %v", expected, revenue)
+	}
+
+	// A window without subscriptions.
+	revenue, err = db.SubscriptionRevenue(ctx, start.Add(-10*day), start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revenue != 0 {
+		t.Fatalf("Expected no revenue, got %v", revenue)
+	}
+}
+
+// TestSubscribersByTier is a unit test for SubscribersByTier.
+func TestSubscribersByTier(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	day := 24 * time.Hour
+	subs := []struct {
+		sub  string
+		tier int
+		from time.Time
+		to   time.Time
+	}{
+		// Active.
+		{"a", 2, now.Add(-10 * day), now.Add(20 * day)},
+		{"b", 2, now.Add(-5 * day), now.Add(25 * day)},
+		{"c", 3, now.Add(-1 * day), now.Add(29 * day)},
+		// Two overlapping periods of the same tier count once.
+		{"d", 3, now.Add(-20 * day), now.Add(10 * day)},
+		{"d", 3, now.Add(-2 * day), now.Add(28 * day)},
+		// Expired.
+		{"e", 2, now.Add(-40 * day), now.Add(-10 * day)},
+		{"f", 4, now.Add(-60 * day), now.Add(-30 * day)},
+		// Ends exactly now.
+		{"g", 4, now.Add(-30 * day), now},
+		// Starts in the future.
+		{"h", 4, now.Add(day), now.Add(30 * day)},
+	}
+	for _, s := range subs {
+		_, err = db.NewSubscription(ctx, s.sub, s.tier, s.from, s.to, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts, err := db.SubscribersByTier(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int]int64{
+		2: 2,
+		3: 2,
+	}
+	if len(counts) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, counts)
+	}
+	for tier, n := range expected {
+		if counts[tier] != n {
+			t.Fatalf("Expected %d subscribers for tier %d, got %d", n, tier, counts[tier])
+		}
+	}
+}
+
+// TestUpdateSubscriptionPrice is a unit test for UpdateSubscriptionPrice.
+func TestUpdateSubscriptionPrice(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	day := 24 * time.Hour
+	current, err := db.NewSubscription(ctx, "sub", 2, now.Add(-day), now.Add(day), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future, err := db.NewSubscription(ctx, "sub", 2, now.Add(day), now.Add(2*day), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ended, err := db.NewSubscription(ctx, "sub", 2, now.Add(-2*day), now.Add(-day), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Update the price of the current subscription twice. Both previous
+	// prices are kept.
+	_, err = db.UpdateSubscriptionPrice(ctx, current.ID, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.UpdateSubscriptionPrice(ctx, current.ID, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Price != 7 {
+		t.Fatalf("Expected price 7, got %v", s.Price)
+	}
+	if len(s.PriceHistory) != 2 || s.PriceHistory[0].Price != 5 || s.PriceHistory[1].Price != 6 {
+		t.Fatalf("Expected price history [5 6], got %+v", s.PriceHistory)
+	}
+	if s.PriceHistory[0].ChangedAt.After(s.PriceHistory[1].ChangedAt) {
+		t.Fatalf("Expected price history in order, got %+v", s.PriceHistory)
+	}
+
+	// Subscriptions which haven't started can be updated as well.
+	s, err = db.UpdateSubscriptionPrice(ctx, future.ID, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Price != 8 || len(s.PriceHistory) != 1 || s.PriceHistory[0].Price != 5 {
+		t.Fatalf("Unexpected subscription %+v", s)
+	}
+
+	// Ended subscriptions are immutable.
+	_, err = db.UpdateSubscriptionPrice(ctx, ended.ID, 9)
+	if !errors.Contains(err, ErrSubscriptionEnded) {
+		t.Fatalf("Expected %v, got %v", ErrSubscriptionEnded, err)
+	}
+	var stored Subscription
+	err = db.staticDB.Collection(collSubscriptions).FindOne(ctx, db.scoped(bson.D{{"_id", ended.ID}})).Decode(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Price != 5 || len(stored.PriceHistory) != 0 {
+		t.Fatalf("Expected ended subscription to be unchanged, got %+v", stored)
+	}
+
+	// Invalid prices are rejected.
+	for _, price := range []float64{-1, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		_, err = db.UpdateSubscriptionPrice(ctx, current.ID, price)
+		if !errors.Contains(err, ErrInvalidPrice) {
+			t.Fatalf("Expected %v for price %v, got %v", ErrInvalidPrice, price, err)
+		}
+	}
+
+	// Unknown subscriptions aren't found.
+	_, err = db.UpdateSubscriptionPrice(ctx, primitive.NewObjectID(), 9)
+	if !errors.Contains(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	// With FuturePriceUpdatesOnly, current subscriptions can't be updated
+	// anymore while future ones still can.
+	db.staticConfig.FuturePriceUpdatesOnly = true
+	_, err = db.UpdateSubscriptionPrice(ctx, current.ID, 10)
+	if !errors.Contains(err, ErrSubscriptionStarted) {
+		t.Fatalf("Expected %v, got %v", ErrSubscriptionStarted, err)
+	}
+	_, err = db.UpdateSubscriptionPrice(ctx, future.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestValidPrice is a unit test for validPrice.
+func TestValidPrice(t *testing.T) {
+	tests := []struct {
+		price float64
+		valid bool
+	}{
+		{0, true},
+		{5, true},
+		{-1, false},
+		{math.NaN(), false},
+		{math.Inf(1), false},
+		{math.Inf(-1), false},
+	}
+	for _, tt := range tests {
+		if valid := validPrice(tt.price); valid != tt.valid {
+			t.Errorf("%v: expected %v, got %v", tt.price, tt.valid, valid)
+		}
+	}
+}
+
+// TestGetSubscription tests fetching a subscription by its ID.
+func TestGetSubscription(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	created, err := db.NewSubscription(ctx, "sub", 2, now, now.Add(24*time.Hour), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.GetSubscription(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != created.ID || s.Sub != created.Sub || s.Tier != created.Tier || !s.From.Equal(created.From) || !s.To.Equal(created.To) || s.Price != created.Price {
+		t.Fatalf("Expected %+v, got %+v", created, s)
+	}
+
+	// Unknown subscriptions aren't found.
+	_, err = db.GetSubscription(ctx, primitive.NewObjectID())
+	if !errors.Contains(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"time"
+)
+
+// These are the rules by which TierForUser determines a user's tier.
+const (
+	// TierRuleDefault applies to users without an active subscription.
+	TierRuleDefault = "default"
+	// TierRuleSubscription applies to users with an active subscription.
+	TierRuleSubscription = "subscription"
+	// TierRuleGracePeriod applies to users whose subscription ended within
+	// the grace period.
+	TierRuleGracePeriod = "gracePeriod"
+)
+
+// These are the reasons EligibilityForTier reports for its decision.
+const (
+	// EligibleByTier means that the user is on the tier or a higher one
+	// already.
+	EligibleByTier = "currentTier"
+	// EligibleByBalance means that the user's balance covers the price of
+	// the tier.
+	EligibleByBalance = "balance"
+	// IneligibleByBalance means that the user's balance doesn't cover the
+	// price of the tier.
+	IneligibleByBalance = "insufficientBalance"
+	// IneligibleBySubscription means that the tier has no price, so it can
+	// only be reached by an active subscription which the user doesn't have.
+	IneligibleBySubscription = "missingSubscription"
+)
+
+type (
+	// UserView is a snapshot of everything we know about a user which is
+	// relevant for computing their tier.
+	UserView struct {
+		Sub           string
+		Balance       float64
+		Subscriptions []Subscription
+	}
+
+	// TierConfig contains the rules for computing a user's tier.
+	TierConfig struct {
+		// DefaultTier is the tier of users without an active subscription.
+		DefaultTier int
+		// GracePeriod is the time for which a subscription still counts as
+		// active after it ended. This gives users time to renew their
+		// subscription without being demoted in between.
+		GracePeriod time.Duration
+		// Prices are the prices of subscribing to the tiers. They are
+		// charged for new subscriptions and determine whether a user can
+		// afford a tier they're not on yet. Tiers without a price can't be
+		// subscribed to via the API.
+		Prices map[int]float64
+	}
+
+	// TierDecision is the outcome of computing a user's tier. Rule is the
+	// rule which determined the tier and Subscription is the index of the
+	// subscription in the UserView it was derived from, or -1 if the user is
+	// on the default tier.
+	TierDecision struct {
+		Tier         int
+		Rule         string
+		Subscription int
+	}
+
+	// TierEligibility is the outcome of checking whether a user is eligible
+	// for a tier. Reason is the reason for the decision and Gap is the
+	// amount of credits the user is short of the tier's price if the
+	// balance is insufficient.
+	TierEligibility struct {
+		Eligible    bool
+		Reason      string
+		CurrentTier int
+		Gap         float64
+	}
+)
+
+// TierForUser computes the tier of the given user at the given time. A user is
+// on the tier of their active subscription, including subscriptions which
+// ended less than the grace period ago. If multiple subscriptions are active
+// at the same time, the highest tier wins. Users without any active
+// subscriptions are on the default tier.
+//
+// TierForUser doesn't depend on the database, so it can be reused by all code
+// paths which need to know a user's tier.
+func TierForUser(view UserView, cfg TierConfig, now time.Time) int {
+	return ExplainTierForUser(view, cfg, now).Tier
+}
+
+// ExplainTierForUser computes the tier of the given user at the given time
+// like TierForUser but also reports which rule determined the tier.
+func ExplainTierForUser(view UserView, cfg TierConfig, now time.Time) TierDecision {
+	decision := TierDecision{
+		Tier:         cfg.DefaultTier,
+		Rule:         TierRuleDefault,
+		Subscription: -1,
+	}
+	for i, s := range view.Subscriptions {
+		if !s.activeAt(now, cfg.GracePeriod) {
+			continue
+		}
+		if s.Tier <= decision.Tier {
+			continue
+		}
+		decision.Tier = s.Tier
+		decision.Subscription = i
+		decision.Rule = TierRuleSubscription
+		if !now.Before(s.To) {
+			decision.Rule = TierRuleGracePeriod
+		}
+	}
+	return decision
+}
+
+// EligibilityForTier checks whether the given user is eligible for the given
+// tier at the given time without promoting them. A user is eligible if they
+// are on the tier or a higher one already, or if their balance covers the
+// tier's price. Like TierForUser, it doesn't depend on the database.
+func EligibilityForTier(view UserView, cfg TierConfig, tier int, now time.Time) TierEligibility {
+	current := TierForUser(view, cfg, now)
+	if current >= tier {
+		return TierEligibility{
+			Eligible:    true,
+			Reason:      EligibleByTier,
+			CurrentTier: current,
+		}
+	}
+	price, ok := cfg.Prices[tier]
+	if !ok {
+		return TierEligibility{
+			Reason:      IneligibleBySubscription,
+			CurrentTier: current,
+		}
+	}
+	if view.Balance < price {
+		return TierEligibility{
+			Reason:      IneligibleByBalance,
+			CurrentTier: current,
+			Gap:         price - view.Balance,
+		}
+	}
+	return TierEligibility{
+		Eligible:    true,
+		Reason:      EligibleByBalance,
+		CurrentTier: current,
+	}
+}
+
+// activeAt returns true if the subscription is active at the given time,
+// considering the given grace period after its end.
+func (s Subscription) activeAt(t time.Time, grace time.Duration) bool {
+	return !t.Before(s.From) && t.Before(s.To.Add(grace))
+}
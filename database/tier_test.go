@@ -0,0 +1,201 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTierForUser is a unit test for TierForUser.
+func TestTierForUser(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	day := 24 * time.Hour
+	cfg := TierConfig{
+		DefaultTier: 1,
+		GracePeriod: 3 * day,
+	}
+	subscription := func(tier int, from, to time.Time) Subscription {
+		return Subscription{Sub: "sub", Tier: tier, From: from, To: to}
+	}
+
+	tests := []struct {
+		name string
+		subs []Subscription
+		tier int
+		rule string
+	}{
+		{
+			name: "NoSubscription",
+			tier: 1,
+			rule: TierRuleDefault,
+		},
+		{
+			name: "ActiveSubscription",
+			subs: []Subscription{subscription(3, now.Add(-day), now.Add(day))},
+			tier: 3,
+			rule: TierRuleSubscription,
+		},
+		{
+			name: "StartsNow",
+			subs: []Subscription{subscription(3, now, now.Add(day))},
+			tier: 3,
+			rule: TierRuleSubscription,
+		},
+		{
+			name: "FutureSubscription",
+			subs: []Subscription{subscription(3, now.Add(day), now.Add(2*day))},
+			tier: 1,
+			rule: TierRuleDefault,
+		},
+		{
+			name: "ExpiredWithinGrace",
+			subs: []Subscription{subscription(2, now.Add(-30*day), now.Add(-day))},
+			tier: 2,
+			rule: TierRuleGracePeriod,
+		},
+		{
+			name: "ExpiredAtEndOfGrace",
+			subs: []Subscription{subscription(2, now.Add(-30*day), now.Add(-3*day))},
+			tier: 1,
+			rule: TierRuleDefault,
+		},
+		{
+			name: "ExpiredBeyondGrace",
+			subs: []Subscription{subscription(2, now.Add(-30*day), now.Add(-10*day))},
+			tier: 1,
+			rule: TierRuleDefault,
+		},
+		{
+			name: "OverlappingSubscriptions",
+			subs: []Subscription{
+				subscription(2, now.Add(-10*day), now.Add(10*day)),
+				subscription(4, now.Add(-day), now.Add(day)),
+				subscription(3, now.Add(-5*day), now.Add(5*day)),
+			},
+			tier: 4,
+			rule: TierRuleSubscription,
+		},
+		{
+			name: "DowngradeWithinGrace",
+			subs: []Subscription{
+				subscription(4, now.Add(-30*day), now.Add(-day)),
+				subscription(2, now.Add(-day), now.Add(30*day)),
+			},
+			tier: 4,
+			rule: TierRuleGracePeriod,
+		},
+		{
+			name: "ExpiredAndActive",
+			subs: []Subscription{
+				subscription(4, now.Add(-60*day), now.Add(-30*day)),
+				subscription(2, now.Add(-day), now.Add(30*day)),
+			},
+			tier: 2,
+			rule: TierRuleSubscription,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			view := UserView{Sub: "sub", Subscriptions: tt.subs}
+			if tier := TierForUser(view, cfg, now); tier != tt.tier {
+				t.Fatalf("Expected tier %d, got %d", tt.tier, tier)
+			}
+			decision := ExplainTierForUser(view, cfg, now)
+			if decision.Tier != tt.tier || decision.Rule != tt.rule {
+				t.Fatalf("Expected tier %d by rule %s, got %+v", tt.tier, tt.rule, decision)
+			}
+			if (decision.Rule == TierRuleDefault) != (decision.Subscription == -1) {
+				t.Fatalf("Unexpected subscription index in %+v", decision)
+			}
+			if decision.Subscription >= 0 && tt.subs[decision.Subscription].Tier != tt.tier {
+				t.Fatalf("Subscription %d doesn't have tier %d", decision.Subscription, tt.tier)
+			}
+		})
+	}
+}
+
+// TestEligibilityForTier is a unit test for EligibilityForTier.
+func TestEligibilityForTier(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	day := 24 * time.Hour
+	cfg := TierConfig{
+		DefaultTier: 1,
+		GracePeriod: 3 * day,
+		Prices: map[int]float64{
+			2: 5,
+			3: 20,
+		},
+	}
+	active := []Subscription{{Sub: "sub", Tier: 3, From: now.Add(-day), To: now.Add(day)}}
+
+	tests := []struct {
+		name     string
+		balance  float64
+		subs     []Subscription
+		tier     int
+		eligible bool
+		reason   string
+		current  int
+		gap      float64
+	}{
+		{
+			name:     "DefaultTier",
+			tier:     1,
+			eligible: true,
+			reason:   EligibleByTier,
+			current:  1,
+		},
+		{
+			name:     "SubscribedToTier",
+			subs:     active,
+			tier:     3,
+			eligible: true,
+			reason:   EligibleByTier,
+			current:  3,
+		},
+		{
+			name:     "SubscribedToHigherTier",
+			subs:     active,
+			tier:     2,
+			eligible: true,
+			reason:   EligibleByTier,
+			current:  3,
+		},
+		{
+			name:     "BalanceCoversPrice",
+			balance:  20,
+			tier:     3,
+			eligible: true,
+			reason:   EligibleByBalance,
+			current:  1,
+		},
+		{
+			name:    "InsufficientBalance",
+			balance: 12.5,
+			tier:    3,
+			reason:  IneligibleByBalance,
+			current: 1,
+			gap:     7.5,
+		},
+		{
+			name:    "MissingSubscription",
+			balance: 1000,
+			subs:    active,
+			tier:    4,
+			reason:  IneligibleBySubscription,
+			current: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			view := UserView{Sub: "sub", Balance: tt.balance, Subscriptions: tt.subs}
+			e := EligibilityForTier(view, cfg, tt.tier, now)
+			if e.Eligible != tt.eligible || e.Reason != tt.reason || e.CurrentTier != tt.current || e.Gap != tt.gap {
+				t.Fatalf("Expected eligible %v by %s on tier %d with gap %v, got %+v", tt.eligible, tt.reason, tt.current, tt.gap, e)
+			}
+		})
+	}
+}
@@ -0,0 +1,477 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// chargeTxnIDPrefix is the prefix of the IDs of the txns which record
+	// subscription charges.
+	chargeTxnIDPrefix = "subscription-"
+
+	// holdTxnIDPrefix is the prefix of the IDs of the txns which record
+	// captured holds.
+	holdTxnIDPrefix = "hold-"
+)
+
+type (
+	// TxnFilter describes which txns to iterate over. Zero values don't
+	// filter.
+	TxnFilter struct {
+		Sub    string
+		Source string
+		// From and To limit the creation time of the txns to [From, To).
+		From time.Time
+		To   time.Time
+		// IncludeDeleted includes deleted txns, e.g. for auditing.
+		IncludeDeleted bool
+	}
+
+	// TxnDuplicates is a group of txns which are logical duplicates of each
+	// other. Value is the metadata value they share. IDs are ordered from
+	// oldest to newest.
+	TxnDuplicates struct {
+		Sub   string      `bson:"sub"`
+		Value interface{} `bson:"value"`
+		IDs   []string    `bson:"ids"`
+	}
+
+	// TxnPosition is a position in the sequence of all txns ordered by
+	// their creation time and ID. If ID is empty, the position is right
+	// after all txns created at CreatedAt.
+	TxnPosition struct {
+		CreatedAt time.Time
+		ID        string
+	}
+
+	// TxnCursor iterates over txns without loading them all into memory at
+	// once. It needs to be closed once it's no longer needed.
+	TxnCursor struct {
+		c      *mongo.Cursor
+		closed bool
+		err    error
+	}
+)
+
+// IsReservedTxnID returns true if the txn ID is reserved for txns created by
+// the promoter itself. Payments must not use such IDs, otherwise they could
+// take the place of a charge or a captured hold.
+func IsReservedTxnID(id string) bool {
+	return strings.HasPrefix(id, chargeTxnIDPrefix) || strings.HasPrefix(id, holdTxnIDPrefix)
+}
+
+// scopedTxns scopes a filter for txns like scoped and additionally excludes
+// deleted txns.
+func (db *DB) scopedTxns(filter bson.D) bson.D {
+	return append(db.scoped(filter), bson.E{"deleted", bson.D{{"$ne", true}}})
+}
+
+// GetTxn returns the txn with the given ID. If the txn doesn't exist or was
+// deleted, ErrNotFound is returned.
+func (db *DB) GetTxn(ctx context.Context, id string) (*Txn, error) {
+	return db.getTxn(ctx, db.scopedTxns(bson.D{{"txnID", id}}))
+}
+
+// GetTxnForAudit returns the txn with the given ID like GetTxn but also
+// returns it if it was deleted.
+func (db *DB) GetTxnForAudit(ctx context.Context, id string) (*Txn, error) {
+	return db.getTxn(ctx, db.scoped(bson.D{{"txnID", id}}))
+}
+
+// getTxn returns the txn matching the filter.
+func (db *DB) getTxn(ctx context.Context, filter bson.D) (*Txn, error) {
+	var txn Txn
+	err := db.staticDB.Collection(collTnxs).FindOne(ctx, filter).Decode(&txn)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &txn, nil
+}
+
+// DeleteTxn marks the txn with the given ID as deleted, which reverses its
+// effect on the balance of its sub. The txn is kept for auditing and its ID
+// stays taken, so a payment which is reported again isn't credited again. If
+// the txn doesn't exist or was deleted already, ErrNotFound is returned.
+func (db *DB) DeleteTxn(ctx context.Context, id string) error {
+	n, err := db.deleteTxns(ctx, db.scopedTxns(bson.D{{"txnID", id}}))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// deleteTxns marks all txns matching the filter as deleted and returns their
+// number.
+func (db *DB) deleteTxns(ctx context.Context, filter bson.D) (int64, error) {
+	res, err := db.staticDB.Collection(collTnxs).UpdateMany(ctx, filter, bson.M{
+		"$set": bson.M{
+			"deleted":   true,
+			"deletedAt": time.Now().UTC(),
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// ReassignTxn moves the txn with the given ID to another sub, e.g. because a
+// payment processor attributed it to the wrong sub. The new user is created if
+// necessary and the move is recorded in the txn's reassignments. The txn keeps
+// its ID, so a payment which is reported again is still recognized as a
+// duplicate. Reassigning a txn to the sub it already belongs to is a no-op.
+// Only payments can be reassigned, debits like subscription charges belong to
+// the sub which spent the credits and ErrTxnNotReassignable is returned for
+// them. Moving a payment spends its credits, so the configured
+// NegativeBalancePolicy applies to the current sub.
+// This method assumes that it's called from within a DB transaction, so when
+// it fails with an error all changes in the DB are automatically rolled back.
+func (db *DB) ReassignTxn(ctx context.Context, txnID, newSub string) (*Txn, error) {
+	txn, err := db.GetTxn(ctx, txnID)
+	if err != nil {
+		return nil, err
+	}
+	if txn.Source != TxnSourcePayment {
+		return nil, ErrTxnNotReassignable
+	}
+	if txn.Sub == newSub {
+		return txn, nil
+	}
+	oldSub := txn.Sub
+	err = db.touchUser(ctx, oldSub)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to update user")
+	}
+	if txn.Amount > 0 {
+		_, available, err := db.UserBalance(ctx, oldSub)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to fetch balance")
+		}
+		if err = db.checkSpend(oldSub, available, txn.Amount); err != nil {
+			return nil, err
+		}
+	}
+	err = db.ensureUser(ctx, newSub)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to create user")
+	}
+	reassignment := TxnReassignment{
+		From: oldSub,
+		To:   newSub,
+		At:   time.Now().UTC(),
+	}
+	res, err := db.staticDB.Collection(collTnxs).UpdateOne(ctx, db.scopedTxns(bson.D{{"txnID", txnID}, {"sub", oldSub}}), bson.M{
+		"$set":  bson.M{"sub": newSub},
+		"$push": bson.M{"reassignments": reassignment},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.ModifiedCount == 0 {
+		// The txn was changed concurrently.
+		return nil, ErrNotFound
+	}
+	db.staticLogger.WithField("txn", txnID).Infof("Reassigned txn from sub %s to %s", oldSub, newSub)
+	txn.Sub = newSub
+	txn.Reassignments = append(txn.Reassignments, reassignment)
+	return txn, nil
+}
+
+// OrphanTxns returns all txns whose sub has no user document, ordered by their
+// creation time. Such txns shouldn't exist since users are created with their
+// first txn, so this helps operators with auditing the integrity of the data.
+func (db *DB) OrphanTxns(ctx context.Context) ([]Txn, error) {
+	match := bson.D{{"$match", db.scoped(bson.D{})}}
+	lookup := bson.D{{"$lookup", bson.D{
+		{"from", collUsers},
+		{"let", bson.D{{"sub", "$sub"}, {"domain", "$domain"}}},
+		{"pipeline", mongo.Pipeline{
+			{{"$match", bson.D{{"$expr", bson.D{{"$and", bson.A{
+				bson.D{{"$eq", bson.A{"$sub", "$$sub"}}},
+				bson.D{{"$eq", bson.A{"$domain", "$$domain"}}},
+			}}}}}}},
+			{{"$project", bson.D{{"_id", 1}}}},
+		}},
+		{"as", "users"},
+	}}}
+	orphans := bson.D{{"$match", bson.D{{"users", bson.D{{"$size", 0}}}}}}
+	project := bson.D{{"$project", bson.D{{"users", 0}}}}
+	sort := bson.D{{"$sort", bson.D{{"createdAt", 1}, {"txnID", 1}}}}
+	c, err := db.staticDB.Collection(collTnxs).Aggregate(ctx, mongo.Pipeline{match, lookup, orphans, project, sort})
+	if err != nil {
+		return nil, err
+	}
+	txns := make([]Txn, 0)
+	err = c.All(ctx, &txns)
+	if err != nil {
+		return nil, err
+	}
+	return txns, nil
+}
+
+// ListDebits returns a page of the debit txns of the given sub, i.e. the txns
+// with a negative amount, ordered from newest to oldest. It also returns the
+// total number of debits of the sub.
+func (db *DB) ListDebits(ctx context.Context, sub string, limit, offset int64) ([]Txn, int64, error) {
+	filter := db.scopedTxns(bson.D{
+		{"sub", sub},
+		{"amount", bson.D{{"$lt", 0}}},
+	})
+	opts := options.Find().
+		SetSort(bson.D{{"createdAt", -1}, {"txnID", -1}}).
+		SetLimit(limit).
+		SetSkip(offset)
+	c, err := db.staticDB.Collection(collTnxs).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	txns := make([]Txn, 0)
+	err = c.All(ctx, &txns)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := db.staticDB.Collection(collTnxs).CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	return txns, total, nil
+}
+
+// TxnsAfter returns up to limit txns which come after the given position,
+// ordered by their creation time and ID. The position of the last returned txn
+// can be used to request the next page, so callers can poll for new txns
+// without missing or repeating any. The zero position starts with the oldest
+// txn. Txns younger than the configured TxnVisibilityLag aren't returned yet
+// since older txns might still be committed before them.
+func (db *DB) TxnsAfter(ctx context.Context, after TxnPosition, limit int64) ([]Txn, error) {
+	cutoff := bson.E{"$lt", time.Now().Add(-db.staticConfig.TxnVisibilityLag).UTC()}
+	filter := bson.D{{"createdAt", bson.D{cutoff}}}
+	if after.ID != "" {
+		filter = append(filter, bson.E{"$or", bson.A{
+			bson.D{{"createdAt", bson.D{{"$gt", after.CreatedAt.UTC()}}}},
+			bson.D{{"createdAt", after.CreatedAt.UTC()}, {"txnID", bson.D{{"$gt", after.ID}}}},
+		}})
+	} else if !after.CreatedAt.IsZero() {
+		filter = bson.D{{"createdAt", bson.D{{"$gt", after.CreatedAt.UTC()}, cutoff}}}
+	}
+	opts := options.Find().
+		SetSort(bson.D{{"createdAt", 1}, {"txnID", 1}}).
+		SetLimit(limit)
+	c, err := db.staticDB.Collection(collTnxs).Find(ctx, db.scopedTxns(filter), opts)
+	if err != nil {
+		return nil, err
+	}
+	txns := make([]Txn, 0)
+	err = c.All(ctx, &txns)
+	if err != nil {
+		return nil, err
+	}
+	return txns, nil
+}
+
+// Position returns the position of the txn in the sequence of all txns.
+func (txn Txn) Position() TxnPosition {
+	return TxnPosition{
+		CreatedAt: txn.CreatedAt,
+		ID:        txn.ID,
+	}
+}
+
+// maxLatestTxnsSubs is the maximum number of subs LatestTxns accepts.
+const maxLatestTxnsSubs = 1000
+
+// LatestTxns returns the most recent txn of each of the given subs. Subs
+// without txns are missing from the returned map. At most maxLatestTxnsSubs
+// subs can be requested at once.
+func (db *DB) LatestTxns(ctx context.Context, subs []string) (map[string]Txn, error) {
+	if len(subs) > maxLatestTxnsSubs {
+		return nil, fmt.Errorf("can't request more than %d subs at once, got %d", maxLatestTxnsSubs, len(subs))
+	}
+	latest := make(map[string]Txn, len(subs))
+	if len(subs) == 0 {
+		return latest, nil
+	}
+	// The sort matches the sub_createdAt index, so the txns don't need to
+	// be sorted in memory.
+	match := bson.D{{"$match", db.scopedTxns(bson.D{{"sub", bson.D{{"$in", subs}}}})}}
+	sort := bson.D{{"$sort", bson.D{{"sub", 1}, {"createdAt", -1}}}}
+	group := bson.D{{
+		"$group", bson.D{
+			{"_id", "$sub"},
+			{"txn", bson.D{{"$first", "$$ROOT"}}},
+		},
+	}}
+	c, err := db.staticDB.Collection(collTnxs).Aggregate(ctx, mongo.Pipeline{match, sort, group})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.Close(ctx) }()
+	for c.Next(ctx) {
+		var res struct {
+			Txn Txn `bson:"txn"`
+		}
+		if err = c.Decode(&res); err != nil {
+			return nil, err
+		}
+		latest[res.Txn.Sub] = res.Txn
+	}
+	return latest, c.Err()
+}
+
+// FindDuplicateTxns returns all groups of txns which are logical duplicates
+// of each other, e.g. the same payment imported twice under different IDs.
+// Two txns are duplicates if they belong to the same sub, have the same amount
+// and carry the same value under the given metadata key. The key should be one
+// which the payment processor sets to a unique reference for every payment.
+// Txns without the key are never considered duplicates.
+func (db *DB) FindDuplicateTxns(ctx context.Context, metadataKey string) ([]TxnDuplicates, error) {
+	if metadataKey == "" || strings.Contains(metadataKey, ".") || strings.HasPrefix(metadataKey, "$") {
+		return nil, fmt.Errorf("can't find duplicates by invalid metadata key '%s'", metadataKey)
+	}
+	byField := "metadata." + metadataKey
+	scope := bson.D{{"$match", db.scopedTxns(bson.D{{byField, bson.D{{"$exists", true}}}})}}
+	sort := bson.D{{"$sort", bson.D{{"createdAt", 1}, {"txnID", 1}}}}
+	group := bson.D{{
+		"$group", bson.D{
+			{"_id", bson.D{{"sub", "$sub"}, {"amount", "$amount"}, {"value", "$" + byField}}},
+			{"ids", bson.D{{"$push", "$txnID"}}},
+		},
+	}}
+	match := bson.D{{"$match", bson.D{{"ids.1", bson.D{{"$exists", true}}}}}}
+	project := bson.D{{"$project", bson.D{
+		{"_id", 0},
+		{"sub", "$_id.sub"},
+		{"value", "$_id.value"},
+		{"ids", 1},
+	}}}
+	c, err := db.staticDB.Collection(collTnxs).Aggregate(ctx, mongo.Pipeline{scope, sort, group, match, project})
+	if err != nil {
+		return nil, err
+	}
+	dups := make([]TxnDuplicates, 0)
+	err = c.All(ctx, &dups)
+	if err != nil {
+		return nil, err
+	}
+	return dups, nil
+}
+
+// RemoveDuplicateTxns deletes all but the oldest txn of every group returned
+// by FindDuplicateTxns like DeleteTxn and returns the number of deleted txns.
+// Since this changes the balance of the affected subs, dryRun allows for
+// checking the impact first. If it's true, nothing is deleted and the number
+// of txns which would have been deleted is returned.
+func (db *DB) RemoveDuplicateTxns(ctx context.Context, metadataKey string, dryRun bool) (int64, error) {
+	dups, err := db.FindDuplicateTxns(ctx, metadataKey)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for _, dup := range dups {
+		ids = append(ids, dup.IDs[1:]...)
+	}
+	if dryRun || len(ids) == 0 {
+		return int64(len(ids)), nil
+	}
+	n, err := db.deleteTxns(ctx, db.scopedTxns(bson.D{{"txnID", bson.D{{"$in", ids}}}}))
+	if err != nil {
+		return 0, err
+	}
+	db.staticLogger.Infof("Deleted %d duplicate txns by metadata key '%s'", n, metadataKey)
+	return n, nil
+}
+
+// IterTxns returns a cursor over all txns matching the filter, ordered by
+// their creation time. Deleted txns are skipped unless the filter includes
+// them.
+func (db *DB) IterTxns(ctx context.Context, filter TxnFilter) (*TxnCursor, error) {
+	scope := db.scopedTxns
+	if filter.IncludeDeleted {
+		scope = db.scoped
+	}
+	opts := options.Find().SetSort(bson.D{{"createdAt", 1}, {"txnID", 1}})
+	c, err := db.staticDB.Collection(collTnxs).Find(ctx, scope(filter.bson()), opts)
+	if err != nil {
+		return nil, err
+	}
+	return &TxnCursor{c: c}, nil
+}
+
+// bson returns the filter as a query document.
+func (f TxnFilter) bson() bson.D {
+	filter := bson.D{}
+	if f.Sub != "" {
+		filter = append(filter, bson.E{"sub", f.Sub})
+	}
+	if f.Source != "" {
+		filter = append(filter, bson.E{"source", f.Source})
+	}
+	createdAt := bson.D{}
+	if !f.From.IsZero() {
+		createdAt = append(createdAt, bson.E{"$gte", f.From.UTC()})
+	}
+	if !f.To.IsZero() {
+		createdAt = append(createdAt, bson.E{"$lt", f.To.UTC()})
+	}
+	if len(createdAt) > 0 {
+		filter = append(filter, bson.E{"createdAt", createdAt})
+	}
+	return filter
+}
+
+// Next advances the cursor to the next txn. It returns false once there are
+// no more txns, the context is cancelled or an error occurred. In that case
+// the cursor is closed automatically and Err should be checked.
+func (tc *TxnCursor) Next(ctx context.Context) bool {
+	if tc.closed {
+		return false
+	}
+	if err := ctx.Err(); err != nil {
+		tc.err = err
+		_ = tc.Close(context.Background())
+		return false
+	}
+	if !tc.c.Next(ctx) {
+		_ = tc.Close(context.Background())
+		return false
+	}
+	return true
+}
+
+// Decode decodes the txn the cursor is currently pointing at.
+func (tc *TxnCursor) Decode() (Txn, error) {
+	var txn Txn
+	err := tc.c.Decode(&txn)
+	return txn, err
+}
+
+// Err returns the last error the cursor encountered.
+func (tc *TxnCursor) Err() error {
+	if tc.err != nil {
+		return tc.err
+	}
+	return tc.c.Err()
+}
+
+// Close closes the cursor. It's safe to call Close multiple times.
+func (tc *TxnCursor) Close(ctx context.Context) error {
+	if tc.closed {
+		return nil
+	}
+	tc.closed = true
+	return tc.c.Close(ctx)
+}
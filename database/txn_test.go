@@ -0,0 +1,696 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TestIterTxns is a unit test for IterTxns.
+func TestIterTxns(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Seed txns for two subs.
+	ctx := context.Background()
+	numTxns := 1000
+	start := time.Now()
+	for i := 0; i < numTxns; i++ {
+		sub := "sub1"
+		if i%2 == 1 {
+			sub = "sub2"
+		}
+		_, err = db.NewTxn(ctx, fmt.Sprint(i), sub, 1, TxnSourcePayment, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// iterate counts the txns matching the filter and ensures they are
+	// ordered by creation time.
+	iterate := func(ctx context.Context, filter TxnFilter) (int, error) {
+		c, err := db.IterTxns(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+		defer func() { _ = c.Close(ctx) }()
+		var n int
+		var last time.Time
+		for c.Next(ctx) {
+			txn, err := c.Decode()
+			if err != nil {
+				return 0, err
+			}
+			if filter.Sub != "" && txn.Sub != filter.Sub {
+				t.Fatalf("Expected sub %v, got %v", filter.Sub, txn.Sub)
+			}
+			if txn.CreatedAt.Before(last) {
+				t.Fatal("Txns are not ordered by creation time")
+			}
+			last = txn.CreatedAt
+			n++
+		}
+		return n, c.Err()
+	}
+
+	// All txns.
+	n, err := iterate(ctx, TxnFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != numTxns {
+		t.Fatalf("Expected %d txns, got %d", numTxns, n)
+	}
+	// Txns of a single sub.
+	n, err = iterate(ctx, TxnFilter{Sub: "sub1", Source: TxnSourcePayment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != numTxns/2 {
+		t.Fatalf("Expected %d txns, got %d", numTxns/2, n)
+	}
+	// No txns in the future.
+	n, err = iterate(ctx, TxnFilter{From: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("Expected no txns, got %d", n)
+	}
+	// All txns within the range.
+	n, err = iterate(ctx, TxnFilter{From: start.Add(-time.Second), To: time.Now().Add(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != numTxns {
+		t.Fatalf("Expected %d txns, got %d", numTxns, n)
+	}
+	// A cancelled context stops the iteration.
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = iterate(cancelledCtx, TxnFilter{})
+	if err == nil {
+		t.Fatal("Expected iteration to fail with a cancelled context")
+	}
+}
+
+// TestFindDuplicateTxns is a unit test for FindDuplicateTxns and
+// RemoveDuplicateTxns.
+func TestFindDuplicateTxns(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Invalid metadata keys are rejected.
+	ctx := context.Background()
+	for _, key := range []string{"", "a.b", "$ref"} {
+		_, err = db.FindDuplicateTxns(ctx, key)
+		if err == nil {
+			t.Fatalf("Expected an error for metadata key '%s'", key)
+		}
+	}
+
+	// Import txns the way a careless import would, including the same txn
+	// three times and another one twice under different IDs. The duplicates
+	// were imported at different times, so only the processor's reference
+	// identifies them.
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	ref := func(r string) map[string]string {
+		return map[string]string{"reference": r}
+	}
+	txns := []interface{}{
+		Txn{Domain: db.staticServerDomain, ID: "a1", Sub: "sub", Amount: 5, Source: TxnSourcePayment, Metadata: ref("a"), CreatedAt: now},
+		Txn{Domain: db.staticServerDomain, ID: "a2", Sub: "sub", Amount: 5, Source: TxnSourcePayment, Metadata: ref("a"), CreatedAt: now.Add(time.Second)},
+		Txn{Domain: db.staticServerDomain, ID: "a3", Sub: "sub", Amount: 5, Source: TxnSourcePayment, Metadata: ref("a"), CreatedAt: now.Add(2 * time.Second)},
+		Txn{Domain: db.staticServerDomain, ID: "b1", Sub: "sub", Amount: 7, Source: TxnSourcePayment, Metadata: ref("b"), CreatedAt: now},
+		Txn{Domain: db.staticServerDomain, ID: "b2", Sub: "sub", Amount: 7, Source: TxnSourcePayment, Metadata: ref("b"), CreatedAt: now.Add(time.Second)},
+		// Same reference but different sub or amount.
+		Txn{Domain: db.staticServerDomain, ID: "c", Sub: "othersub", Amount: 5, Source: TxnSourcePayment, Metadata: ref("a"), CreatedAt: now},
+		Txn{Domain: db.staticServerDomain, ID: "d", Sub: "sub", Amount: 6, Source: TxnSourcePayment, Metadata: ref("a"), CreatedAt: now},
+		// Same sub, amount and time but without a reference.
+		Txn{Domain: db.staticServerDomain, ID: "e1", Sub: "sub", Amount: 5, Source: TxnSourcePayment, CreatedAt: now},
+		Txn{Domain: db.staticServerDomain, ID: "e2", Sub: "sub", Amount: 5, Source: TxnSourcePayment, CreatedAt: now},
+	}
+	_, err = db.staticDB.Collection(collTnxs).InsertMany(ctx, txns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dups, err := db.FindDuplicateTxns(ctx, "reference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dups) != 2 {
+		t.Fatalf("Expected 2 groups of duplicates, got %+v", dups)
+	}
+	var numDups int
+	for _, dup := range dups {
+		if dup.Sub != "sub" {
+			t.Fatalf("Unexpected duplicates %+v", dup)
+		}
+		numDups += len(dup.IDs) - 1
+	}
+	if numDups != 3 {
+		t.Fatalf("Expected 3 duplicates, got %v", numDups)
+	}
+
+	// A dry run doesn't remove anything.
+	n, err := db.RemoveDuplicateTxns(ctx, "reference", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("Expected 3 txns to be removed, got %v", n)
+	}
+	balance, _, err := db.UserBalance(ctx, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 45 {
+		t.Fatalf("Expected balance 45, got %v", balance)
+	}
+
+	// Remove the duplicates.
+	n, err = db.RemoveDuplicateTxns(ctx, "reference", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("Expected 3 txns to be removed, got %v", n)
+	}
+	balance, _, err = db.UserBalance(ctx, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 28 {
+		t.Fatalf("Expected balance 28, got %v", balance)
+	}
+	dups, err = db.FindDuplicateTxns(ctx, "reference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dups) != 0 {
+		t.Fatalf("Expected no duplicates, got %+v", dups)
+	}
+}
+
+// TestLatestTxns is a unit test for LatestTxns.
+func TestLatestTxns(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Seed multiple txns per sub with distinct creation times.
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	var txns []interface{}
+	for i, sub := range []string{"sub1", "sub2", "sub3"} {
+		for j := 0; j < 5; j++ {
+			txns = append(txns, Txn{
+				ID:        fmt.Sprintf("%s-%d", sub, j),
+				Domain:    db.staticServerDomain,
+				Sub:       sub,
+				Amount:    float64(j + 1),
+				Source:    TxnSourcePayment,
+				CreatedAt: now.Add(time.Duration(i*10+j) * time.Second),
+			})
+		}
+	}
+	_, err = db.staticDB.Collection(collTnxs).InsertMany(ctx, txns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Request two of the subs and one without txns.
+	latest, err := db.LatestTxns(ctx, []string{"sub1", "sub3", "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latest) != 2 {
+		t.Fatalf("Expected 2 txns, got %v", latest)
+	}
+	for _, sub := range []string{"sub1", "sub3"} {
+		txn, ok := latest[sub]
+		if !ok {
+			t.Fatalf("Missing txn for %s", sub)
+		}
+		if txn.ID != sub+"-4" || txn.Sub != sub {
+			t.Fatalf("Expected latest txn of %s, got %+v", sub, txn)
+		}
+	}
+
+	// Too many subs.
+	_, err = db.LatestTxns(ctx, make([]string, maxLatestTxnsSubs+1))
+	if err == nil {
+		t.Fatal("Expected an error for too many subs")
+	}
+}
+
+// TestReassignTxn ensures that reassigning a txn moves its amount from the
+// balance of one sub to another while the txn keeps its ID.
+func TestReassignTxn(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// checkBalance checks the balance of the sub.
+	ctx := context.Background()
+	checkBalance := func(sub string, expected float64) {
+		t.Helper()
+		balance, _, err := db.UserBalance(ctx, sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance != expected {
+			t.Fatalf("Expected balance %v for sub %s, got %v", expected, sub, balance)
+		}
+	}
+
+	// Credit the wrong sub.
+	_, err = db.CreditUser(ctx, "wrong", 10, "txn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreditUser(ctx, "wrong", 3, "othertxn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reassign the txn to the right sub, which doesn't exist yet.
+	txn, err := db.ReassignTxn(ctx, "txn", "right")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txn.ID != "txn" || txn.Sub != "right" {
+		t.Fatalf("Unexpected txn %+v", txn)
+	}
+	checkBalance("wrong", 3)
+	checkBalance("right", 10)
+	if _, err = db.GetUser(ctx, "right"); err != nil {
+		t.Fatal(err)
+	}
+	txn, err = db.GetTxn(ctx, "txn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txn.Reassignments) != 1 || txn.Reassignments[0].From != "wrong" || txn.Reassignments[0].To != "right" {
+		t.Fatalf("Expected the reassignment to be recorded, got %+v", txn.Reassignments)
+	}
+
+	// Reassigning it again is a no-op.
+	if _, err = db.ReassignTxn(ctx, "txn", "right"); err != nil {
+		t.Fatal(err)
+	}
+	checkBalance("wrong", 3)
+	checkBalance("right", 10)
+
+	// Crediting the original txn again is still recognized as a duplicate.
+	_, err = db.CreditUser(ctx, "wrong", 10, "txn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance("wrong", 3)
+	checkBalance("right", 10)
+
+	// The credits of a txn which were already spent can't be moved.
+	subID, err := newTestCharge(ctx, db, "right", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ReassignTxn(ctx, "txn", "wrong")
+	if !errors.Contains(err, ErrInsufficientBalance) {
+		t.Fatalf("Expected %v, got %v", ErrInsufficientBalance, err)
+	}
+
+	// Debits can't be reassigned, otherwise moving the charge would credit
+	// the current sub without checking the balance of the new one.
+	_, err = db.ReassignTxn(ctx, chargeTxnID(subID), "wrong")
+	if !errors.Contains(err, ErrTxnNotReassignable) {
+		t.Fatalf("Expected %v, got %v", ErrTxnNotReassignable, err)
+	}
+	checkBalance("wrong", 3)
+	checkBalance("right", 2)
+
+	// Unknown txns can't be reassigned.
+	_, err = db.ReassignTxn(ctx, "unknown", "right")
+	if !errors.Contains(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+}
+
+// TestOrphanTxns ensures that txns without a user are found while txns of
+// existing users and other domains aren't.
+func TestOrphanTxns(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Credit a user the regular way.
+	ctx := context.Background()
+	_, err = db.CreditUser(ctx, "sub", 10, "txn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphans, err := db.OrphanTxns(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Fatalf("Expected no orphans, got %+v", orphans)
+	}
+
+	// Create a txn without a user, and a user with the same sub in another
+	// domain.
+	_, err = db.NewTxn(ctx, "orphan", "nouser", 5, TxnSourcePayment, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.staticDB.Collection(collUsers).InsertOne(ctx, User{Domain: "other.example.com", Sub: "nouser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphans, err = db.OrphanTxns(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].ID != "orphan" || orphans[0].Sub != "nouser" {
+		t.Fatalf("Expected the orphan txn, got %+v", orphans)
+	}
+}
+
+// TestSoftDeleteTxn ensures that deleted txns no longer affect the balance of
+// their sub and are excluded from listings while they can still be retrieved
+// for auditing.
+func TestSoftDeleteTxn(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+	sub := "sub"
+	for i, amount := range []float64{10, 5, -2, -1} {
+		_, err = db.NewTxn(ctx, fmt.Sprintf("txn%d", i), sub, amount, TxnSourcePayment, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Delete a credit and a debit.
+	if err = db.DeleteTxn(ctx, "txn0"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DeleteTxn(ctx, "txn3"); err != nil {
+		t.Fatal(err)
+	}
+
+	// They no longer affect the balance.
+	credit, spent, net, err := db.BalanceBreakdown(ctx, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credit != 5 || spent != 2 || net != 3 {
+		t.Fatalf("Expected credit 5, spent 2 and net 3, got %v %v %v", credit, spent, net)
+	}
+
+	// They are excluded from listings.
+	debits, total, err := db.ListDebits(ctx, sub, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(debits) != 1 || debits[0].ID != "txn2" {
+		t.Fatalf("Expected only txn2, got %v (total %v)", debits, total)
+	}
+	_, err = db.GetTxn(ctx, "txn0")
+	if !errors.Contains(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+	count := func(filter TxnFilter) int {
+		c, err := db.IterTxns(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for c.Next(ctx) {
+			n++
+		}
+		if err = c.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count(TxnFilter{}); n != 2 {
+		t.Fatalf("Expected 2 txns, got %v", n)
+	}
+
+	// They can still be retrieved for auditing.
+	if n := count(TxnFilter{IncludeDeleted: true}); n != 4 {
+		t.Fatalf("Expected 4 txns, got %v", n)
+	}
+	txn, err := db.GetTxnForAudit(ctx, "txn0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !txn.Deleted || txn.DeletedAt == nil || txn.Amount != 10 {
+		t.Fatalf("Expected a deleted txn, got %+v", txn)
+	}
+
+	// Deleting a txn again fails and crediting it again is a no-op.
+	if err = db.DeleteTxn(ctx, "txn0"); !errors.Contains(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+	if _, err = db.CreditUser(ctx, sub, 10, "txn0", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, _, net, err = db.BalanceBreakdown(ctx, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if net != 3 {
+		t.Fatalf("Expected net 3, got %v", net)
+	}
+}
+
+// TestTxnsAfter ensures that paging through txns with TxnsAfter returns every
+// txn exactly once, including txns which were created at the same time.
+func TestTxnsAfter(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Insert txns directly to control their creation time. Some of them
+	// share it.
+	ctx := context.Background()
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	createdAt := []time.Time{
+		start,
+		start.Add(time.Second),
+		start.Add(time.Second),
+		start.Add(time.Second),
+		start.Add(2 * time.Second),
+		start.Add(3 * time.Second),
+		start.Add(3 * time.Second),
+	}
+	var expected []string
+	for i, ca := range createdAt {
+		txn := Txn{
+			ID:        fmt.Sprintf("txn%d", i),
+			Domain:    db.staticServerDomain,
+			Sub:       "sub",
+			Amount:    1,
+			Source:    TxnSourcePayment,
+			CreatedAt: ca,
+		}
+		if _, err = db.staticDB.Collection(collTnxs).InsertOne(ctx, txn); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, txn.ID)
+	}
+	// A deleted txn is skipped.
+	if err = db.DeleteTxn(ctx, "txn4"); err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected[:4], expected[5:]...)
+
+	// Page through all txns.
+	var pos TxnPosition
+	var ids []string
+	seen := make(map[string]bool)
+	for pages := 0; ; pages++ {
+		if pages > len(createdAt) {
+			t.Fatal("Paging didn't terminate")
+		}
+		txns, err := db.TxnsAfter(ctx, pos, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(txns) == 0 {
+			break
+		}
+		for _, txn := range txns {
+			if seen[txn.ID] {
+				t.Fatalf("Txn %s was returned twice", txn.ID)
+			}
+			seen[txn.ID] = true
+			ids = append(ids, txn.ID)
+		}
+		pos = txns[len(txns)-1].Position()
+	}
+	if strings.Join(ids, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v, got %v", expected, ids)
+	}
+
+	// A timestamp cursor skips all txns created at or before it.
+	txns, err := db.TxnsAfter(ctx, TxnPosition{CreatedAt: start.Add(time.Second)}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 2 || txns[0].ID != "txn5" || txns[1].ID != "txn6" {
+		t.Fatalf("Expected txn5 and txn6, got %v", txns)
+	}
+}
+
+// TestTxnsAfterVisibilityLag ensures that TxnsAfter holds back recent txns, so
+// a txn whose DB transaction commits after a newer txn isn't skipped by
+// pollers.
+func TestTxnsAfterVisibilityLag(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	lag := time.Second
+	db, err := newCustomTestDB(t.Name(), t.Name(), Config{TxnVisibilityLag: lag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Create the older txn within a DB transaction which isn't committed
+	// until the newer txn was created.
+	ctx := context.Background()
+	sess, err := db.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.EndSession(ctx)
+	sctx := mongo.NewSessionContext(ctx, sess)
+	if err = sess.StartTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreditUser(sctx, "sub1", 1, "older", nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err = db.CreditUser(ctx, "sub2", 1, "newer", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The newer txn is committed but not visible yet.
+	txns, err := db.TxnsAfter(ctx, TxnPosition{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 0 {
+		t.Fatalf("Expected no txns, got %v", txns)
+	}
+	if err = sess.CommitTransaction(sctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the lag passed, both txns are returned in order.
+	time.Sleep(2 * lag)
+	txns, err = db.TxnsAfter(ctx, TxnPosition{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 2 || txns[0].ID != "older" || txns[1].ID != "newer" {
+		t.Fatalf("Expected older and newer, got %v", txns)
+	}
+}
@@ -2,64 +2,232 @@ package database
 
 import (
 	"context"
+	"fmt"
 	"gitlab.com/NebulousLabs/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"time"
 )
 
+const (
+	// TxnSourcePayment is the source of txns created for payments.
+	TxnSourcePayment = "payment"
+
+	// TxnSourceSubscription is the source of txns created for subscription
+	// charges.
+	TxnSourceSubscription = "subscription"
+
+	// TxnSourceHold is the source of txns created for captured holds.
+	TxnSourceHold = "hold"
+)
+
 type (
-	// User identifies a portal user by their sub.
+	// User identifies a portal user by their sub. Domain is the server
+	// domain of the portal the user belongs to.
 	User struct {
-		Sub string `bson:"sub"`
+		Domain string `bson:"domain"`
+		Sub    string `bson:"sub"`
 	}
 
-	// Subscription describes a single subscription period.
+	// Subscription describes a single subscription period. PriceHistory
+	// records every price the subscription had before its current one.
 	Subscription struct {
-		ID    primitive.ObjectID `bson:"_id"`
-		Sub   string             `bson:"sub"`
-		Tier  int                `bson:"tier"`
-		From  time.Time          `bson:"from"`
-		To    time.Time          `bson:"to"`
-		Price float64            `bson:"price"`
+		ID           primitive.ObjectID `bson:"_id"`
+		Domain       string             `bson:"domain"`
+		Sub          string             `bson:"sub"`
+		Tier         int                `bson:"tier"`
+		From         time.Time          `bson:"from"`
+		To           time.Time          `bson:"to"`
+		Price        float64            `bson:"price"`
+		PriceHistory []PriceChange      `bson:"priceHistory,omitempty"`
+	}
+
+	// UserBalanceView is the net balance of a sub.
+	UserBalanceView struct {
+		Sub     string  `bson:"_id"`
+		Balance float64 `bson:"balance"`
+	}
+
+	// PriceChange records a previous price of a subscription and when it
+	// was replaced.
+	PriceChange struct {
+		Price     float64   `bson:"price"`
+		ChangedAt time.Time `bson:"changedAt"`
 	}
 
 	// Txn represents a transfer of cryptocurrency with a txn ID and an amount
 	// of credits that the txn's sum amounts to. The conversion is done by the
-	// appropriate payment processor.
+	// appropriate payment processor. Txns with a negative amount are debits,
+	// e.g. subscription charges. Metadata is arbitrary context provided by
+	// the payment processor. Txn IDs are unique within a domain, so
+	// different portals sharing a database can use the same IDs.
+	// Reassignments records every time the txn was moved to another sub.
+	// Deleted txns are kept for auditing but don't count towards balances
+	// and are excluded from listings. DeletedAt is the time of deletion.
 	Txn struct {
-		ID     string  `bson:"_id"`
-		Sub    string  `bson:"sub"`
-		Amount float64 `bson:"amount"` // credits
+		ID            string            `bson:"txnID"`
+		Domain        string            `bson:"domain"`
+		Sub           string            `bson:"sub"`
+		Amount        float64           `bson:"amount"` // credits
+		Source        string            `bson:"source"`
+		Metadata      map[string]string `bson:"metadata,omitempty"`
+		Reassignments []TxnReassignment `bson:"reassignments,omitempty"`
+		CreatedAt     time.Time         `bson:"createdAt"`
+		Deleted       bool              `bson:"deleted,omitempty"`
+		DeletedAt     *time.Time        `bson:"deletedAt,omitempty"`
+	}
+
+	// TxnReassignment records that a txn was moved from one sub to another.
+	TxnReassignment struct {
+		From string    `bson:"from"`
+		To   string    `bson:"to"`
+		At   time.Time `bson:"at"`
 	}
 )
 
 // CreditUser adds the given amount to the user's credit balance and marks the
-// txnID as processed. If the txn is already processed, this is a no-op.
+// txnID as processed. The metadata is stored with the txn. If the txn is
+// already processed, this is a no-op. The returned bool is true if the txn was
+// newly inserted and false if it had been processed before.
 // This method assumes that it's called from within a DB transaction, so when
 // it fails with an error all changes in the DB are automatically rolled back.
-func (db *DB) CreditUser(ctx context.Context, sub string, amount float64, txnID string) error {
-	// Make sure the user exists.
-	_, err := db.NewUser(ctx, sub)
-	if err != nil && !mongo.IsDuplicateKeyError(err) {
-		return errors.AddContext(err, "failed to create user")
+func (db *DB) CreditUser(ctx context.Context, sub string, amount float64, txnID string, metadata map[string]string) (bool, error) {
+	_, inserted, err := db.creditUser(ctx, sub, amount, txnID, metadata)
+	return inserted, err
+}
+
+// creditUser credits the user like CreditUser and returns the txn which
+// records the payment. If the txn had been processed before, that's the
+// existing txn.
+func (db *DB) creditUser(ctx context.Context, sub string, amount float64, txnID string, metadata map[string]string) (*Txn, bool, error) {
+	// Check whether the txn has already been processed before inserting it.
+	// A duplicate key error would abort the surrounding transaction, which
+	// would fail all further reads and writes of the replayed payment. Deleted
+	// txns count as processed since their IDs stay taken.
+	txn, err := db.GetTxnForAudit(ctx, txnID)
+	if err == nil {
+		return txn, false, nil
+	}
+	if !errors.Contains(err, ErrNotFound) {
+		return nil, false, errors.AddContext(err, "failed to look up txn")
+	}
+	// Make sure the user exists. We upsert the user rather than inserting
+	// it since a duplicate key error would abort the surrounding transaction.
+	err = db.ensureUser(ctx, sub)
+	if err != nil {
+		return nil, false, errors.AddContext(err, "failed to create user")
 	}
 	// Register txn.
-	_, err = db.NewTxn(ctx, txnID, sub, amount)
-	if mongo.IsDuplicateKeyError(err) {
-		// This txn has already been processed, nothing to do.
-		return nil
+	txn, err = db.NewTxn(ctx, txnID, sub, amount, TxnSourcePayment, metadata)
+	if errors.Contains(err, ErrDuplicateTxn) {
+		// This txn has been processed concurrently, nothing to do.
+		txn, err = db.GetTxnForAudit(ctx, txnID)
+		if err != nil {
+			return nil, false, errors.AddContext(err, "failed to look up txn")
+		}
+		return txn, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.AddContext(err, "failed to register txn")
+	}
+	return txn, true, nil
+}
+
+// CreditUserWithBalance credits the user like CreditUser and returns the
+// credited amount, the user's resulting total balance as well as whether the
+// txn was newly inserted. If the txn had been processed before, the credited
+// amount is the one stored with it. The user is touched before the balance is
+// read, so concurrent credits of the same user run into a WriteConflict and
+// are retried instead of all returning the balance from before the others'
+// credits.
+// This method assumes that it's called from within a DB transaction, so when
+// it fails with an error all changes in the DB are automatically rolled back.
+func (db *DB) CreditUserWithBalance(ctx context.Context, sub string, amount float64, txnID string, metadata map[string]string) (credited, balance float64, inserted bool, err error) {
+	txn, inserted, err := db.creditUser(ctx, sub, amount, txnID, metadata)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	err = db.touchUser(ctx, sub)
+	if err != nil {
+		return 0, 0, false, errors.AddContext(err, "failed to update user")
+	}
+	balance, _, err = db.UserBalance(ctx, sub)
+	if err != nil {
+		return 0, 0, false, errors.AddContext(err, "failed to fetch balance")
+	}
+	return txn.Amount, balance, inserted, nil
+}
+
+// ChargeSubscription debits the price of the subscription with the given ID
+// from the balance of its user. Every subscription can only be charged once,
+// so charging it again is a no-op. If the user's balance doesn't cover the
+// price, the configured NegativeBalancePolicy applies. If the subscription
+// doesn't exist, ErrNotFound is returned.
+// This method assumes that it's called from within a DB transaction, so when
+// it fails with an error all changes in the DB are automatically rolled back.
+func (db *DB) ChargeSubscription(ctx context.Context, subID primitive.ObjectID) error {
+	s, err := db.GetSubscription(ctx, subID)
+	if err != nil {
+		return errors.AddContext(err, "failed to look up subscription")
+	}
+	sub, price := s.Sub, s.Price
+	if !validPrice(price) {
+		return ErrInvalidPrice
+	}
+	// Check whether the subscription has already been charged. In that case
+	// there is nothing to do. This needs to happen before the balance check
+	// since the balance already reflects the charge. Deleted charges count
+	// as well since their IDs stay taken.
+	txn, err := db.GetTxnForAudit(ctx, chargeTxnID(subID))
+	if err == nil {
+		return checkChargeTxn(txn, sub)
+	}
+	if !errors.Contains(err, ErrNotFound) {
+		return errors.AddContext(err, "failed to look up charge")
+	}
+	err = db.touchUser(ctx, sub)
+	if err != nil {
+		return errors.AddContext(err, "failed to update user")
+	}
+	_, available, err := db.UserBalance(ctx, sub)
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch balance")
+	}
+	if err = db.checkSpend(sub, available, price); err != nil {
+		return err
+	}
+	// Register the charge as a debit txn.
+	_, err = db.NewTxn(ctx, chargeTxnID(subID), sub, -price, TxnSourceSubscription, nil)
+	if errors.Contains(err, ErrDuplicateTxn) {
+		// This subscription has been charged concurrently.
+		txn, err = db.GetTxnForAudit(ctx, chargeTxnID(subID))
+		if err != nil {
+			return errors.AddContext(err, "failed to look up charge")
+		}
+		return checkChargeTxn(txn, sub)
 	}
 	if err != nil {
-		return errors.AddContext(err, "failed to register txn")
+		return errors.AddContext(err, "failed to register charge")
 	}
 	return nil
 }
 
-// NewUser creates a new user with the given sub.
+// checkChargeTxn makes sure that the txn which took the charge's ID is a
+// charge of the given sub. Otherwise, the subscription hasn't been charged
+// and ErrDuplicateTxn is returned.
+func checkChargeTxn(txn *Txn, sub string) error {
+	if txn.Source != TxnSourceSubscription || txn.Sub != sub {
+		return ErrDuplicateTxn
+	}
+	return nil
+}
+
+// NewUser creates a new user with the given sub. If the user exists already,
+// a duplicate key error is returned.
 func (db *DB) NewUser(ctx context.Context, sub string) (*User, error) {
-	u := &User{Sub: sub}
+	u := &User{Domain: db.staticServerDomain, Sub: sub}
 	_, err := db.staticDB.Collection(collUsers).InsertOne(ctx, u)
 	if err != nil {
 		return nil, err
@@ -67,83 +235,142 @@ func (db *DB) NewUser(ctx context.Context, sub string) (*User, error) {
 	return u, nil
 }
 
-// NewTxn creates a new txn in the DB.
-func (db *DB) NewTxn(ctx context.Context, id string, sub string, amount float64) (*Txn, error) {
+// ensureUser creates the user with the given sub if it doesn't exist yet.
+func (db *DB) ensureUser(ctx context.Context, sub string) error {
+	opts := options.Update().SetUpsert(true)
+	_, err := db.staticDB.Collection(collUsers).UpdateOne(ctx, db.scoped(bson.D{{"sub", sub}}), bson.M{
+		"$setOnInsert": bson.M{"sub": sub},
+	}, opts)
+	return err
+}
+
+// touchUser updates the user to make concurrent spending of the same user's
+// credits run into a WriteConflict. Otherwise, two transactions could both see
+// a sufficient balance and overdraw it together.
+func (db *DB) touchUser(ctx context.Context, sub string) error {
+	_, err := db.staticDB.Collection(collUsers).UpdateOne(ctx, db.scoped(bson.D{{"sub", sub}}), bson.M{
+		"$set": bson.M{"lastCharge": time.Now().UTC()},
+	})
+	return err
+}
+
+// GetUser returns the user with the given sub. If the user doesn't exist,
+// ErrNotFound is returned.
+func (db *DB) GetUser(ctx context.Context, sub string) (*User, error) {
+	var u User
+	err := db.staticDB.Collection(collUsers).FindOne(ctx, db.scoped(bson.D{{"sub", sub}})).Decode(&u)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// NewTxn creates a new txn in the DB. The metadata is optional. If a txn with
+// the same ID exists already, ErrDuplicateTxn is returned.
+func (db *DB) NewTxn(ctx context.Context, id string, sub string, amount float64, source string, metadata map[string]string) (*Txn, error) {
 	txn := &Txn{
-		ID:     id,
-		Sub:    sub,
-		Amount: amount,
+		ID:        id,
+		Domain:    db.staticServerDomain,
+		Sub:       sub,
+		Amount:    amount,
+		Source:    source,
+		Metadata:  metadata,
+		CreatedAt: time.Now().UTC(),
 	}
 	_, err := db.staticDB.Collection(collTnxs).InsertOne(ctx, txn)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrDuplicateTxn
+	}
 	if err != nil {
 		return nil, err
 	}
 	return txn, nil
 }
 
-// UserBalance returns the current balance of credits for the given sub.
-func (db *DB) UserBalance(ctx context.Context, sub string) (float64, error) {
-	credit, err := db.userCredit(ctx, sub)
+// chargeTxnID returns the ID of the txn which records the charge of the
+// subscription with the given ID.
+func chargeTxnID(subID primitive.ObjectID) string {
+	return chargeTxnIDPrefix + subID.Hex()
+}
+
+// UserBalance returns the current balance of credits for the given sub. Total
+// is the net balance of all txns while available is the part of it which
+// isn't reserved by active holds.
+func (db *DB) UserBalance(ctx context.Context, sub string) (total, available float64, err error) {
+	_, _, total, err = db.BalanceBreakdown(ctx, sub)
 	if err != nil {
-		return 0, errors.AddContext(err, "failed to calculate the total amount of credit")
+		return 0, 0, err
 	}
-	spent, err := db.userSpent(ctx, sub)
+	held, err := db.heldCredits(ctx, sub)
 	if err != nil {
-		return 0, errors.AddContext(err, "failed to calculate the total amount spent")
+		return 0, 0, err
 	}
-	return credit - spent, nil
+	return total, total - held, nil
 }
 
-// userCredit returns the total amount of credits ever credited to this sub.
-func (db *DB) userCredit(ctx context.Context, sub string) (float64, error) {
-	match := bson.D{{"$match", bson.D{{"sub", sub}}}}
+// TopBalances returns the n subs with the highest net balances in descending
+// order. Subs with the same balance are ordered by sub.
+func (db *DB) TopBalances(ctx context.Context, n int) ([]UserBalanceView, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("n must be positive, got %d", n)
+	}
+	match := bson.D{{"$match", db.scopedTxns(bson.D{})}}
 	group := bson.D{{
 		"$group", bson.D{
-			{"_id", bson.D{{"sub", "$sub"}}},
-			{"credit", bson.D{{"$sum", "$amount"}}},
+			{"_id", "$sub"},
+			{"balance", bson.D{{"$sum", "$amount"}}},
 		},
 	}}
-	c, err := db.staticDB.Collection(collTnxs).Aggregate(ctx, mongo.Pipeline{match, group})
+	sort := bson.D{{"$sort", bson.D{{"balance", -1}, {"_id", 1}}}}
+	limit := bson.D{{"$limit", n}}
+	c, err := db.staticDB.Collection(collTnxs).Aggregate(ctx, mongo.Pipeline{match, group, sort, limit})
 	if err != nil {
-		return 0, err
+		return nil, errors.AddContext(err, "failed to calculate balances")
 	}
-	txns := struct {
-		Credit float64 `bson:"credit"`
-	}{}
-	// We only parse if we have a result. If we don't have a result, that means
-	// that there are no txns and the total credit is zero.
-	if c.Next(ctx) {
-		err = c.Decode(&txns)
-		if err != nil {
-			return 0, err
-		}
+	balances := make([]UserBalanceView, 0, n)
+	err = c.All(ctx, &balances)
+	if err != nil {
+		return nil, err
 	}
-	return txns.Credit, nil
+	return balances, nil
 }
 
-// userSpent returns the total amount of credits ever spent by this sub.
-func (db *DB) userSpent(ctx context.Context, sub string) (float64, error) {
-	match := bson.D{{"$match", bson.D{{"sub", sub}}}}
+// BalanceBreakdown returns the components of the given sub's balance. Credit
+// is the total amount of credits ever credited to the sub, spent is the total
+// amount of credits ever spent by the sub, i.e. the sum of all its debit txns,
+// and net is the resulting balance.
+func (db *DB) BalanceBreakdown(ctx context.Context, sub string) (credit, spent, net float64, err error) {
+	match := bson.D{{"$match", db.scopedTxns(bson.D{{"sub", sub}})}}
 	group := bson.D{{
 		"$group", bson.D{
-			{"_id", bson.D{{"sub", "$sub"}}},
-			{"spent", bson.D{{"$sum", "$price"}}},
+			{"_id", "$sub"},
+			{"credit", bson.D{{"$sum", bson.D{{"$cond", bson.A{
+				bson.D{{"$gt", bson.A{"$amount", 0}}}, "$amount", 0,
+			}}}}}},
+			{"spent", bson.D{{"$sum", bson.D{{"$cond", bson.A{
+				bson.D{{"$lt", bson.A{"$amount", 0}}}, bson.D{{"$multiply", bson.A{"$amount", -1}}}, 0,
+			}}}}}},
 		},
 	}}
 	c, err := db.staticDB.Collection(collTnxs).Aggregate(ctx, mongo.Pipeline{match, group})
 	if err != nil {
-		return 0, err
+		return 0, 0, 0, errors.AddContext(err, "failed to calculate balance")
 	}
-	subs := struct {
-		Spent float64 `bson:"spent"`
+	defer func() { _ = c.Close(ctx) }()
+	balance := struct {
+		Credit float64 `bson:"credit"`
+		Spent  float64 `bson:"spent"`
 	}{}
 	// We only parse if we have a result. If we don't have a result, that means
-	// that there are no txns and the total spent amount is zero.
+	// that there are no txns and the balance is zero.
 	if c.Next(ctx) {
-		err = c.Decode(&subs)
+		err = c.Decode(&balance)
 		if err != nil {
-			return 0, err
+			return 0, 0, 0, err
 		}
 	}
-	return subs.Spent, nil
+	return balance.Credit, balance.Spent, balance.Credit - balance.Spent, nil
 }
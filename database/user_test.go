@@ -0,0 +1,295 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestChargeSubscription is a unit test for ChargeSubscription.
+func TestChargeSubscription(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+	sub := "sub"
+	_, err = db.CreditUser(ctx, sub, 10, "txn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Charge a subscription the user can afford.
+	subID, err := newTestCharge(ctx, db, sub, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance, _, err := db.UserBalance(ctx, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 3 {
+		t.Fatalf("Expected balance 3, got %v", balance)
+	}
+
+	// Charging the same subscription again is a no-op.
+	err = db.ChargeSubscription(ctx, subID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance, _, err = db.UserBalance(ctx, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 3 {
+		t.Fatalf("Expected balance 3, got %v", balance)
+	}
+
+	// Charge a subscription the user can't afford.
+	_, err = newTestCharge(ctx, db, sub, 5)
+	if !errors.Contains(err, ErrInsufficientBalance) {
+		t.Fatalf("Expected %v, got %v", ErrInsufficientBalance, err)
+	}
+	balance, _, err = db.UserBalance(ctx, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 3 {
+		t.Fatalf("Expected balance 3, got %v", balance)
+	}
+
+	// Subscriptions which don't exist can't be charged.
+	err = db.ChargeSubscription(ctx, primitive.NewObjectID())
+	if !errors.Contains(err, ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	// A payment which took the ID of the charge doesn't count as the charge.
+	now := time.Now()
+	s, err := db.NewSubscription(ctx, sub, 2, now, now.Add(time.Hour), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreditUser(ctx, sub, 1, chargeTxnID(s.ID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.ChargeSubscription(ctx, s.ID)
+	if !errors.Contains(err, ErrDuplicateTxn) {
+		t.Fatalf("Expected %v, got %v", ErrDuplicateTxn, err)
+	}
+}
+
+// TestBalanceBreakdown ensures that the components of a balance are
+// consistent with each other and with UserBalance.
+func TestBalanceBreakdown(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+	sub := "sub"
+
+	// checkBreakdown checks the balance components of the sub.
+	checkBreakdown := func(expectedCredit, expectedSpent float64) {
+		t.Helper()
+		credit, spent, net, err := db.BalanceBreakdown(ctx, sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if credit != expectedCredit || spent != expectedSpent {
+			t.Fatalf("Expected credit %v and spent %v, got %v and %v", expectedCredit, expectedSpent, credit, spent)
+		}
+		if net != credit-spent {
+			t.Fatalf("Expected net %v, got %v", credit-spent, net)
+		}
+		balance, _, err := db.UserBalance(ctx, sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance != net {
+			t.Fatalf("Expected balance %v, got %v", net, balance)
+		}
+	}
+
+	// No txns.
+	checkBreakdown(0, 0)
+
+	// Seed credits and debits for the sub and another sub.
+	for i, amount := range []float64{10, 20, 5} {
+		_, err = db.CreditUser(ctx, sub, amount, fmt.Sprintf("txn%d", i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreditUser(ctx, "othersub", amount, fmt.Sprintf("othertxn%d", i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkBreakdown(35, 0)
+	for _, price := range []float64{7, 3} {
+		_, err = newTestCharge(ctx, db, sub, price)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkBreakdown(35, 10)
+}
+
+// TestCreditUserWithBalance ensures that the balance returned after crediting
+// a user matches an independent recomputation.
+func TestCreditUserWithBalance(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+	sub := "sub"
+	var expected float64
+	for i, amount := range []float64{10, 2.5, 7} {
+		expected += amount
+		credited, balance, inserted, err := db.CreditUserWithBalance(ctx, sub, amount, fmt.Sprintf("txn%d", i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if credited != amount {
+			t.Fatalf("Expected %v to be credited, got %v", amount, credited)
+		}
+		if !inserted {
+			t.Fatal("Expected txn to be inserted")
+		}
+		total, _, err := db.UserBalance(ctx, sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance != expected || balance != total {
+			t.Fatalf("Expected balance %v, got %v and recomputed %v", expected, balance, total)
+		}
+	}
+
+	// Crediting the same txn again doesn't change the balance. The amount
+	// of the original txn is returned.
+	credited, balance, inserted, err := db.CreditUserWithBalance(ctx, sub, 20, "txn0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credited != 10 {
+		t.Fatalf("Expected the original amount 10, got %v", credited)
+	}
+	if inserted {
+		t.Fatal("Expected txn to be reported as already processed")
+	}
+	if balance != expected {
+		t.Fatalf("Expected balance %v, got %v", expected, balance)
+	}
+}
+
+// TestTopBalances is a unit test for TopBalances.
+func TestTopBalances(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	db, err := newTestDB(t.Name(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := dropTestDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Seed users with distinct balances. "c" and "d" tie and "e" spent some
+	// of its credits.
+	ctx := context.Background()
+	txns := []struct {
+		sub    string
+		amount float64
+	}{
+		{"a", 5},
+		{"b", 50},
+		{"d", 20},
+		{"c", 20},
+		{"e", 40},
+		{"e", -30},
+		{"f", 1},
+	}
+	for i, txn := range txns {
+		_, err = db.NewTxn(ctx, fmt.Sprintf("txn%d", i), txn.sub, txn.amount, TxnSourcePayment, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	balances, err := db.TopBalances(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []UserBalanceView{
+		{"b", 50},
+		{"c", 20},
+		{"d", 20},
+		{"e", 10},
+	}
+	if len(balances) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, balances)
+	}
+	for i := range expected {
+		if balances[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, balances)
+		}
+	}
+
+	// Asking for more than there are returns all of them.
+	balances, err = db.TopBalances(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != 6 {
+		t.Fatalf("Expected 6 balances, got %v", balances)
+	}
+
+	// n needs to be positive.
+	if _, err = db.TopBalances(ctx, 0); err == nil {
+		t.Fatal("Expected an error for n = 0")
+	}
+}
@@ -3,9 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -28,14 +34,53 @@ type (
 		ServerDomain string
 		AccountsHost string
 		AccountsPort string
+
+		AllowedSubs      []string
+		AllowTxnDeletion bool
+		APIKey           string
+		BasePath         string
+		CreditRounding   api.RoundingPolicy
+		DisabledFeatures []string
+		Expvar           bool
+		HoldTTL          time.Duration
+		IndexWorkers     int
+		LogBodies        bool
+		LogBodiesRedact  []string
+		MaxDBSessions    int
+		MaxRequests      int
+		MaxLimit         int64
+		MaxPaymentAge    time.Duration
+		MaxTopBalances   int
+		PaymentCacheSize int
+		PaymentCacheTTL  time.Duration
+		DuplicateStatus  bool
+		NegativeBalance  database.NegativeBalancePolicy
+		DBPingTimeout    time.Duration
+		AnomalyThreshold float64
+		AnomalyWindow    time.Duration
+		WorkerStall      int
+		FuturePricesOnly bool
+		SlowQuery        time.Duration
+		TxnLag           time.Duration
+		LegacyDomain     string
+		ReadOnly         bool
+		ShutdownTimeout  time.Duration
+		Tiers            database.TierConfig
+		AccessLogFormat  api.AccessLogFormat
+		AccessLogFile    string
 	}
 )
 
 const (
-	// envAPIShutdownTimeout is the timeout for gracefully shutting down the
-	// API before killing it.
+	// envAPIShutdownTimeout is the default timeout for gracefully shutting
+	// down the API before in-flight calls are aborted.
 	envAPIShutdownTimeout = 20 * time.Second
 
+	// envShutdownTimeout is the environment variable for the timeout for
+	// gracefully shutting down the API, e.g. "20s". In-flight calls which
+	// don't finish within the timeout are aborted.
+	envShutdownTimeout = "PROMOTER_SHUTDOWN_TIMEOUT"
+
 	// envAccountsHost is the environment variable for the host where we can
 	// find the accounts service.
 	envAccountsHost = "ACCOUNTS_HOST"
@@ -44,6 +89,156 @@ const (
 	// find the accounts service.
 	envAccountsPort = "ACCOUNTS_PORT"
 
+	// envAccessLogFormat is the environment variable for the format of
+	// access logs. Either "common" or "combined". Access logs are disabled
+	// if it's not set.
+	envAccessLogFormat = "PROMOTER_ACCESS_LOG_FORMAT"
+
+	// envAccessLogFile is the environment variable for the file access logs
+	// are appended to. Access logs are written to stdout if it's not set.
+	envAccessLogFile = "PROMOTER_ACCESS_LOG_FILE"
+
+	// envAllowedSubs is the environment variable for the comma-separated
+	// list of glob patterns of subs which are allowed to receive payments.
+	envAllowedSubs = "PROMOTER_ALLOWED_SUBS"
+
+	// envAllowTxnDeletion is the environment variable for enabling the
+	// DELETE /txn/:id route. This must never be enabled in production.
+	envAllowTxnDeletion = "PROMOTER_ALLOW_TXN_DELETION"
+
+	// envAPIKey is the environment variable for the API key required by
+	// authenticated routes.
+	envAPIKey = "PROMOTER_API_KEY"
+
+	// envBasePath is the environment variable for the prefix all routes are
+	// registered under, e.g. "/promoter".
+	envBasePath = "PROMOTER_BASE_PATH"
+
+	// envCreditRoundingMode is the environment variable for the mode used
+	// to round incoming credits. One of 'nearest', 'down' or 'up'.
+	envCreditRoundingMode = "PROMOTER_CREDIT_ROUNDING_MODE"
+
+	// envCreditRoundingPlaces is the environment variable for the number of
+	// decimal places incoming credits are rounded to, between 0 and
+	// api.MaxRoundingPlaces.
+	envCreditRoundingPlaces = "PROMOTER_CREDIT_ROUNDING_PLACES"
+
+	// envDisabledFeatures is the environment variable for the
+	// comma-separated list of API features to disable.
+	envDisabledFeatures = "PROMOTER_DISABLED_FEATURES"
+
+	// envExpvar is the environment variable for enabling the /debug/vars
+	// endpoint.
+	envExpvar = "PROMOTER_EXPVAR"
+
+	// envLogBodies is the environment variable for enabling the logging of
+	// request and response bodies at Trace level.
+	envLogBodies = "PROMOTER_LOG_BODIES"
+
+	// envLogBodiesRedact is the environment variable for the comma-separated
+	// list of JSON fields to redact when logging bodies.
+	envLogBodiesRedact = "PROMOTER_LOG_BODIES_REDACT"
+
+	// envHoldTTL is the environment variable for the time after which
+	// holds expire, e.g. "15m".
+	envHoldTTL = "PROMOTER_HOLD_TTL"
+
+	// envIndexWorkers is the environment variable for the number of
+	// collections whose indexes are built concurrently on startup.
+	envIndexWorkers = "PROMOTER_INDEX_WORKERS"
+
+	// envMaxDBSessions is the environment variable for the maximum number
+	// of concurrent database sessions opened by the API.
+	envMaxDBSessions = "PROMOTER_MAX_DB_SESSIONS"
+
+	// envMaxConcurrentRequests is the environment variable for the maximum
+	// number of requests handled concurrently by the API.
+	envMaxConcurrentRequests = "PROMOTER_MAX_CONCURRENT_REQUESTS"
+
+	// envMaxLimit is the environment variable for the maximum number of
+	// items returned by list endpoints.
+	envMaxLimit = "PROMOTER_MAX_LIMIT"
+
+	// envMaxTopBalances is the environment variable for the maximum number
+	// of subs returned by /stats/top.
+	envMaxTopBalances = "PROMOTER_MAX_TOP_BALANCES"
+
+	// envMaxPaymentAge is the environment variable for the maximum age of
+	// payments based on the timestamp in their metadata, e.g. "24h".
+	// Older payments are rejected. The check is disabled if it's not set.
+	envMaxPaymentAge = "PROMOTER_MAX_PAYMENT_AGE"
+
+	// envPaymentCacheSize is the environment variable for the number of
+	// recently completed payments which are cached. The cache is disabled if
+	// it's not set.
+	envPaymentCacheSize = "PROMOTER_PAYMENT_CACHE_SIZE"
+
+	// envPaymentCacheTTL is the environment variable for the time a
+	// completed payment stays in the payment cache, e.g. "10s".
+	envPaymentCacheTTL = "PROMOTER_PAYMENT_CACHE_TTL"
+
+	// envAlreadyReportedStatus is the environment variable for answering
+	// payments which were already processed with a 208 instead of a 200.
+	envAlreadyReportedStatus = "PROMOTER_DUPLICATE_PAYMENT_STATUS"
+
+	// envAnomalyThreshold is the environment variable for the amount of
+	// credits a sub may receive within the anomaly window before it's
+	// flagged. The anomaly detector is disabled if it's not set.
+	envAnomalyThreshold = "PROMOTER_ANOMALY_THRESHOLD"
+
+	// envAnomalyWindow is the environment variable for the window over
+	// which the anomaly detector sums up credits, e.g. "1h".
+	envAnomalyWindow = "PROMOTER_ANOMALY_WINDOW"
+
+	// envWorkerStallMultiple is the environment variable for the number of
+	// intervals a background worker may miss its heartbeat before /status
+	// reports it as unhealthy.
+	envWorkerStallMultiple = "PROMOTER_WORKER_STALL_MULTIPLE"
+
+	// envSlowQueryThreshold is the environment variable for the duration
+	// above which database commands are logged as slow queries, e.g.
+	// "500ms". The slow query log is disabled if it's not set.
+	envSlowQueryThreshold = "PROMOTER_SLOW_QUERY_THRESHOLD"
+
+	// envTxnVisibilityLag is the environment variable for the time after
+	// its creation before a txn is returned by /txns/since, e.g. "10s".
+	envTxnVisibilityLag = "PROMOTER_TXN_VISIBILITY_LAG"
+
+	// envLegacyDomain is the environment variable for the domain which
+	// documents from before data was scoped to server domains are assigned
+	// to. They are left alone if it's not set.
+	envLegacyDomain = "PROMOTER_LEGACY_DOMAIN"
+
+	// envFuturePriceUpdatesOnly is the environment variable for restricting
+	// price updates to subscriptions which haven't started yet.
+	envFuturePriceUpdatesOnly = "PROMOTER_FUTURE_PRICE_UPDATES_ONLY"
+
+	// envReadOnly is the environment variable for putting the API into
+	// read-only mode, e.g. during database maintenance.
+	envReadOnly = "PROMOTER_READ_ONLY"
+
+	// envDefaultTier is the environment variable for the tier of users
+	// without an active subscription.
+	envDefaultTier = "PROMOTER_DEFAULT_TIER"
+
+	// envTierGracePeriod is the environment variable for the time for which
+	// a subscription still counts as active after it ended, e.g. "72h".
+	envTierGracePeriod = "PROMOTER_TIER_GRACE_PERIOD"
+
+	// envTierPrices is the environment variable for the prices of
+	// subscribing to the tiers as a comma-separated list of tier:price
+	// pairs, e.g. "2:5,3:20".
+	envTierPrices = "PROMOTER_TIER_PRICES"
+
+	// envDBPingTimeout is the environment variable for the time after which
+	// a health check of the database is considered failed, e.g. "2s".
+	envDBPingTimeout = "PROMOTER_DB_PING_TIMEOUT"
+
+	// envNegativeBalancePolicy is the environment variable for the policy
+	// applied to operations which would drive a balance below zero. One of
+	// "block", "allow" or "warn".
+	envNegativeBalancePolicy = "PROMOTER_NEGATIVE_BALANCE_POLICY"
+
 	// envMongoDBURI is the environment variable for the mongodb URI.
 	envMongoDBURI = "MONGODB_URI"
 
@@ -69,6 +264,9 @@ func parseConfig() (*config, error) {
 		LogLevel:     logrus.InfoLevel,
 		AccountsHost: "10.10.10.70",
 		AccountsPort: "3000",
+
+		ShutdownTimeout: envAPIShutdownTimeout,
+		LogBodiesRedact: []string{"auth", "authorization", "password", "token"},
 	}
 
 	// Parse custom vars from environment.
@@ -106,9 +304,295 @@ func parseConfig() (*config, error) {
 	if !ok {
 		return nil, fmt.Errorf("%s wasn't specified", envAccountsPort)
 	}
+	allowedSubsStr, ok := os.LookupEnv(envAllowedSubs)
+	if ok {
+		cfg.AllowedSubs = splitList(allowedSubsStr)
+		for _, pattern := range cfg.AllowedSubs {
+			if _, err = path.Match(pattern, ""); err != nil {
+				return nil, errors.AddContext(err, fmt.Sprintf("invalid pattern '%s' in %s", pattern, envAllowedSubs))
+			}
+		}
+	}
+	allowTxnDeletionStr, ok := os.LookupEnv(envAllowTxnDeletion)
+	if ok {
+		cfg.AllowTxnDeletion, err = strconv.ParseBool(allowTxnDeletionStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envAllowTxnDeletion)
+		}
+	}
+	cfg.APIKey = os.Getenv(envAPIKey)
+	cfg.BasePath = os.Getenv(envBasePath)
+	creditRoundingPlacesStr, ok := os.LookupEnv(envCreditRoundingPlaces)
+	if ok {
+		cfg.CreditRounding.Places, err = api.ParseRoundingPlaces(creditRoundingPlacesStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envCreditRoundingPlaces)
+		}
+		cfg.CreditRounding.Mode = api.RoundingNearest
+	}
+	creditRoundingModeStr, ok := os.LookupEnv(envCreditRoundingMode)
+	if ok {
+		cfg.CreditRounding.Mode, err = api.ParseRoundingMode(creditRoundingModeStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envCreditRoundingMode)
+		}
+	}
+	disabledFeaturesStr, ok := os.LookupEnv(envDisabledFeatures)
+	if ok {
+		cfg.DisabledFeatures = splitList(disabledFeaturesStr)
+		for _, f := range cfg.DisabledFeatures {
+			if !containsString(api.Features(), f) {
+				return nil, fmt.Errorf("unknown feature '%s' in %s, must be one of %v", f, envDisabledFeatures, api.Features())
+			}
+		}
+	}
+	expvarStr, ok := os.LookupEnv(envExpvar)
+	if ok {
+		cfg.Expvar, err = strconv.ParseBool(expvarStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envExpvar)
+		}
+	}
+	logBodiesStr, ok := os.LookupEnv(envLogBodies)
+	if ok {
+		cfg.LogBodies, err = strconv.ParseBool(logBodiesStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envLogBodies)
+		}
+	}
+	logBodiesRedactStr, ok := os.LookupEnv(envLogBodiesRedact)
+	if ok {
+		cfg.LogBodiesRedact = splitList(logBodiesRedactStr)
+	}
+	holdTTLStr, ok := os.LookupEnv(envHoldTTL)
+	if ok {
+		cfg.HoldTTL, err = time.ParseDuration(holdTTLStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envHoldTTL)
+		}
+	}
+	indexWorkersStr, ok := os.LookupEnv(envIndexWorkers)
+	if ok {
+		cfg.IndexWorkers, err = strconv.Atoi(indexWorkersStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envIndexWorkers)
+		}
+	}
+	maxDBSessionsStr, ok := os.LookupEnv(envMaxDBSessions)
+	if ok {
+		cfg.MaxDBSessions, err = strconv.Atoi(maxDBSessionsStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envMaxDBSessions)
+		}
+	}
+	maxRequestsStr, ok := os.LookupEnv(envMaxConcurrentRequests)
+	if ok {
+		cfg.MaxRequests, err = strconv.Atoi(maxRequestsStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envMaxConcurrentRequests)
+		}
+	}
+	maxLimitStr, ok := os.LookupEnv(envMaxLimit)
+	if ok {
+		cfg.MaxLimit, err = strconv.ParseInt(maxLimitStr, 10, 64)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envMaxLimit)
+		}
+	}
+	maxTopBalancesStr, ok := os.LookupEnv(envMaxTopBalances)
+	if ok {
+		cfg.MaxTopBalances, err = strconv.Atoi(maxTopBalancesStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envMaxTopBalances)
+		}
+	}
+	maxPaymentAgeStr, ok := os.LookupEnv(envMaxPaymentAge)
+	if ok {
+		cfg.MaxPaymentAge, err = time.ParseDuration(maxPaymentAgeStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envMaxPaymentAge)
+		}
+	}
+	paymentCacheSizeStr, ok := os.LookupEnv(envPaymentCacheSize)
+	if ok {
+		cfg.PaymentCacheSize, err = strconv.Atoi(paymentCacheSizeStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envPaymentCacheSize)
+		}
+	}
+	paymentCacheTTLStr, ok := os.LookupEnv(envPaymentCacheTTL)
+	if ok {
+		cfg.PaymentCacheTTL, err = time.ParseDuration(paymentCacheTTLStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envPaymentCacheTTL)
+		}
+	}
+	duplicatePaymentStatusStr, ok := os.LookupEnv(envAlreadyReportedStatus)
+	if ok {
+		cfg.DuplicateStatus, err = strconv.ParseBool(duplicatePaymentStatusStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envAlreadyReportedStatus)
+		}
+	}
+	dbPingTimeoutStr, ok := os.LookupEnv(envDBPingTimeout)
+	if ok {
+		cfg.DBPingTimeout, err = time.ParseDuration(dbPingTimeoutStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envDBPingTimeout)
+		}
+	}
+	negativeBalanceStr, ok := os.LookupEnv(envNegativeBalancePolicy)
+	if ok {
+		cfg.NegativeBalance, err = database.ParseNegativeBalancePolicy(negativeBalanceStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envNegativeBalancePolicy)
+		}
+	}
+	anomalyThresholdStr, ok := os.LookupEnv(envAnomalyThreshold)
+	if ok {
+		cfg.AnomalyThreshold, err = strconv.ParseFloat(anomalyThresholdStr, 64)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envAnomalyThreshold)
+		}
+	}
+	anomalyWindowStr, ok := os.LookupEnv(envAnomalyWindow)
+	if ok {
+		cfg.AnomalyWindow, err = time.ParseDuration(anomalyWindowStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envAnomalyWindow)
+		}
+	}
+	workerStallStr, ok := os.LookupEnv(envWorkerStallMultiple)
+	if ok {
+		cfg.WorkerStall, err = strconv.Atoi(workerStallStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envWorkerStallMultiple)
+		}
+	}
+	slowQueryStr, ok := os.LookupEnv(envSlowQueryThreshold)
+	if ok {
+		cfg.SlowQuery, err = time.ParseDuration(slowQueryStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envSlowQueryThreshold)
+		}
+	}
+	txnLagStr, ok := os.LookupEnv(envTxnVisibilityLag)
+	if ok {
+		cfg.TxnLag, err = time.ParseDuration(txnLagStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envTxnVisibilityLag)
+		}
+	}
+	futurePricesOnlyStr, ok := os.LookupEnv(envFuturePriceUpdatesOnly)
+	if ok {
+		cfg.FuturePricesOnly, err = strconv.ParseBool(futurePricesOnlyStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envFuturePriceUpdatesOnly)
+		}
+	}
+	readOnlyStr, ok := os.LookupEnv(envReadOnly)
+	if ok {
+		cfg.ReadOnly, err = strconv.ParseBool(readOnlyStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envReadOnly)
+		}
+	}
+	shutdownTimeoutStr, ok := os.LookupEnv(envShutdownTimeout)
+	if ok {
+		cfg.ShutdownTimeout, err = time.ParseDuration(shutdownTimeoutStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envShutdownTimeout)
+		}
+	}
+	defaultTierStr, ok := os.LookupEnv(envDefaultTier)
+	if ok {
+		cfg.Tiers.DefaultTier, err = strconv.Atoi(defaultTierStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envDefaultTier)
+		}
+	}
+	tierGracePeriodStr, ok := os.LookupEnv(envTierGracePeriod)
+	if ok {
+		cfg.Tiers.GracePeriod, err = time.ParseDuration(tierGracePeriodStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envTierGracePeriod)
+		}
+	}
+	tierPricesStr, ok := os.LookupEnv(envTierPrices)
+	if ok {
+		cfg.Tiers.Prices, err = parseTierPrices(tierPricesStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envTierPrices)
+		}
+	}
+	accessLogFormatStr, ok := os.LookupEnv(envAccessLogFormat)
+	if ok {
+		cfg.AccessLogFormat, err = api.ParseAccessLogFormat(accessLogFormatStr)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to parse "+envAccessLogFormat)
+		}
+	}
+	cfg.AccessLogFile = os.Getenv(envAccessLogFile)
+	cfg.LegacyDomain = os.Getenv(envLegacyDomain)
 	return cfg, nil
 }
 
+// splitList splits a comma-separated list into its trimmed, non-empty
+// elements.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// parseTierPrices parses a comma-separated list of tier:price pairs.
+func parseTierPrices(s string) (map[int]float64, error) {
+	prices := make(map[int]float64)
+	for _, e := range splitList(s) {
+		tierStr, priceStr, ok := strings.Cut(e, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid tier price '%s'", e)
+		}
+		tier, err := strconv.Atoi(strings.TrimSpace(tierStr))
+		if err != nil {
+			return nil, errors.AddContext(err, "invalid tier")
+		}
+		price, err := strconv.ParseFloat(strings.TrimSpace(priceStr), 64)
+		if err != nil {
+			return nil, errors.AddContext(err, "invalid price")
+		}
+		if price < 0 || math.IsNaN(price) || math.IsInf(price, 0) {
+			return nil, fmt.Errorf("invalid price for tier %d, must be a finite, non-negative number", tier)
+		}
+		prices[tier] = price
+	}
+	return prices, nil
+}
+
+// containsString returns true if the list contains the given string.
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleLogger returns a logger for the given submodule. Every line it logs
+// is tagged with the module and the server domain, so logs aggregated from
+// multiple servers can be attributed to the server that logged them.
+func moduleLogger(logger *logrus.Logger, serverDomain, module string) *logrus.Entry {
+	return logger.WithFields(logrus.Fields{
+		"modules":      module,
+		"serverDomain": serverDomain,
+	})
+}
+
 func main() {
 	logger := logrus.New()
 
@@ -124,17 +608,68 @@ func main() {
 
 	// Create the loggers for the submodules.
 	logger.SetLevel(cfg.LogLevel)
-	apiLogger := logger.WithField("modules", "api")
-	dbLogger := logger.WithField("modules", "db")
+	apiLogger := moduleLogger(logger, cfg.ServerDomain, "api")
+	dbLogger := moduleLogger(logger, cfg.ServerDomain, "db")
 
 	// Create the promoter that talks to skyd and the database.
-	db, err := database.New(ctx, dbLogger, cfg.DBURI, cfg.DBUser, cfg.DBPassword, cfg.ServerDomain, database.DBName)
+	db, err := database.New(ctx, dbLogger, cfg.DBURI, cfg.DBUser, cfg.DBPassword, cfg.ServerDomain, database.DBName, database.Config{
+		AnomalyThreshold:       cfg.AnomalyThreshold,
+		AnomalyWindow:          cfg.AnomalyWindow,
+		FuturePriceUpdatesOnly: cfg.FuturePricesOnly,
+		HoldTTL:                cfg.HoldTTL,
+		IndexBuildWorkers:      cfg.IndexWorkers,
+		LegacyDomain:           cfg.LegacyDomain,
+		NegativeBalancePolicy:  cfg.NegativeBalance,
+		PingTimeout:            cfg.DBPingTimeout,
+		SlowQueryThreshold:     cfg.SlowQuery,
+		TxnVisibilityLag:       cfg.TxnLag,
+		WorkerStallMultiple:    cfg.WorkerStall,
+	})
 	if err != nil {
 		logger.WithError(err).Fatal("Failed to connect to database")
 	}
+	db.StartBackgroundThreads()
+
+	// Open the access log.
+	var accessLog io.Writer = os.Stdout
+	if cfg.AccessLogFile != "" {
+		f, err := os.OpenFile(cfg.AccessLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to open access log")
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				logger.WithError(err).Error("Failed to close access log")
+			}
+		}()
+		accessLog = f
+	}
 
 	// Create API.
-	a, err := api.New(apiLogger, db, cfg.Port)
+	a, err := api.New(apiLogger, db, cfg.Port, api.Config{
+		AccessLog:             accessLog,
+		AccessLogFormat:       cfg.AccessLogFormat,
+		AccountsAddr:          net.JoinHostPort(cfg.AccountsHost, cfg.AccountsPort),
+		AllowedSubs:           cfg.AllowedSubs,
+		AllowTxnDeletion:      cfg.AllowTxnDeletion,
+		AlreadyReportedStatus: cfg.DuplicateStatus,
+		APIKey:                cfg.APIKey,
+		BasePath:              cfg.BasePath,
+		CreditRounding:        cfg.CreditRounding,
+		DisabledFeatures:      cfg.DisabledFeatures,
+		Expvar:                cfg.Expvar,
+		LogBodies:             cfg.LogBodies,
+		LogBodiesRedact:       cfg.LogBodiesRedact,
+		MaxDBSessions:         cfg.MaxDBSessions,
+		MaxConcurrentRequests: cfg.MaxRequests,
+		MaxLimit:              cfg.MaxLimit,
+		MaxPaymentAge:         cfg.MaxPaymentAge,
+		MaxTopBalances:        cfg.MaxTopBalances,
+		PaymentCacheSize:      cfg.PaymentCacheSize,
+		PaymentCacheTTL:       cfg.PaymentCacheTTL,
+		ReadOnly:              cfg.ReadOnly,
+		Tiers:                 cfg.Tiers,
+	})
 	if err != nil {
 		logger.WithError(err).Fatal("Failed to init API")
 	}
@@ -151,12 +686,16 @@ func main() {
 		// Log that we are shutting down.
 		logger.Info("Caught stop signal. Shutting down...")
 
-		// Shut down API with sane timeout.
-		shutdownCtx, cancel := context.WithTimeout(ctx, envAPIShutdownTimeout)
+		// Stop accepting new requests and wait for the in-flight ones,
+		// which might be in the middle of a transaction, to finish.
+		shutdownCtx, cancel := context.WithTimeout(ctx, cfg.ShutdownTimeout)
 		defer cancel()
 		if err := a.Shutdown(shutdownCtx); err != nil {
 			logger.WithError(err).Error("Failed to shut down api")
 		}
+		if err := a.WaitInFlight(shutdownCtx); err != nil {
+			logger.WithError(err).Error("Failed to wait for in-flight requests")
+		}
 	}()
 
 	// Start serving API.
@@ -169,7 +708,8 @@ func main() {
 	// shutdown procedures.
 	wg.Wait()
 
-	// Close database.
+	// Stop the background threads before closing the database.
+	db.StopBackgroundThreads()
 	if err = db.Close(); err != nil {
 		logger.WithError(err).Fatal("Failed to close database gracefully")
 	}
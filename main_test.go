@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestModuleLogger ensures that module loggers tag their output with both
+// the module and the server domain.
+func TestModuleLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+
+	moduleLogger(logger, "server.example.com", "api").Info("test")
+	out := buf.String()
+	if !strings.Contains(out, "serverDomain=server.example.com") {
+		t.Fatalf("Expected server domain in log output, got '%s'", out)
+	}
+	if !strings.Contains(out, "modules=api") {
+		t.Fatalf("Expected module in log output, got '%s'", out)
+	}
+}
+
+// TestParseTierPrices is a unit test for parseTierPrices.
+func TestParseTierPrices(t *testing.T) {
+	prices, err := parseTierPrices(" 2:5, 3 : 20.5,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prices) != 2 || prices[2] != 5 || prices[3] != 20.5 {
+		t.Fatalf("Unexpected prices %v", prices)
+	}
+	for _, s := range []string{"2", "x:5", "2:x", "2:-1", "2:NaN", "2:Inf", "2:-Inf"} {
+		if _, err := parseTierPrices(s); err == nil {
+			t.Fatalf("Expected '%s' to be rejected", s)
+		}
+	}
+}
@@ -0,0 +1,567 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/promoter/api"
+	"github.com/SkynetLabs/promoter/database"
+)
+
+// TestDebugVars ensures that the /debug/vars endpoint reports the payments
+// processed by the API and the running background workers. It doesn't run in
+// parallel since the counters are shared by all APIs in this process.
+func TestDebugVars(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{Expvar: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// counter returns the current value of the counter with the given name.
+	// The counters are shared by all APIs in this process so we only compare
+	// relative values.
+	counter := func(name string) float64 {
+		vars, err := tester.DebugVars()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, ok := vars[name].(float64)
+		if !ok {
+			t.Fatalf("Counter %v missing from %v", name, vars)
+		}
+		return count
+	}
+	before := counter("promoter_payments")
+
+	// Make a payment.
+	_, err = tester.Payment(t.Name(), "sub", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after := counter("promoter_payments"); after != before+1 {
+		t.Fatalf("Expected payment counter to increase from %v, got %v", before, after)
+	}
+
+	// Replaying the payment doesn't count it again.
+	_, err = tester.Payment(t.Name(), "sub", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after := counter("promoter_payments"); after != before+1 {
+		t.Fatalf("Expected payment counter to stay at %v, got %v", before+1, after)
+	}
+
+	// The running background workers are reported.
+	_ = counter("promoter_background_workers")
+
+	// The endpoint shouldn't exist when disabled.
+	tester2, err := newTester(t.Name() + "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester2.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if _, err = tester2.DebugVars(); err == nil {
+		t.Fatal("Expected /debug/vars to be unavailable")
+	}
+}
+
+// TestDeleteTxn tests the DELETE /txn/:id endpoint.
+func TestDeleteTxn(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		APIKey:           "apikey",
+		AllowTxnDeletion: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Make two payments.
+	sub := "sub"
+	_, err = tester.Payment("txn1", sub, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tester.Payment("txn2", sub, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete one of them.
+	err = tester.DeleteTxn("txn1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance, _, err := tester.staticDB.UserBalance(context.Background(), sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 5 {
+		t.Fatalf("Expected balance 5, got %v", balance)
+	}
+
+	// The txn is only returned in audit mode.
+	_, err = tester.Txn("txn1")
+	if err == nil || !strings.Contains(err.Error(), database.ErrNotFound.Error()) {
+		t.Fatalf("Expected %v, got %v", database.ErrNotFound, err)
+	}
+	tg, err := tester.TxnForAudit("txn1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tg.DeletedAt == nil || tg.Amount != 10 {
+		t.Fatalf("Expected a deleted txn, got %+v", tg)
+	}
+
+	// Txns can't be read without the API key.
+	_, err = api.NewClient("http://" + tester.staticAPI.Address()).TxnForAudit("txn1")
+	if err == nil || !strings.Contains(err.Error(), api.ErrUnauthorized.Error()) {
+		t.Fatalf("Expected %v, got %v", api.ErrUnauthorized, err)
+	}
+
+	// Deleting it again fails.
+	err = tester.DeleteTxn("txn1")
+	if err == nil || !strings.Contains(err.Error(), database.ErrNotFound.Error()) {
+		t.Fatalf("Expected %v, got %v", database.ErrNotFound, err)
+	}
+
+	// Deleting without the API key fails.
+	err = api.NewClient("http://" + tester.staticAPI.Address()).DeleteTxn("txn2")
+	if err == nil || !strings.Contains(err.Error(), api.ErrUnauthorized.Error()) {
+		t.Fatalf("Expected %v, got %v", api.ErrUnauthorized, err)
+	}
+
+	// The route shouldn't exist when txn deletion is disabled.
+	tester2, err := newCustomTester(t.Name()+"2", api.Config{APIKey: "apikey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester2.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	_, err = tester2.Payment("txn1", sub, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tester2.DeleteTxn("txn1"); err == nil {
+		t.Fatal("Expected deletion to fail")
+	}
+	balance, _, err = tester2.staticDB.UserBalance(context.Background(), sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 10 {
+		t.Fatalf("Expected balance 10, got %v", balance)
+	}
+}
+
+// TestPaymentRounding ensures that the credits of payments are rounded
+// according to the configured policy and that the applied amount is returned.
+func TestPaymentRounding(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		CreditRounding: api.RoundingPolicy{
+			Places: 2,
+			Mode:   api.RoundingDown,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	sub := "sub"
+	pr, err := tester.Payment("txn1", sub, 1.23999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.Credits != 1.23 {
+		t.Fatalf("Expected 1.23 credits to be applied, got %v", pr.Credits)
+	}
+	balance, _, err := tester.staticDB.UserBalance(context.Background(), sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != pr.Credits {
+		t.Fatalf("Expected balance %v, got %v", pr.Credits, balance)
+	}
+
+	// A replay of the payment with a different amount returns the credits
+	// which were applied originally.
+	pr, err = tester.Payment("txn1", sub, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.Credits != 1.23 || pr.Balance != 1.23 {
+		t.Fatalf("Expected the original 1.23 credits, got %+v", pr)
+	}
+
+	// Payments which round to zero are rejected.
+	_, err = tester.Payment("txn2", sub, 0.001)
+	if err == nil {
+		t.Fatal("Expected payment to be rejected")
+	}
+}
+
+// TestPaymentBalance ensures that payments return the user's balance after the
+// payment and that concurrent payments of the same user, which are retried on
+// WriteConflicts, each return a distinct balance.
+func TestPaymentBalance(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newTester(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Send concurrent payments of one credit each. There are fewer of them
+	// than retries, so they all succeed eventually.
+	sub := "sub"
+	n := api.DBTxnRetryCount
+	balances := make([]float64, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pr, err := tester.Payment(fmt.Sprintf("txn%d", i), sub, 1)
+			balances[i], errs[i] = pr.Balance, err
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every payment saw the credits of all payments before it.
+	sort.Float64s(balances)
+	for i, balance := range balances {
+		if balance != float64(i+1) {
+			t.Fatalf("Expected balances 1 to %d, got %v", n, balances)
+		}
+	}
+	total, _, err := tester.staticDB.UserBalance(context.Background(), sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != float64(n) {
+		t.Fatalf("Expected balance %d, got %v", n, total)
+	}
+}
+
+// TestPaymentReplay ensures that a payment which is reported again is answered
+// with the user's current balance instead of failing the transaction it runs
+// in.
+func TestPaymentReplay(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newTester(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	sub := "sub"
+	pr, err := tester.Payment("txn", sub, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.Balance != 10 {
+		t.Fatalf("Expected balance 10, got %v", pr.Balance)
+	}
+	_, err = tester.Payment("other", sub, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay the first payment. It isn't credited again but returns the
+	// current balance.
+	pr, err = tester.Payment("txn", sub, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.Balance != 15 {
+		t.Fatalf("Expected balance 15, got %v", pr.Balance)
+	}
+	total, _, err := tester.staticDB.UserBalance(context.Background(), sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 15 {
+		t.Fatalf("Expected balance 15, got %v", total)
+	}
+}
+
+// TestPaymentCache ensures that a rapid duplicate of a payment is answered
+// from the payment cache without starting a second database transaction.
+func TestPaymentCache(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		APIKey:           "key",
+		PaymentCacheSize: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	pr, err := tester.Payment("txn", "sub", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicate, err := tester.Payment("txn", "sub", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.AlreadyProcessed {
+		t.Fatal("Expected the first payment to be processed")
+	}
+	expected := pr
+	expected.AlreadyProcessed = true
+	if duplicate != expected {
+		t.Fatalf("Expected the cached response %v, got %v", expected, duplicate)
+	}
+
+	// Only the first payment went through WithDBSession.
+	rg, err := tester.DebugRetries(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int64
+	for _, n := range rg.Calls {
+		calls += n
+	}
+	if calls != 1 {
+		t.Fatalf("Expected 1 call with a database session, got %d", calls)
+	}
+
+	// A payment for another sub with the same txn ID isn't served from the
+	// cache.
+	_, err = tester.Payment("txn", "other", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rg, err = tester.DebugRetries(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls = 0
+	for _, n := range rg.Calls {
+		calls += n
+	}
+	if calls != 2 {
+		t.Fatalf("Expected 2 calls with a database session, got %d", calls)
+	}
+
+	// A cached payment is answered with the current balance rather than the
+	// one from when it was credited.
+	_, err = tester.Payment("txn2", "sub", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicate, err = tester.Payment("txn", "sub", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected.Balance = 3
+	if duplicate != expected {
+		t.Fatalf("Expected the cached response %v, got %v", expected, duplicate)
+	}
+	rg, err = tester.DebugRetries(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls = 0
+	for _, n := range rg.Calls {
+		calls += n
+	}
+	if calls != 3 {
+		t.Fatalf("Expected 3 calls with a database session, got %d", calls)
+	}
+}
+
+// TestMaxPaymentAge ensures that stale payments are rejected while fresh ones
+// and ones without a timestamp are credited.
+func TestMaxPaymentAge(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		MaxPaymentAge: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	now := time.Now()
+	fresh := map[string]string{api.MetadataTimestamp: now.Add(-time.Minute).Format(time.RFC3339)}
+	if _, err = tester.PaymentWithMetadata("fresh", "sub", 1, fresh); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tester.Payment("none", "sub", 1); err != nil {
+		t.Fatal(err)
+	}
+	stale := map[string]string{api.MetadataTimestamp: now.Add(-2 * time.Hour).Format(time.RFC3339)}
+	_, err = tester.PaymentWithMetadata("stale", "sub", 1, stale)
+	if err == nil || !strings.Contains(err.Error(), api.ErrPaymentTooOld.Error()) {
+		t.Fatalf("Expected %v, got %v", api.ErrPaymentTooOld, err)
+	}
+
+	// Only the fresh payment and the one without a timestamp were credited.
+	total, _, err := tester.staticDB.UserBalance(context.Background(), "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 {
+		t.Fatalf("Expected balance 2, got %v", total)
+	}
+}
+
+// TestDuplicatePayment ensures that the response to a payment tells whether it
+// was already processed and that duplicates are answered with a 208 if
+// configured.
+func TestDuplicatePayment(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	for _, alreadyReported := range []bool{false, true} {
+		tester, err := newCustomTester(fmt.Sprintf("%s-%v", t.Name(), alreadyReported), api.Config{
+			AlreadyReportedStatus: alreadyReported,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pay := func() (int, api.PaymentResponse) {
+			b, err := json.Marshal(api.PaymentPOST{TxnID: "txn", Sub: "sub", Credits: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.Post("http://"+tester.staticAPI.Address()+"/payment", "application/json", bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var pr api.PaymentResponse
+			if err = json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+				t.Fatal(err)
+			}
+			return resp.StatusCode, pr
+		}
+
+		// The first payment is processed.
+		status, pr := pay()
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %v, got %v", http.StatusOK, status)
+		}
+		if pr.AlreadyProcessed || pr.Balance != 10 {
+			t.Fatalf("Unexpected response %+v", pr)
+		}
+
+		// The replay isn't credited again.
+		expectedStatus := http.StatusOK
+		if alreadyReported {
+			expectedStatus = http.StatusAlreadyReported
+		}
+		status, pr = pay()
+		if status != expectedStatus {
+			t.Fatalf("Expected status %v, got %v", expectedStatus, status)
+		}
+		if !pr.AlreadyProcessed || pr.Balance != 10 {
+			t.Fatalf("Unexpected response %+v", pr)
+		}
+
+		// The client accepts both statuses.
+		pr, err = tester.Payment("txn", "sub", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pr.AlreadyProcessed {
+			t.Fatal("Expected payment to be already processed")
+		}
+		if err = tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SkynetLabs/promoter/api"
+	"github.com/SkynetLabs/promoter/database"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestDebugIndexes tests the /debug/indexes endpoint.
+func TestDebugIndexes(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		APIKey: "apikey",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// The endpoint requires authentication.
+	_, err = api.NewClient("http://" + tester.staticAPI.Address()).DebugIndexes()
+	if err == nil {
+		t.Fatal("Expected unauthenticated request to fail")
+	}
+
+	// Without drift, nothing is missing or unexpected.
+	ig, err := tester.DebugIndexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ig.Collections) == 0 {
+		t.Fatal("Expected collections to be reported")
+	}
+	for collName, ci := range ig.Collections {
+		if len(ci.Missing) != 0 || len(ci.Unexpected) != 0 {
+			t.Fatalf("Unexpected drift for collection %s: %+v", collName, ci)
+		}
+		if len(ci.Expected) != len(ci.Existing) {
+			t.Fatalf("Expected %v to exist in collection %s, got %v", ci.Expected, collName, ci.Existing)
+		}
+	}
+
+	// Drop an index behind the service's back.
+	ctx := context.Background()
+	client, err := newTestMongoClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.Disconnect(ctx)
+	}()
+	_, err = client.Database(t.Name()).Collection("txns").Indexes().DropOne(ctx, "createdAt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The dropped index should be reported as missing.
+	ig, err = tester.DebugIndexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := ig.Collections["txns"]
+	if len(ci.Missing) != 1 || ci.Missing[0] != "createdAt" {
+		t.Fatalf("Expected createdAt to be missing, got %+v", ci)
+	}
+}
+
+// TestDebugRetries tests the /debug/retries endpoint.
+func TestDebugRetries(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		APIKey: "apikey",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// The endpoint requires authentication.
+	_, err = api.NewClient("http://" + tester.staticAPI.Address()).DebugRetries(false)
+	if err == nil {
+		t.Fatal("Expected unauthenticated request to fail")
+	}
+
+	// call runs a call through WithDBSession which fails with a simulated
+	// WriteConflict the given number of times before it succeeds.
+	call := func(conflicts int) {
+		t.Helper()
+		h := tester.staticAPI.WithDBSession(func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+			if conflicts > 0 {
+				conflicts--
+				tester.staticAPI.WriteError(w, errors.New("(WriteConflict) simulated"), http.StatusInternalServerError)
+				return
+			}
+			tester.staticAPI.WriteSuccess(w)
+		})
+		rw := httptest.NewRecorder()
+		h(rw, httptest.NewRequest(http.MethodPost, "/", nil), nil)
+		if rw.Code != http.StatusNoContent {
+			t.Fatalf("Expected status %d, got %d", http.StatusNoContent, rw.Code)
+		}
+	}
+	for _, conflicts := range []int{0, 0, 1, 2, 3} {
+		call(conflicts)
+	}
+
+	// checkRetries checks the tallies returned by the endpoint.
+	checkRetries := func(reset bool, none, one, multiple, retries int64) {
+		t.Helper()
+		rg, err := tester.DebugRetries(reset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rg.Calls["0"] != none || rg.Calls["1"] != one || rg.Calls["2+"] != multiple {
+			t.Fatalf("Expected buckets %d/%d/%d, got %v", none, one, multiple, rg.Calls)
+		}
+		if rg.Retries != retries {
+			t.Fatalf("Expected %d retries, got %d", retries, rg.Retries)
+		}
+	}
+	checkRetries(false, 2, 1, 2, 6)
+	checkRetries(true, 2, 1, 2, 6)
+	checkRetries(false, 0, 0, 0, 0)
+}
+
+// TestDebugOrphanTxns tests the /debug/txns/orphans endpoint.
+func TestDebugOrphanTxns(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		APIKey: "apikey",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// The endpoint requires authentication.
+	_, err = api.NewClient("http://" + tester.staticAPI.Address()).DebugOrphanTxns()
+	if err == nil {
+		t.Fatal("Expected unauthenticated request to fail")
+	}
+
+	// Seed a regular payment and an orphan txn.
+	_, err = tester.Payment("txn", "sub", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tester.staticDB.NewTxn(context.Background(), "orphan", "nouser", 5, database.TxnSourcePayment, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	og, err := tester.DebugOrphanTxns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(og.Txns) != 1 || og.Txns[0].ID != "orphan" {
+		t.Fatalf("Expected the orphan txn, got %+v", og.Txns)
+	}
+}
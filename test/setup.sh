@@ -5,11 +5,17 @@ MONGO_PASSWORD=aO4tV5tC1oU3oQ7u
 MONGO_PORT=37017
 MONGO_TEST_CONTAINER_NAME=$1
 MONGO_REPLSET=skynet
+# The standalone server is used to test that deployments without transaction
+# support are rejected.
+MONGO_STANDALONE_PORT=37018
+MONGO_STANDALONE_CONTAINER_NAME=$1-standalone
 
 # Stop and remove any existing docker container
 printf '\n==STOPPING AND REMOVING DOCKER CONTAINERS==\n'
 docker stop $MONGO_TEST_CONTAINER_NAME 1>/dev/null 2>&1
 docker rm $MONGO_TEST_CONTAINER_NAME 1>/dev/null 2>&1
+docker stop $MONGO_STANDALONE_CONTAINER_NAME 1>/dev/null 2>&1
+docker rm $MONGO_STANDALONE_CONTAINER_NAME 1>/dev/null 2>&1
 
 # Start docker container
 printf '\n==STARTING DOCKER CONTAINER==\n'
@@ -21,6 +27,14 @@ docker run \
 	-e MONGO_INITDB_ROOT_USERNAME=$MONGO_USER \
 	-e MONGO_INITDB_ROOT_PASSWORD=$MONGO_PASSWORD \
 	mongo:4.4.2 mongod --port=$MONGO_PORT --replSet=$MONGO_REPLSET 1>/dev/null 2>&1
+docker run \
+	--rm \
+	--detach \
+	--name $MONGO_STANDALONE_CONTAINER_NAME \
+	-p $MONGO_STANDALONE_PORT:$MONGO_STANDALONE_PORT \
+	-e MONGO_INITDB_ROOT_USERNAME=$MONGO_USER \
+	-e MONGO_INITDB_ROOT_PASSWORD=$MONGO_PASSWORD \
+	mongo:4.4.2 mongod --port=$MONGO_STANDALONE_PORT 1>/dev/null 2>&1
 
 # wait for mongo to start before we try to configure it
 printf '\n==WAIT FOR MONGO TO BE ACCESSIBLE==\n'
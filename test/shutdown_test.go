@@ -0,0 +1,136 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/promoter/api"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestShutdownInFlight ensures that in-flight calls which use a database
+// session are either completed or cleanly aborted during shutdown.
+func TestShutdownInFlight(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// newCall starts a credit of the given sub through WithDBSession which
+	// blocks until proceed is closed or the call is aborted. It returns a
+	// channel with the call's status.
+	newCall := func(tester *Tester, sub string, started, proceed chan struct{}) chan int {
+		status := make(chan int, 1)
+		h := tester.staticAPI.WithDBSession(func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+			close(started)
+			select {
+			case <-proceed:
+			case <-req.Context().Done():
+			}
+			_, err := tester.staticDB.CreditUser(req.Context(), sub, 10, "txn", nil)
+			if err != nil {
+				tester.staticAPI.WriteDBError(w, err)
+				return
+			}
+			tester.staticAPI.WriteSuccess(w)
+		})
+		go func() {
+			rw := httptest.NewRecorder()
+			h(rw, httptest.NewRequest(http.MethodPost, "/payment", strings.NewReader("{}")), nil)
+			status <- rw.Code
+		}()
+		return status
+	}
+
+	t.Run("Complete", func(t *testing.T) {
+		tester, err := newTester(strings.ReplaceAll(t.Name(), "/", "_"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := tester.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+
+		// Start a call and begin shutting down while it's in flight.
+		started, proceed := make(chan struct{}), make(chan struct{})
+		status := newCall(tester, "sub", started, proceed)
+		<-started
+		waitErr := make(chan error, 1)
+		go func() {
+			waitErr <- tester.staticAPI.WaitInFlight(context.Background())
+		}()
+		select {
+		case err := <-waitErr:
+			t.Fatalf("Expected shutdown to wait for the in-flight call, got %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		// New calls are rejected in the meantime.
+		h := tester.staticAPI.WithDBSession(func(http.ResponseWriter, *http.Request, httprouter.Params) {
+			t.Error("Expected new call to be rejected")
+		})
+		rw := httptest.NewRecorder()
+		h(rw, httptest.NewRequest(http.MethodPost, "/payment", strings.NewReader("{}")), nil)
+		if rw.Code != http.StatusServiceUnavailable || !strings.Contains(rw.Body.String(), api.ErrShuttingDown.Error()) {
+			t.Fatalf("Expected %v, got %d %s", api.ErrShuttingDown, rw.Code, rw.Body.String())
+		}
+
+		// The in-flight call completes and shutdown continues.
+		close(proceed)
+		if code := <-status; code != http.StatusNoContent {
+			t.Fatalf("Expected status %d, got %d", http.StatusNoContent, code)
+		}
+		if err := <-waitErr; err != nil {
+			t.Fatal(err)
+		}
+		balance, _, err := tester.staticDB.UserBalance(context.Background(), "sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance != 10 {
+			t.Fatalf("Expected balance 10, got %v", balance)
+		}
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		tester, err := newTester(strings.ReplaceAll(t.Name(), "/", "_"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := tester.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+
+		// Start a call which doesn't finish before the shutdown deadline.
+		started, proceed := make(chan struct{}), make(chan struct{})
+		status := newCall(tester, "sub", started, proceed)
+		<-started
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err = tester.staticAPI.WaitInFlight(ctx)
+		if !errors.Contains(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+		}
+
+		// The call was aborted without crediting the sub.
+		if code := <-status; code == http.StatusNoContent {
+			t.Fatal("Expected call to be aborted")
+		}
+		balance, _, err := tester.staticDB.UserBalance(context.Background(), "sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance != 0 {
+			t.Fatalf("Expected balance 0, got %v", balance)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/promoter/api"
+)
+
+// TestStatsTiers tests the /stats/tiers endpoint.
+func TestStatsTiers(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newTester(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Seed subscriptions across multiple tiers.
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	day := 24 * time.Hour
+	subs := []struct {
+		sub   string
+		tier  int
+		from  time.Time
+		to    time.Time
+		price float64
+	}{
+		// Active within the window.
+		{"a", 2, now.Add(-10 * day), now.Add(20 * day), 5},
+		{"b", 2, now.Add(-5 * day), now.Add(25 * day), 5},
+		{"c", 3, now.Add(-1 * day), now.Add(29 * day), 20},
+		// Changes from tier 2 to tier 3 within the window. Both periods
+		// count towards their respective tier.
+		{"d", 2, now.Add(-20 * day), now.Add(-2 * day), 5},
+		{"d", 3, now.Add(-2 * day), now.Add(28 * day), 20},
+		// Ended before the window.
+		{"e", 4, now.Add(-60 * day), now.Add(-30 * day), 80},
+		// Starts after the window.
+		{"f", 4, now.Add(30 * day), now.Add(60 * day), 80},
+	}
+	for _, s := range subs {
+		_, err = tester.staticDB.NewSubscription(ctx, s.sub, s.tier, s.from, s.to, s.price)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Query the stats for the window.
+	stg, err := tester.StatsTiers(now.Add(-7*day), now.Add(7*day))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int]float64{
+		2: 15,
+		3: 40,
+	}
+	if len(stg.Tiers) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, stg.Tiers)
+	}
+	for tier, sum := range expected {
+		if stg.Tiers[tier] != sum {
+			t.Fatalf("Expected tier %d to sum to %v, got %v", tier, sum, stg.Tiers[tier])
+		}
+	}
+
+	// An invalid window should be rejected.
+	_, err = tester.StatsTiers(now, now.Add(-day))
+	if err == nil {
+		t.Fatal("Expected an error for an invalid window")
+	}
+}
+
+// TestStatsRevenue tests the /stats/revenue endpoint.
+func TestStatsRevenue(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newTester(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Seed a subscription which overlaps the window by half.
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	day := 24 * time.Hour
+	_, err = tester.staticDB.NewSubscription(ctx, "sub", 2, now.Add(-10*day), now.Add(10*day), 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srg, err := tester.StatsRevenue(now, now.Add(30*day))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srg.Revenue != 15 {
+		t.Fatalf("Expected revenue 15, got %v", srg.Revenue)
+	}
+
+	// An invalid window should be rejected.
+	_, err = tester.StatsRevenue(now, now.Add(-day))
+	if err == nil {
+		t.Fatal("Expected an error for an invalid window")
+	}
+}
+
+// TestStatsTop tests the /stats/top endpoint.
+func TestStatsTop(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		APIKey:         "apikey",
+		MaxTopBalances: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	for i, credits := range []float64{3, 1, 2} {
+		_, err = tester.Payment(fmt.Sprintf("txn%d", i), fmt.Sprintf("sub%d", i), credits)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The endpoint requires authentication.
+	_, err = api.NewClient("http://" + tester.staticAPI.Address()).StatsTop(10)
+	if err == nil {
+		t.Fatal("Expected unauthenticated request to fail")
+	}
+
+	// n is clamped to the maximum.
+	stg, err := tester.StatsTop(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stg.N != 2 || len(stg.Users) != 2 {
+		t.Fatalf("Expected 2 users, got %+v", stg)
+	}
+	if stg.Users[0] != (api.UserBalanceGET{Sub: "sub0", Balance: 3}) || stg.Users[1] != (api.UserBalanceGET{Sub: "sub2", Balance: 2}) {
+		t.Fatalf("Unexpected top balances %+v", stg.Users)
+	}
+
+	// n needs to be positive.
+	if _, err = tester.StatsTop(0); err == nil {
+		t.Fatal("Expected an error for n = 0")
+	}
+}
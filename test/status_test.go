@@ -0,0 +1,220 @@
+package test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/promoter/api"
+	"github.com/SkynetLabs/promoter/build"
+)
+
+// TestStatus tests the /status endpoint.
+func TestStatus(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create a listener to act as the accounts service.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	// Healthy.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		AccountsAddr: l.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	sg, err := tester.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sg.Database.OK || sg.Database.Error != "" {
+		t.Fatalf("Expected database to be ok, got %+v", sg.Database)
+	}
+	if sg.Accounts == nil || !sg.Accounts.OK || sg.Accounts.Error != "" {
+		t.Fatalf("Expected accounts to be ok, got %+v", sg.Accounts)
+	}
+	if len(sg.Workers) != 0 {
+		t.Fatalf("Expected no background workers, got %+v", sg.Workers)
+	}
+	if sg.BuildVersion != build.Version() {
+		t.Fatalf("Expected build version %s, got %s", build.Version(), sg.BuildVersion)
+	}
+
+	// Degraded. The accounts service goes away while the database stays
+	// healthy.
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sg, err = tester.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sg.Database.OK {
+		t.Fatalf("Expected database to be ok, got %+v", sg.Database)
+	}
+	if sg.Accounts == nil || sg.Accounts.OK || sg.Accounts.Error == "" {
+		t.Fatalf("Expected accounts to be unreachable, got %+v", sg.Accounts)
+	}
+	if sg.BuildVersion == "" {
+		t.Fatal("Expected build version to be set")
+	}
+}
+
+// TestReadOnly ensures that reads keep working in read-only mode while writes
+// are rejected and that /status reports the mode.
+func TestReadOnly(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		ReadOnly: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Seed a balance directly.
+	sub := "sub"
+	_, err = tester.staticDB.CreditUser(context.Background(), sub, 10, "txn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads succeed.
+	bg, err := tester.Balance(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bg.Balance != 10 {
+		t.Fatalf("Expected balance 10, got %v", bg.Balance)
+	}
+	if _, err = tester.Debits(sub, 10, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes fail.
+	_, err = tester.Payment("txn2", sub, 5)
+	if err == nil || !strings.Contains(err.Error(), api.ErrReadOnly.Error()) {
+		t.Fatalf("Expected %v, got %v", api.ErrReadOnly, err)
+	}
+
+	// The mode is reported.
+	sg, err := tester.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sg.ReadOnly {
+		t.Fatal("Expected status to report read-only mode")
+	}
+}
+
+// TestConcurrencyLimit ensures that requests beyond the concurrency limit are
+// rejected while the health check keeps working.
+func TestConcurrencyLimit(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		MaxConcurrentRequests: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Occupy the only slot with a payment whose body is still being sent.
+	body, bodyWriter := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, "http://"+tester.staticAPI.Address()+"/payment", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		done <- err
+	}()
+	if _, err = bodyWriter.Write([]byte(`{"txnID":"txn",`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other requests are rejected while the health check still works. The
+	// payment might not have reached the server yet, so we wait for it.
+	for i := 0; ; i++ {
+		_, err = tester.Balance("sub")
+		if err != nil && strings.Contains(err.Error(), api.ErrTooManyRequests.Error()) {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Expected %v, got %v", api.ErrTooManyRequests, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	hg, err := tester.Health()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hg.DBAlive {
+		t.Fatal("Expected the database to be alive")
+	}
+
+	// Once the payment is done, requests are accepted again.
+	if _, err = bodyWriter.Write([]byte(`"sub":"sub","credits":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	_ = bodyWriter.Close()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	bg, err := tester.Balance("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bg.Balance != 1 {
+		t.Fatalf("Expected balance 1, got %v", bg.Balance)
+	}
+}
@@ -0,0 +1,202 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/promoter/api"
+	"github.com/SkynetLabs/promoter/database"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestSubscriptionPOST tests that creating a subscription returns the created
+// subscription with a 201 and its location and that it's charged the tier's
+// configured price.
+func TestSubscriptionPOST(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		APIKey: "key",
+		Tiers: database.TierConfig{
+			Prices: map[int]float64{2: 5},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Credit the user so the subscription can be paid for.
+	sub := "sub"
+	_, err = tester.Payment("txn", sub, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a subscription with a raw request to check the status and
+	// headers.
+	now := time.Now().UTC().Truncate(time.Second)
+	sp := api.SubscriptionPOST{
+		Sub:  sub,
+		Tier: 2,
+		From: now,
+		To:   now.Add(30 * 24 * time.Hour),
+	}
+	b, err := json.Marshal(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(path, apiKey string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, "http://"+tester.staticAPI.Address()+path, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			req.Header.Set("X-Promoter-API-Key", apiKey)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Without the API key, the subscription is rejected.
+	resp := post("/subscription", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("wrong status", resp.StatusCode)
+	}
+
+	resp = post("/subscription", "key")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("wrong status", resp.StatusCode)
+	}
+	var sg api.SubscriptionGET
+	if err = json.NewDecoder(resp.Body).Decode(&sg); err != nil {
+		t.Fatal(err)
+	}
+	if sg.ID == "" {
+		t.Fatal("missing id")
+	}
+	if location := resp.Header.Get("Location"); location != "/subscription/"+sg.ID {
+		t.Fatal("wrong location", location)
+	}
+	if sg.Sub != sp.Sub || sg.Tier != sp.Tier || !sg.From.Equal(sp.From) || !sg.To.Equal(sp.To) || sg.Price != 5 {
+		t.Fatal("wrong subscription", sg)
+	}
+
+	// The client should return the created subscription as well.
+	sp.From = sp.To
+	sp.To = sp.From.Add(30 * 24 * time.Hour)
+	sg2, err := tester.Subscription(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sg2.ID == "" || sg2.ID == sg.ID {
+		t.Fatal("wrong id", sg2.ID)
+	}
+	if sg2.Sub != sp.Sub || !sg2.From.Equal(sp.From) || !sg2.To.Equal(sp.To) {
+		t.Fatal("wrong subscription", sg2)
+	}
+
+	// Tiers without a price can't be subscribed to.
+	sp.Tier = 3
+	_, err = tester.Subscription(sp)
+	if err == nil || !strings.Contains(err.Error(), api.ErrTierNotForSale.Error()) {
+		t.Fatalf("Expected %v, got %v", api.ErrTierNotForSale, err)
+	}
+
+	// Subscriptions created through the versioned routes are located under
+	// them as well.
+	sp.Tier = 2
+	sp.From = sp.To
+	sp.To = sp.From.Add(30 * 24 * time.Hour)
+	b, err = json.Marshal(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = post("/v1/subscription", "key")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("wrong status", resp.StatusCode)
+	}
+	var sg3 api.SubscriptionGET
+	if err = json.NewDecoder(resp.Body).Decode(&sg3); err != nil {
+		t.Fatal(err)
+	}
+	if location := resp.Header.Get("Location"); location != "/v1/subscription/"+sg3.ID {
+		t.Fatal("wrong location", location)
+	}
+
+	// All subscriptions should have been charged.
+	ub, err := tester.Balance(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ub.Balance != 0 {
+		t.Fatal("wrong balance", ub.Balance)
+	}
+}
+
+// TestGetSubscription tests the /subscription/:id endpoint.
+func TestGetSubscription(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newTester(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Create a subscription.
+	now := time.Now().UTC().Truncate(time.Second)
+	s, err := tester.staticDB.NewSubscription(context.Background(), "sub", 2, now, now.Add(24*time.Hour), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fetch it.
+	sg, err := tester.GetSubscription(s.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sg.ID != s.ID.Hex() || sg.Sub != s.Sub || sg.Tier != s.Tier || !sg.From.Equal(s.From) || !sg.To.Equal(s.To) || sg.Price != s.Price {
+		t.Fatal("wrong subscription", sg)
+	}
+
+	// Malformed IDs are rejected.
+	_, err = tester.GetSubscription("malformed")
+	if err == nil || !strings.Contains(err.Error(), "invalid subscription id") {
+		t.Fatal("expected malformed id to be rejected", err)
+	}
+
+	// Unknown subscriptions aren't found.
+	_, err = tester.GetSubscription(primitive.NewObjectID().Hex())
+	if err == nil || !strings.Contains(err.Error(), database.ErrNotFound.Error()) {
+		t.Fatalf("Expected %v, got %v", database.ErrNotFound, err)
+	}
+}
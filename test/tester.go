@@ -5,22 +5,46 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/SkynetLabs/promoter/api"
 	"github.com/SkynetLabs/promoter/database"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	testUsername = "admin"
+	// nolint:gosec // Disable gosec since these are only test credentials.
+	testPassword = "aO4tV5tC1oU3oQ7u"
+	testURI      = "mongodb://localhost:37017"
+
+	// testTxnVisibilityLag is the TxnVisibilityLag of the test databases.
+	// It's kept short so tests don't need to wait long for new txns.
+	testTxnVisibilityLag = 100 * time.Millisecond
 )
 
 // newTestDB creates a DB instance for testing.
 func newTestDB(domain string) (*database.DB, error) {
-	username := "admin"
-	// nolint:gosec // Disable gosec since these are only test credentials.
-	password := "aO4tV5tC1oU3oQ7u"
-	uri := "mongodb://localhost:37017"
 	logger := logrus.New()
 	logger.SetOutput(io.Discard)
-	return database.New(context.Background(), logrus.NewEntry(logger), uri, username, password, domain, domain)
+	return database.New(context.Background(), logrus.NewEntry(logger), testURI, testUsername, testPassword, domain, domain, database.Config{
+		TxnVisibilityLag: testTxnVisibilityLag,
+	})
+}
+
+// newTestMongoClient creates a plain mongo client for tests which need to
+// manipulate the database behind the DB's back.
+func newTestMongoClient() (*mongo.Client, error) {
+	opts := options.Client().
+		ApplyURI(testURI).
+		SetAuth(options.Credential{
+			Username: testUsername,
+			Password: testPassword,
+		})
+	return mongo.Connect(context.Background(), opts)
 }
 
 // Tester is a pair of an API and a client to talk to that API for testing.
@@ -35,12 +59,18 @@ type Tester struct {
 	shutDownErr error
 }
 
-// Close shuts the tester down gracefully.
+// Close shuts the tester down gracefully and drops its database.
 func (t *Tester) Close() error {
 	if err := t.staticAPI.Shutdown(context.Background()); err != nil {
 		return err
 	}
 	<-t.shutDown
+	if err := t.staticDB.Drop(context.Background()); err != nil {
+		return errors.AddContext(err, "failed to drop database")
+	}
+	if err := t.staticDB.Close(); err != nil {
+		return errors.AddContext(err, "failed to close database")
+	}
 	if errors.Contains(t.shutDownErr, http.ErrServerClosed) {
 		return nil // Ignore shutdown error
 	}
@@ -49,6 +79,12 @@ func (t *Tester) Close() error {
 
 // newTester creates a new, ready-to-go tester.
 func newTester(server string) (*Tester, error) {
+	return newCustomTester(server, api.Config{})
+}
+
+// newCustomTester creates a new, ready-to-go tester with an API using the
+// given config.
+func newCustomTester(server string, cfg api.Config) (*Tester, error) {
 	// Create discard logger.
 	logger := logrus.New()
 	logger.SetOutput(io.Discard)
@@ -58,12 +94,12 @@ func newTester(server string) (*Tester, error) {
 	}
 
 	// Create API.
-	a, err := api.New(logrus.NewEntry(logger), db, 0)
+	a, err := api.New(logrus.NewEntry(logger), db, 0, cfg)
 	if err != nil {
 		return nil, err
 	}
 	tester := &Tester{
-		Client:    api.NewClient(fmt.Sprintf("http://%s", a.Address())),
+		Client:    api.NewCustomClient(fmt.Sprintf("http://%s", a.Address()), cfg.BasePath, cfg.APIKey),
 		staticAPI: a,
 		staticDB:  db,
 		shutDown:  make(chan struct{}),
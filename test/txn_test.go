@@ -0,0 +1,310 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/promoter/api"
+	"github.com/SkynetLabs/promoter/database"
+)
+
+// TestDebits tests the /debits/:sub endpoint.
+func TestDebits(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newTester(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Seed a mix of credits and debits for two subs.
+	ctx := context.Background()
+	sub := "sub"
+	for i := 0; i < 3; i++ {
+		_, err = tester.Payment(fmt.Sprintf("txn%d", i), sub, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tester.Payment(fmt.Sprintf("othertxn%d", i), "othersub", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	charge := func(sub string, price float64) {
+		t.Helper()
+		now := time.Now()
+		s, err := tester.staticDB.NewSubscription(ctx, sub, 2, now, now.Add(time.Hour), price)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tester.staticDB.ChargeSubscription(ctx, s.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prices := []float64{1, 2, 3}
+	for _, price := range prices {
+		charge(sub, price)
+	}
+	charge("othersub", 5)
+
+	// Only the debits of the sub should be returned, newest first.
+	dg, err := tester.Debits(sub, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dg.Total != int64(len(prices)) || dg.NextOffset != nil {
+		t.Fatalf("Unexpected page %+v", dg)
+	}
+	if len(dg.Items) != len(prices) {
+		t.Fatalf("Expected %d debits, got %d", len(prices), len(dg.Items))
+	}
+	for i, debit := range dg.Items {
+		price := prices[len(prices)-1-i]
+		if debit.Sub != sub || debit.Amount != -price {
+			t.Fatalf("Unexpected debit %+v", debit)
+		}
+		if debit.Source != database.TxnSourceSubscription {
+			t.Fatalf("Expected source %s, got %s", database.TxnSourceSubscription, debit.Source)
+		}
+		if i > 0 && debit.CreatedAt.After(dg.Items[i-1].CreatedAt) {
+			t.Fatal("Debits are not ordered from newest to oldest")
+		}
+	}
+
+	// Limit and offset.
+	dg, err = tester.Debits(sub, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dg.Items) != 1 || dg.Items[0].Amount != -prices[1] {
+		t.Fatalf("Unexpected debits %+v", dg.Items)
+	}
+	if dg.Total != int64(len(prices)) || dg.NextOffset == nil || *dg.NextOffset != 2 {
+		t.Fatalf("Unexpected page %+v", dg)
+	}
+
+	// Enormous limits are clamped and the effective limit is reported.
+	dg, err = tester.Debits(sub, 1000000000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dg.Limit != api.DefaultMaxLimit || len(dg.Items) != len(prices) {
+		t.Fatalf("Expected limit to be clamped to %d, got page %+v", api.DefaultMaxLimit, dg)
+	}
+}
+
+// TestTxnMetadata tests that the metadata of payments is stored and returned
+// with their txns.
+func TestTxnMetadata(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newTester(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Pay with metadata.
+	metadata := map[string]string{
+		"orderID": "123",
+		"region":  "eu",
+	}
+	_, err = tester.PaymentWithMetadata("txn", "sub", 10, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn, err := tester.staticDB.GetTxn(context.Background(), "txn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(txn.Metadata, metadata) {
+		t.Fatalf("Expected metadata %v, got %v", metadata, txn.Metadata)
+	}
+
+	// Oversized metadata is rejected.
+	_, err = tester.PaymentWithMetadata("txn2", "sub", 10, map[string]string{
+		"key": strings.Repeat("v", 10000),
+	})
+	if err == nil {
+		t.Fatal("Expected oversized metadata to be rejected")
+	}
+	_, err = tester.staticDB.GetTxn(context.Background(), "txn2")
+	if err == nil {
+		t.Fatal("Expected rejected payment not to be stored")
+	}
+}
+
+// TestReassignTxn tests the /txn/:id/reassign endpoint.
+func TestReassignTxn(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		APIKey: "apikey",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Credit the wrong sub.
+	_, err = tester.Payment("txn", "wrong", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The endpoint requires authentication.
+	_, err = api.NewClient("http://"+tester.staticAPI.Address()).ReassignTxn("txn", "right")
+	if err == nil {
+		t.Fatal("Expected unauthenticated request to fail")
+	}
+
+	// Reassign the txn.
+	trr, err := tester.ReassignTxn("txn", "right")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trr.Txn.ID != "txn" || trr.Txn.Sub != "right" || trr.FromSub != "wrong" {
+		t.Fatalf("Unexpected response %+v", trr)
+	}
+	if trr.FromBalance != 0 || trr.ToBalance != 10 {
+		t.Fatalf("Expected balances 0 and 10, got %v and %v", trr.FromBalance, trr.ToBalance)
+	}
+	for sub, expected := range map[string]float64{"wrong": 0, "right": 10} {
+		bg, err := tester.Balance(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bg.Balance != expected {
+			t.Fatalf("Expected balance %v for sub %s, got %v", expected, sub, bg.Balance)
+		}
+	}
+
+	// Reporting the payment again doesn't credit the wrong sub again.
+	_, err = tester.Payment("txn", "wrong", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bg, err := tester.Balance("wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bg.Balance != 0 {
+		t.Fatalf("Expected balance 0, got %v", bg.Balance)
+	}
+
+	// Unknown txns and empty subs are rejected.
+	if _, err = tester.ReassignTxn("unknown", "right"); err == nil {
+		t.Fatal("Expected reassigning an unknown txn to fail")
+	}
+	if _, err = tester.ReassignTxn("txn", " "); err == nil {
+		t.Fatal("Expected reassigning to an empty sub to fail")
+	}
+}
+
+// TestTxnsSince tests the /txns/since endpoint.
+func TestTxnsSince(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{APIKey: "apikey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Seed some txns.
+	n := 5
+	for i := 0; i < n; i++ {
+		_, err = tester.Payment(fmt.Sprintf("txn%d", i), fmt.Sprintf("sub%d", i%2), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// poll pages through all txns after the cursor and returns the new
+	// cursor. Since new txns are held back for a while, it waits for them
+	// to become visible first.
+	seen := make(map[string]bool)
+	poll := func(after string) string {
+		time.Sleep(2 * testTxnVisibilityLag)
+		for {
+			tsg, err := tester.TxnsSince(after, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tsg.Txns) == 0 {
+				if tsg.Next != after {
+					t.Fatalf("Expected cursor %s to stay, got %s", after, tsg.Next)
+				}
+				return after
+			}
+			for _, txn := range tsg.Txns {
+				if seen[txn.ID] {
+					t.Fatalf("Txn %s was returned twice", txn.ID)
+				}
+				seen[txn.ID] = true
+			}
+			if tsg.Next != tsg.Txns[len(tsg.Txns)-1].ID {
+				t.Fatalf("Expected cursor %s, got %s", tsg.Txns[len(tsg.Txns)-1].ID, tsg.Next)
+			}
+			after = tsg.Next
+		}
+	}
+	cursor := poll("")
+	if len(seen) != n {
+		t.Fatalf("Expected %d txns, got %d", n, len(seen))
+	}
+
+	// Polling again after more txns were processed only returns the new
+	// ones.
+	_, err = tester.Payment("txn5", "sub0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll(cursor)
+	if len(seen) != n+1 || !seen["txn5"] {
+		t.Fatalf("Expected txn5 to be returned, got %v", seen)
+	}
+
+	// Unknown cursors are rejected.
+	_, err = tester.TxnsSince("unknown", 2)
+	if err == nil || !strings.Contains(err.Error(), database.ErrNotFound.Error()) {
+		t.Fatalf("Expected %v, got %v", database.ErrNotFound, err)
+	}
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/promoter/api"
+	"github.com/SkynetLabs/promoter/database"
+)
+
+// TestUserEligible tests the /user/:sub/eligible endpoint.
+func TestUserEligible(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// Create tester.
+	tester, err := newCustomTester(t.Name(), api.Config{
+		Tiers: database.TierConfig{
+			DefaultTier: 1,
+			Prices: map[int]float64{
+				2: 5,
+				3: 20,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tester.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Give the user a balance of 10 and a subscription to tier 2.
+	sub := "sub"
+	_, err = tester.Payment("txn", sub, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	_, err = tester.staticDB.NewSubscription(context.Background(), sub, 2, now.Add(-time.Hour), now.Add(24*time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The user is on tier 2 already.
+	ueg, err := tester.UserEligible(sub, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ueg.Eligible || ueg.Reason != database.EligibleByTier || ueg.CurrentTier != 2 {
+		t.Fatalf("Unexpected response %+v", ueg)
+	}
+
+	// The balance doesn't cover tier 3.
+	ueg, err = tester.UserEligible(sub, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ueg.Eligible || ueg.Reason != database.IneligibleByBalance || ueg.Gap != 10 {
+		t.Fatalf("Unexpected response %+v", ueg)
+	}
+
+	// Tier 4 can only be reached by a subscription.
+	ueg, err = tester.UserEligible(sub, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ueg.Eligible || ueg.Reason != database.IneligibleBySubscription {
+		t.Fatalf("Unexpected response %+v", ueg)
+	}
+
+	// The user didn't get promoted.
+	view, err := tester.staticDB.UserView(context.Background(), sub, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tier := database.TierForUser(view, database.TierConfig{DefaultTier: 1}, now); tier != 2 {
+		t.Fatalf("Expected tier 2, got %d", tier)
+	}
+	if view.Balance != 10 {
+		t.Fatalf("Expected balance 10, got %v", view.Balance)
+	}
+
+	// Empty subs are rejected.
+	_, err = tester.UserEligible(" ", 2)
+	if err == nil || !strings.Contains(err.Error(), api.ErrInvalidSub.Error()) {
+		t.Fatalf("Expected %v, got %v", api.ErrInvalidSub, err)
+	}
+}